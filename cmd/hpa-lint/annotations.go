@@ -0,0 +1,125 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+func annotationsCommand(args []string) int {
+	flags := flag.NewFlagSet("annotations", flag.ExitOnError)
+	var prefix string
+	flags.StringVar(&prefix, "prefix", stub.DefaultAnnotationPrefix, "Domain of the autoscale annotations.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s annotations [-prefix domain] [file ...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	handler, err := stub.NewHandler(nil, nil, stub.Options{AnnotationPrefix: prefix})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	failed := false
+	for _, file := range files {
+		ok, err := processFile(file, func(source string, in io.Reader) (bool, error) {
+			return annotations(handler, source, in, os.Stdout, os.Stderr)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			return 2
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// annotations prints the autoscale annotations of every HorizontalPodAutoscaler in the manifests
+// read from in to out, and reports what can't be expressed by annotations to errOut. It returns
+// false if anything was left out.
+func annotations(handler *stub.HPAHandler, source string, in io.Reader, out io.Writer, errOut io.Writer) (bool, error) {
+	reader := yaml.NewYAMLReader(bufio.NewReader(in))
+	decoder := clientgoscheme.Codecs.UniversalDeserializer()
+	complete := true
+	for document := 1; ; document++ {
+		data, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return complete, nil
+			}
+			return false, fmt.Errorf("document %d: %v", document, err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+
+		typeMeta := metav1.TypeMeta{}
+		if err := sigsyaml.Unmarshal(data, &typeMeta); err != nil {
+			return false, fmt.Errorf("document %d: %v", document, err)
+		}
+		if typeMeta.Kind != "HorizontalPodAutoscaler" {
+			continue
+		}
+		hpa, _, err := decoder.Decode(data, nil, nil)
+		if err != nil {
+			return false, fmt.Errorf("document %d: %v", document, err)
+		}
+		converted, err := stub.ConvertHorizontalPodAutoscaler(hpa)
+		if err != nil {
+			complete = false
+			fmt.Fprintf(errOut, "%s: document %d: %v\n", source, document, err)
+			continue
+		}
+
+		annotations, errs := handler.AnnotationsFromHorizontalPodAutoscaler(converted)
+		for _, e := range errs {
+			complete = false
+			fmt.Fprintf(errOut, "%s: document %d: HorizontalPodAutoscaler %s: %v\n", source, document, converted.Name, e)
+		}
+
+		data, err = sigsyaml.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": annotations,
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		target := converted.Spec.ScaleTargetRef
+		fmt.Fprintf(out, "---\n# HorizontalPodAutoscaler %s -> %s %s\n%s", converted.Name, target.Kind, target.Name, data)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// hpa-lint validates the autoscale annotations of the Deployments and StatefulSets found in
+// multi-document YAML manifests and renders the HorizontalPodAutoscalers the operator would create.
+// It never talks to a cluster.
+//
+//	hpa-lint [-q] [-prefix domain] [-presets file] [file ...]
+//
+// The annotations subcommand does the reverse, it prints the autoscale annotations equivalent to
+// the HorizontalPodAutoscalers found in the manifests, to migrate them to annotations.
+//
+//	hpa-lint annotations [-prefix domain] [file ...]
+//
+// Manifests are read from stdin if no file, or "-", is given. The exit code is 1 if any
+// autoscale annotation is invalid, or any HorizontalPodAutoscaler can't be expressed by annotations.
+// Annotations set to different values on a workload and on its pod template are reported as warnings.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// workload holds the fields of a Deployment or StatefulSet, in any API version, the HPA is generated from
+type workload struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Selector *metav1.LabelSelector `json:"selector,omitempty"`
+		Template struct {
+			metav1.ObjectMeta `json:"metadata,omitempty"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "annotations" {
+		os.Exit(annotationsCommand(os.Args[2:]))
+	}
+
+	var quiet bool
+	var prefix string
+	var presetsFile string
+	flag.BoolVar(&quiet, "q", false, "Only report validation errors, don't print the rendered HorizontalPodAutoscalers.")
+	flag.StringVar(&prefix, "prefix", stub.DefaultAnnotationPrefix, "Domain of the autoscale annotations.")
+	flag.StringVar(&presetsFile, "presets", "", "YAML file of the metric presets configured for the operator.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-q] [-prefix domain] [-presets file] [file ...]\n       %s annotations [-prefix domain] [file ...]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var out io.Writer = os.Stdout
+	if quiet {
+		out = nil
+	}
+	options := stub.Options{AnnotationPrefix: prefix}
+	if presetsFile != "" {
+		presets, err := stub.LoadMetricPresets(presetsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		options.MetricPresets = presets
+	}
+	handler, err := stub.NewHandler(nil, &warningRecorder{out: os.Stderr}, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	failed := false
+	for _, file := range files {
+		ok, err := processFile(file, func(source string, in io.Reader) (bool, error) {
+			return lint(handler, source, in, out, os.Stderr)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			os.Exit(2)
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// warningRecorder prints the events of the handler, e.g. conflicting annotations, as warnings
+type warningRecorder struct {
+	out io.Writer
+}
+
+func (r *warningRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if ref, ok := object.(*corev1.ObjectReference); ok {
+		fmt.Fprintf(r.out, "warning: %s %s: %s\n", ref.Kind, ref.Name, message)
+		return
+	}
+	fmt.Fprintf(r.out, "warning: %s\n", message)
+}
+
+func (r *warningRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *warningRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (r *warningRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// processFile calls process with the contents of file, or stdin if file is "-"
+func processFile(file string, process func(source string, in io.Reader) (bool, error)) (bool, error) {
+	if file == "-" {
+		return process("<stdin>", os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return process(file, f)
+}
+
+// lint renders the HPA of every workload in the manifests read from in to out, and reports the
+// invalid autoscale annotations to errOut. It returns false if any annotation is invalid.
+func lint(handler *stub.HPAHandler, source string, in io.Reader, out io.Writer, errOut io.Writer) (bool, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(in, 4096)
+	valid := true
+	for document := 1; ; document++ {
+		w := workload{}
+		if err := decoder.Decode(&w); err != nil {
+			if err == io.EOF {
+				return valid, nil
+			}
+			return false, fmt.Errorf("document %d: %v", document, err)
+		}
+		if w.Kind != "Deployment" && w.Kind != "StatefulSet" {
+			continue
+		}
+
+		hpa, err := handler.DesiredHorizontalPodAutoscaler(context.Background(), w.UID, w.Name, w.Namespace,
+			w.Kind, w.APIVersion, w.Annotations, w.Spec.Template.Annotations, w.Spec.Selector)
+		if err != nil {
+			valid = false
+			if invalid, ok := err.(*stub.InvalidAnnotationsError); ok {
+				for _, e := range invalid.Errors {
+					fmt.Fprintf(errOut, "%s: document %d: %s %s: %v\n", source, document, w.Kind, w.Name, e)
+				}
+			} else {
+				fmt.Fprintf(errOut, "%s: document %d: %s %s: %v\n", source, document, w.Kind, w.Name, err)
+			}
+		}
+		if hpa == nil || out == nil {
+			continue
+		}
+
+		// the owner's UID is only known in the cluster
+		hpa.OwnerReferences = nil
+		data, err := sigsyaml.Marshal(hpa)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "---\n%s", data)
+	}
+}
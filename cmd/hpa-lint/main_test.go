@@ -0,0 +1,153 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+)
+
+func TestLint(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		manifests     string
+		expectedValid bool
+		expectedOut   []string
+		expectedErr   []string
+	}{
+		{
+			name: "valid deployment",
+			manifests: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: example
+  annotations:
+    hpa.autoscaling.banzaicloud.io/minReplicas: "1"
+    hpa.autoscaling.banzaicloud.io/maxReplicas: "3"
+    cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization: "70"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: example
+`,
+			expectedValid: true,
+			expectedOut:   []string{"kind: HorizontalPodAutoscaler", "name: example", "averageUtilization: 70"},
+		},
+		{
+			name: "invalid pod template annotations",
+			manifests: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: example
+spec:
+  template:
+    metadata:
+      annotations:
+        hpa.autoscaling.banzaicloud.io/minReplicas: "1"
+        cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization: "70"
+`,
+			expectedValid: false,
+			expectedErr:   []string{"document 1: StatefulSet example: hpa.autoscaling.banzaicloud.io/maxReplicas annotation is missing"},
+		},
+		{
+			name: "workload and pod template annotations are merged",
+			manifests: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: example
+  annotations:
+    autoscaling.banzaicloud.io/annotation-merge: Workload
+    hpa.autoscaling.banzaicloud.io/minReplicas: "1"
+    hpa.autoscaling.banzaicloud.io/maxReplicas: "4"
+spec:
+  template:
+    metadata:
+      annotations:
+        hpa.autoscaling.banzaicloud.io/maxReplicas: "8"
+        cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization: "70"
+`,
+			expectedValid: true,
+			expectedOut:   []string{"maxReplicas: 4", "averageUtilization: 70"},
+			expectedErr:   []string{"warning: Deployment example: Autoscale annotations are set to different values on the Deployment and its pod template, the Deployment values are used: hpa.autoscaling.banzaicloud.io/maxReplicas"},
+		},
+		{
+			name: "deprecated annotations",
+			manifests: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: example
+  annotations:
+    hpa.autoscaling.banzaicloud.io/minReplicas: "1"
+    hpa.autoscaling.banzaicloud.io/maxReplicas: "4"
+    pod.hpa.autoscaling.banzaicloud.io/http_requests: "10"
+`,
+			expectedValid: true,
+			expectedOut:   []string{"type: External", "query-name: podHttpRequests"},
+			expectedErr: []string{"warning: Deployment example: Deprecated autoscale annotations are used on the Deployment: pod.hpa.autoscaling.banzaicloud.io/http_requests " +
+				"(use prometheus.podHttpRequests.hpa.autoscaling.banzaicloud.io/query, prometheus.podHttpRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue)"},
+		},
+		{
+			name: "workload without autoscale annotations",
+			manifests: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: example
+`,
+			expectedValid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			errOut := &bytes.Buffer{}
+			handler, err := stub.NewHandler(nil, &warningRecorder{out: errOut}, stub.Options{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			valid, err := lint(handler, "test.yaml", strings.NewReader(test.manifests), out, errOut)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if valid != test.expectedValid {
+				t.Errorf("Valid expected: %v actual: %v (%s)", test.expectedValid, valid, errOut.String())
+			}
+			for _, expected := range test.expectedOut {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("Output is missing %q:\n%s", expected, out.String())
+				}
+			}
+			for _, expected := range test.expectedErr {
+				if !strings.Contains(errOut.String(), expected) {
+					t.Errorf("Errors are missing %q:\n%s", expected, errOut.String())
+				}
+			}
+			if len(test.expectedOut) == 0 && out.Len() > 0 {
+				t.Errorf("Unexpected output:\n%s", out.String())
+			}
+		})
+	}
+}
@@ -5,9 +5,12 @@ go 1.13
 require (
 	github.com/go-logr/logr v0.1.0
 	github.com/google/uuid v1.1.1
-	github.com/sirupsen/logrus v1.4.2
-	k8s.io/api v0.0.0-20190918155943-95b840bb6a1f
-	k8s.io/apimachinery v0.0.0-20190913080033-27d36303b655
-	k8s.io/client-go v0.0.0-20190918160344-1fbdaa4c8d90
+	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/prometheus v0.0.0-20200609090129-a6600f564e3c
+	go.uber.org/zap v1.13.0
+	k8s.io/api v0.17.5
+	k8s.io/apimachinery v0.17.5
+	k8s.io/client-go v0.17.5
 	sigs.k8s.io/controller-runtime v0.4.0
+	sigs.k8s.io/yaml v1.1.0
 )
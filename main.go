@@ -17,15 +17,24 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/banzaicloud/hpa-operator/pkg/stub"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/banzaicloud/hpa-operator/pkg/config"
 	"github.com/banzaicloud/hpa-operator/pkg/controllers"
+	uzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	// +kubebuilder:scaffold:imports
 )
@@ -45,41 +54,257 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var development bool
+	var logLevel string
+	var watchNamespaces string
+	var namespaceSelector string
+	var workloadSelector string
+	var annotationPrefix string
+	var instanceID string
+	var rewriteDeprecatedAnnotations bool
+	var autoscalerBackend string
+	var kedaPrometheusAddress string
+	var metricsAdapter string
+	var prometheusAdapterConfigMap string
+	var metricPresetsFile string
+	var dryRun bool
+	var introspectionAddr string
+	var healthProbeAddr string
+	var reconcileTimeout time.Duration
+	var configFile string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&development, "development", false,
+		"Development mode logs human readable lines instead of JSON and defaults the log level to debug.")
+	flag.StringVar(&logLevel, "log-level", "",
+		"Minimum log level: debug, info, error or a positive integer verbosity. Defaults to info, or debug in development mode.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated list of namespaces to watch. All namespaces are watched if empty.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector restricting the watched namespaces. Can't be combined with watch-namespaces.")
+	flag.StringVar(&workloadSelector, "workload-selector", "",
+		"Label selector restricting the handled Deployments and StatefulSets.")
+	flag.StringVar(&annotationPrefix, "annotation-prefix", stub.DefaultAnnotationPrefix,
+		"Domain of the autoscale annotations, e.g. hpa.example.com for cpu.hpa.example.com/targetAverageUtilization.")
+	flag.StringVar(&instanceID, "instance-id", "",
+		"ID of this operator instance, put into a label of the created HPAs. Instances running side by side need different IDs, they leave each other's HPAs alone.")
+	flag.BoolVar(&rewriteDeprecatedAnnotations, "rewrite-deprecated-annotations", false,
+		"Replace the deprecated autoscale annotation keys on the Deployments and StatefulSets by the keys of the current schema.")
+	flag.StringVar(&autoscalerBackend, "autoscaler-backend", stub.BackendHPA,
+		"Autoscaler generated from the autoscale annotations: HPA, or KEDA for KEDA ScaledObjects. Workloads may select another one by annotation.")
+	flag.StringVar(&kedaPrometheusAddress, "keda-prometheus-address", "",
+		"Address of the Prometheus server queried by the prometheus triggers of the KEDA ScaledObjects, e.g. http://prometheus.monitoring:9090.")
+	flag.StringVar(&metricsAdapter, "metrics-adapter", stub.MetricsAdapterKube,
+		"Adapter serving the prometheus metrics of the HPAs: kube-metrics-adapter, or prometheus-adapter to maintain its rules.")
+	flag.StringVar(&prometheusAdapterConfigMap, "prometheus-adapter-configmap", "",
+		"Namespace/name of the prometheus-adapter ConfigMap the rules are written into, required with --metrics-adapter=prometheus-adapter.")
+	flag.StringVar(&metricPresetsFile, "metric-presets", "",
+		"YAML file of metric presets by name, added to the built-in ones. Presets of the same name replace the built-in ones.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Compute the changes to the HPAs and the other generated objects without making them: they are sent as server-side dry-run requests and reported by logs, events and metrics.")
+	flag.StringVar(&introspectionAddr, "introspection-addr", "",
+		"The address the introspection API, listing the autoscaled workloads and their state, binds to. Disabled if empty.")
+	flag.StringVar(&healthProbeAddr, "health-probe-addr", ":9440",
+		"The address the healthz and readyz endpoints bind to.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 0,
+		"Fail the readyz check of the leader when no workload was reconciled successfully for this long, e.g. 1h. Disabled if 0.")
+	flag.StringVar(&configFile, "config", "",
+		"YAML file of the configuration, setting the flags above by their camel case names, e.g. watchNamespaces, and metricPresets. "+
+			"Its settings replace the flags. It's reloaded when it changes, the watched namespaces, a namespace selector not set at start, the instance ID and metrics adapter on restart only.")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(func(o *zap.Options) {
-		o.Development = true
-	}))
+	// the level is replaced when the configuration file is reloaded
+	level := uzap.NewAtomicLevelAt(defaultLogLevel(development))
+	if logLevel != "" {
+		parsed, err := config.ParseLogLevel(logLevel)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		level.SetLevel(parsed)
+	}
+	ctrl.SetLogger(zap.New(zap.UseDevMode(development), zap.Level(&level)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		LeaderElection:     enableLeaderElection,
-		Port:               9443,
-	})
+	baseConfig := config.Config{
+		LogLevel:                     logLevel,
+		NamespaceSelector:            namespaceSelector,
+		WorkloadSelector:             workloadSelector,
+		AnnotationPrefix:             annotationPrefix,
+		InstanceID:                   instanceID,
+		RewriteDeprecatedAnnotations: rewriteDeprecatedAnnotations,
+		AutoscalerBackend:            autoscalerBackend,
+		KEDAPrometheusAddress:        kedaPrometheusAddress,
+		MetricsAdapter:               metricsAdapter,
+		PrometheusAdapterConfigMap:   prometheusAdapterConfigMap,
+		DryRun:                       dryRun,
+	}
+	if watchNamespaces != "" {
+		baseConfig.WatchNamespaces = strings.Split(watchNamespaces, ",")
+	}
+	if metricPresetsFile != "" {
+		var err error
+		baseConfig.MetricPresets, err = stub.LoadMetricPresets(metricPresetsFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load metric presets")
+			os.Exit(1)
+		}
+	}
+	operatorConfig := baseConfig
+	if configFile != "" {
+		var err error
+		operatorConfig, err = config.Load(configFile, baseConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load configuration")
+			os.Exit(1)
+		}
+	}
+	if err := operatorConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	setLogLevel(&level, operatorConfig.LogLevel, development)
+	scope, err := operatorConfig.Scope()
+	if err != nil {
+		setupLog.Error(err, "invalid scope")
+		os.Exit(1)
+	}
+	if operatorConfig.AnnotationPrefix != stub.DefaultAnnotationPrefix && operatorConfig.InstanceID == "" {
+		setupLog.Info("instance-id is not set, this instance takes over the HPAs of the instances without ID, " +
+			"including the ones using a different annotation prefix")
+	}
+
+	// instances elect their leaders separately
+	leaderElectionID := "hpa-operator-leader-election"
+	if operatorConfig.InstanceID != "" {
+		leaderElectionID += "-" + operatorConfig.InstanceID
+	}
+	options := ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     metricsAddr,
+		HealthProbeBindAddress: healthProbeAddr,
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       leaderElectionID,
+		Port:                   9443,
+	}
+	switch len(scope.Namespaces) {
+	case 0:
+	case 1:
+		options.Namespace = scope.Namespaces[0]
+	default:
+		options.NewCache = cache.MultiNamespacedCacheBuilder(scope.Namespaces)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	handler := stub.NewHandler(mgr.GetClient())
+	handler, err := stub.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("hpa-operator"), operatorConfig.HandlerOptions())
+	if err != nil {
+		setupLog.Error(err, "unable to create handler")
+		os.Exit(1)
+	}
+	// the selectors of the scope are replaced when the configuration file is reloaded
+	reconcilerScope := controllers.NewScope(scope)
+	requeuer := controllers.NewRequeuer(ctrl.Log.WithName("requeuer"))
+	if err = mgr.Add(requeuer); err != nil {
+		setupLog.Error(err, "unable to add requeuer")
+		os.Exit(1)
+	}
 	deploymentReconciler := controllers.NewDeploymentReconciler(
-		mgr.GetClient(), ctrl.Log.WithName("controllers").WithName("Deployment"), mgr.GetScheme(), handler)
+		mgr.GetClient(), ctrl.Log.WithName("controllers").WithName("Deployment"), mgr.GetScheme(), handler, reconcilerScope, requeuer)
 	if err = deploymentReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Deployment")
 		os.Exit(1)
 	}
 
 	statefulsetReconciler := controllers.NewStatefulsSetReconciler(
-		mgr.GetClient(), ctrl.Log.WithName("controllers").WithName("StatefulSet"), mgr.GetScheme(), handler)
+		mgr.GetClient(), ctrl.Log.WithName("controllers").WithName("StatefulSet"), mgr.GetScheme(), handler, reconcilerScope, requeuer)
 	if err = statefulsetReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "StatefulSet")
 		os.Exit(1)
 	}
 
+	if operatorConfig.MetricsAdapter == stub.MetricsAdapterPrometheus {
+		prometheusAdapterReconciler := controllers.NewPrometheusAdapterReconciler(
+			ctrl.Log.WithName("controllers").WithName("PrometheusAdapter"), handler)
+		if err = prometheusAdapterReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PrometheusAdapter")
+			os.Exit(1)
+		}
+	}
+
+	if introspectionAddr != "" {
+		introspectionServer := controllers.NewIntrospectionServer(introspectionAddr,
+			mgr.GetClient(), ctrl.Log.WithName("introspection"), handler, reconcilerScope)
+		if err = mgr.Add(introspectionServer); err != nil {
+			setupLog.Error(err, "unable to add introspection server")
+			os.Exit(1)
+		}
+	}
+
+	// the operator serves no admission webhooks, the replicas are ready once their caches are synced
+	cacheSyncCheck := controllers.NewCacheSyncCheck(mgr.GetCache())
+	if err = mgr.Add(cacheSyncCheck); err != nil {
+		setupLog.Error(err, "unable to add cache sync check")
+		os.Exit(1)
+	}
+	if err = mgr.AddReadyzCheck("cache-sync", cacheSyncCheck.Check); err != nil {
+		setupLog.Error(err, "unable to add readyz check")
+		os.Exit(1)
+	}
+	if err = mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to add healthz check")
+		os.Exit(1)
+	}
+	if reconcileTimeout > 0 {
+		reconcileCheck := controllers.NewReconcileCheck(handler, reconcileTimeout)
+		if err = mgr.Add(reconcileCheck); err != nil {
+			setupLog.Error(err, "unable to add reconcile check")
+			os.Exit(1)
+		}
+		// a readiness check, a liveness check would restart the leader of a quiet cluster in a loop
+		if err = mgr.AddReadyzCheck("reconcile", reconcileCheck.Check); err != nil {
+			setupLog.Error(err, "unable to add readyz check")
+			os.Exit(1)
+		}
+	}
+
+	if configFile != "" {
+		watcher := config.NewWatcher(configFile, baseConfig, operatorConfig, config.DefaultReloadInterval, ctrl.Log.WithName("config"),
+			func(previous config.Config, next config.Config) error {
+				scopeChanged := previous.NamespaceSelector != next.NamespaceSelector ||
+					previous.WorkloadSelector != next.WorkloadSelector
+				nextScope, err := next.Scope()
+				if err != nil {
+					return err
+				}
+				handlerChanged := !reflect.DeepEqual(previous.HandlerOptions(), next.HandlerOptions())
+				if handlerChanged {
+					if err := handler.Reload(next.HandlerOptions()); err != nil {
+						return err
+					}
+				}
+				if scopeChanged {
+					if err := reconcilerScope.Reload(nextScope); err != nil {
+						return err
+					}
+				}
+				// the workloads entering the scope are picked up by the requeue
+				if handlerChanged || scopeChanged {
+					requeuer.RequeueAll()
+				}
+				setLogLevel(&level, next.LogLevel, development)
+				return nil
+			})
+		if err = mgr.Add(watcher); err != nil {
+			setupLog.Error(err, "unable to add configuration watcher")
+			os.Exit(1)
+		}
+	}
+
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -88,3 +313,21 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// defaultLogLevel is the log level used unless one is configured
+func defaultLogLevel(development bool) zapcore.Level {
+	if development {
+		return zapcore.DebugLevel
+	}
+	return zapcore.InfoLevel
+}
+
+// setLogLevel sets level to the configured value, or to the default one if it's empty.
+// The value is expected to be validated.
+func setLogLevel(level *uzap.AtomicLevel, value string, development bool) {
+	parsed := defaultLogLevel(development)
+	if value != "" {
+		parsed, _ = config.ParseLogLevel(value)
+	}
+	level.SetLevel(parsed)
+}
@@ -0,0 +1,189 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config reads the configuration of the operator from its flags and from an optional
+// YAML file, which is reloaded when it changes.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration of the operator. The fields are named after the flags setting them,
+// the file sets the same fields in camel case, e.g. watchNamespaces: [team-a, team-b].
+type Config struct {
+	// LogLevel is debug, info, error or a positive integer verbosity, the default of the log mode if empty
+	LogLevel string `json:"logLevel,omitempty"`
+	// WatchNamespaces lists the watched namespaces, every namespace is watched if empty
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// NamespaceSelector restricts the watched namespaces by their labels
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// WorkloadSelector restricts the handled Deployments and StatefulSets by their labels
+	WorkloadSelector             string                       `json:"workloadSelector,omitempty"`
+	AnnotationPrefix             string                       `json:"annotationPrefix,omitempty"`
+	InstanceID                   string                       `json:"instanceId,omitempty"`
+	RewriteDeprecatedAnnotations bool                         `json:"rewriteDeprecatedAnnotations,omitempty"`
+	AutoscalerBackend            string                       `json:"autoscalerBackend,omitempty"`
+	KEDAPrometheusAddress        string                       `json:"kedaPrometheusAddress,omitempty"`
+	MetricsAdapter               string                       `json:"metricsAdapter,omitempty"`
+	PrometheusAdapterConfigMap   string                       `json:"prometheusAdapterConfigMap,omitempty"`
+	MetricPresets                map[string]stub.MetricPreset `json:"metricPresets,omitempty"`
+	DryRun                       bool                         `json:"dryRun,omitempty"`
+}
+
+// Load returns base, the configuration set by the flags, with the fields set by file replaced
+func Load(file string, base Config) (Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Config{}, err
+	}
+	return parse(file, data, base)
+}
+
+func parse(file string, data []byte, base Config) (Config, error) {
+	config := base
+	// the file replaces the lists and the maps of base, base is left alone
+	config.WatchNamespaces = nil
+	config.MetricPresets = nil
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return Config{}, fmt.Errorf("configuration %s is invalid: %v", file, err)
+	}
+	if config.WatchNamespaces == nil {
+		config.WatchNamespaces = base.WatchNamespaces
+	}
+	if config.MetricPresets == nil {
+		config.MetricPresets = base.MetricPresets
+	}
+	return config, nil
+}
+
+// Validate checks the log level, the scope and the handler options
+func (c Config) Validate() error {
+	if _, err := ParseLogLevel(c.LogLevel); c.LogLevel != "" && err != nil {
+		return err
+	}
+	if _, err := c.Scope(); err != nil {
+		return err
+	}
+	return c.HandlerOptions().Validate()
+}
+
+// HandlerOptions returns the options of the handler
+func (c Config) HandlerOptions() stub.Options {
+	return stub.Options{
+		AnnotationPrefix:             c.AnnotationPrefix,
+		InstanceID:                   c.InstanceID,
+		RewriteDeprecatedAnnotations: c.RewriteDeprecatedAnnotations,
+		Backend:                      c.AutoscalerBackend,
+		KEDAPrometheusAddress:        c.KEDAPrometheusAddress,
+		MetricsAdapter:               c.MetricsAdapter,
+		PrometheusAdapterConfigMap:   c.PrometheusAdapterConfigMap,
+		MetricPresets:                c.MetricPresets,
+		DryRun:                       c.DryRun,
+	}
+}
+
+// Scope returns the scope of the reconcilers
+func (c Config) Scope() (Scope, error) {
+	scope := Scope{}
+	for _, namespace := range c.WatchNamespaces {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			scope.Namespaces = append(scope.Namespaces, namespace)
+		}
+	}
+	if c.NamespaceSelector != "" {
+		// the namespaced cache can't serve cluster scoped Namespace objects
+		if len(scope.Namespaces) > 0 {
+			return scope, fmt.Errorf("namespace-selector can't be combined with watch-namespaces")
+		}
+		selector, err := labels.Parse(c.NamespaceSelector)
+		if err != nil {
+			return scope, fmt.Errorf("invalid namespace-selector: %v", err)
+		}
+		scope.NamespaceSelector = selector
+	}
+	if c.WorkloadSelector != "" {
+		selector, err := labels.Parse(c.WorkloadSelector)
+		if err != nil {
+			return scope, fmt.Errorf("invalid workload-selector: %v", err)
+		}
+		scope.WorkloadSelector = selector
+	}
+	return scope, nil
+}
+
+// restartSettings are the settings the manager, its cache and its controllers are set up with,
+// they are applied on restart only. The namespaces are watched only while a namespace selector is
+// set, so one can be changed on reload but can't be set where none is.
+func (c Config) restartSettings(namespaceSelector bool) map[string]interface{} {
+	settings := map[string]interface{}{
+		"watchNamespaces":            strings.Join(c.WatchNamespaces, ","),
+		"instanceId":                 c.InstanceID,
+		"metricsAdapter":             c.MetricsAdapter,
+		"prometheusAdapterConfigMap": c.PrometheusAdapterConfigMap,
+	}
+	if !namespaceSelector {
+		settings["namespaceSelector"] = c.NamespaceSelector
+	}
+	return settings
+}
+
+// Reloaded returns next, a reloaded configuration, with the settings applied on restart only kept
+// from c. The names of the kept settings which differ in next are returned too.
+func (c Config) Reloaded(next Config) (Config, []string) {
+	var pending []string
+	namespaceSelector := c.NamespaceSelector != ""
+	current := c.restartSettings(namespaceSelector)
+	for name, value := range next.restartSettings(namespaceSelector) {
+		if !reflect.DeepEqual(value, current[name]) {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+	next.WatchNamespaces = c.WatchNamespaces
+	if !namespaceSelector {
+		next.NamespaceSelector = c.NamespaceSelector
+	}
+	next.InstanceID = c.InstanceID
+	next.MetricsAdapter = c.MetricsAdapter
+	next.PrometheusAdapterConfigMap = c.PrometheusAdapterConfigMap
+	return next, pending
+}
+
+// ParseLogLevel accepts a zap level name or a logr verbosity, where verbosity n
+// enables every log.V(n) call and below.
+func ParseLogLevel(value string) (zapcore.Level, error) {
+	var level zapcore.Level
+	if verbosity, err := strconv.Atoi(value); err == nil {
+		if verbosity < 0 {
+			return level, fmt.Errorf("invalid log level %q: verbosity must not be negative", value)
+		}
+		return zapcore.Level(-verbosity), nil
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("invalid log level %q: %v", value, err)
+	}
+	return level, nil
+}
@@ -0,0 +1,186 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	logrtesting "github.com/go-logr/logr/testing"
+)
+
+func TestParse(t *testing.T) {
+
+	base := Config{LogLevel: "info", WatchNamespaces: []string{"team-a"}, AnnotationPrefix: "example.com"}
+	config, err := parse("config.yaml", []byte("watchNamespaces: [team-b, team-c]\ndryRun: true\n"), base)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := Config{LogLevel: "info", WatchNamespaces: []string{"team-b", "team-c"}, AnnotationPrefix: "example.com", DryRun: true}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Config expected: %+v actual: %+v", expected, config)
+	}
+	if !reflect.DeepEqual(base.WatchNamespaces, []string{"team-a"}) {
+		t.Errorf("The base configuration shouldn't be changed: %+v", base)
+	}
+
+	config, err = parse("config.yaml", []byte("dryRun: false\n"), base)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(config, base) {
+		t.Errorf("Config expected: %+v actual: %+v", base, config)
+	}
+
+	if _, err := parse("config.yaml", []byte("namespaces: [team-b]\n"), base); err == nil {
+		t.Errorf("Unknown fields should be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	tests := []struct {
+		config   Config
+		expected string
+	}{
+		{Config{}, ""},
+		{Config{LogLevel: "2", WatchNamespaces: []string{"team-a"}}, ""},
+		{Config{LogLevel: "verbose"}, `invalid log level "verbose": unrecognized level: "verbose"`},
+		{Config{WatchNamespaces: []string{"team-a"}, NamespaceSelector: "team"}, "namespace-selector can't be combined with watch-namespaces"},
+		{Config{AutoscalerBackend: "unknown"}, `autoscaler backend "unknown" is invalid, it should be HPA or KEDA`},
+	}
+	for _, test := range tests {
+		err := test.config.Validate()
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %+v: %v", test.config, err)
+			}
+		} else if err == nil || err.Error() != test.expected {
+			t.Errorf("Error expected for %+v: %v actual: %v", test.config, test.expected, err)
+		}
+	}
+}
+
+func TestReloaded(t *testing.T) {
+
+	current := Config{WatchNamespaces: []string{"team-a"}, InstanceID: "canary", AnnotationPrefix: "example.com"}
+	next, pending := current.Reloaded(Config{
+		WatchNamespaces:  []string{"team-b"},
+		WorkloadSelector: "autoscaled=true",
+		InstanceID:       "canary",
+		AnnotationPrefix: "example.org",
+	})
+	expected := Config{
+		WatchNamespaces:  []string{"team-a"},
+		WorkloadSelector: "autoscaled=true",
+		InstanceID:       "canary",
+		AnnotationPrefix: "example.org",
+	}
+	if !reflect.DeepEqual(next, expected) {
+		t.Errorf("Config expected: %+v actual: %+v", expected, next)
+	}
+	if !reflect.DeepEqual(pending, []string{"watchNamespaces"}) {
+		t.Errorf("Pending settings expected: [watchNamespaces] actual: %v", pending)
+	}
+}
+
+func TestReloadedNamespaceSelector(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		current         string
+		next            string
+		expected        string
+		expectedPending []string
+	}{
+		{name: "changed", current: "team=a", next: "team=b", expected: "team=b"},
+		{name: "removed", current: "team=a", next: "", expected: ""},
+		{name: "set", current: "", next: "team=b", expected: "", expectedPending: []string{"namespaceSelector"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next, pending := Config{NamespaceSelector: test.current}.Reloaded(Config{NamespaceSelector: test.next})
+			if next.NamespaceSelector != test.expected {
+				t.Errorf("Namespace selector expected: %q actual: %q", test.expected, next.NamespaceSelector)
+			}
+			if !reflect.DeepEqual(pending, test.expectedPending) {
+				t.Errorf("Pending settings expected: %v actual: %v", test.expectedPending, pending)
+			}
+		})
+	}
+}
+
+func TestWatcher(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	write("instanceId: canary\n")
+	base := Config{AnnotationPrefix: "example.com"}
+	current, err := Load(file, base)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var changes []Config
+	var failure error
+	watcher := NewWatcher(file, base, current, DefaultReloadInterval, logrtesting.NullLogger{},
+		func(previous Config, next Config) error {
+			if failure != nil {
+				return failure
+			}
+			changes = append(changes, next)
+			return nil
+		})
+
+	watcher.reload()
+	if len(changes) != 0 {
+		t.Errorf("No change expected, actual: %+v", changes)
+	}
+
+	write("instanceId: other\ndryRun: true\n")
+	watcher.reload()
+	expected := []Config{{AnnotationPrefix: "example.com", InstanceID: "canary", DryRun: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes expected: %+v actual: %+v", expected, changes)
+	}
+
+	write("logLevel: verbose\n")
+	watcher.reload()
+	if len(changes) != 1 || !reflect.DeepEqual(watcher.current, expected[0]) {
+		t.Errorf("An invalid configuration shouldn't be applied: %+v", watcher.current)
+	}
+
+	failure = fmt.Errorf("failure")
+	write("instanceId: canary\n")
+	watcher.reload()
+	if len(changes) != 1 || !reflect.DeepEqual(watcher.current, expected[0]) {
+		t.Errorf("A configuration which fails to apply shouldn't be kept: %+v", watcher.current)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Scope restricts the workloads handled by the reconcilers. The zero value matches every workload.
+// Workloads which leave the scope keep their HPA, it is neither updated nor deleted.
+type Scope struct {
+	// Namespaces lists the watched namespaces, every namespace is watched if empty.
+	// The manager cache is expected to be restricted to the same namespaces.
+	Namespaces []string
+	// NamespaceSelector restricts the watched namespaces by their labels
+	NamespaceSelector labels.Selector
+	// WorkloadSelector restricts the handled Deployments and StatefulSets by their labels
+	WorkloadSelector labels.Selector
+}
+
+// NamespaceListed tells whether namespace is one of the watched namespaces, regardless of its labels.
+func (s Scope) NamespaceListed(namespace string) bool {
+	if len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range s.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkloadMatches tells whether the workload is in a listed namespace and matches the workload
+// selector. The labels of its namespace are checked by the reconcilers.
+func (s Scope) WorkloadMatches(meta metav1.Object) bool {
+	if !s.NamespaceListed(meta.GetNamespace()) {
+		return false
+	}
+	return s.WorkloadSelector == nil || s.WorkloadSelector.Matches(labels.Set(meta.GetLabels()))
+}
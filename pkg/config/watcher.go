@@ -0,0 +1,112 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DefaultReloadInterval is the interval the configuration file is checked for changes at. The
+// kubelet takes up to a minute to update a file mounted from a ConfigMap anyway.
+const DefaultReloadInterval = 10 * time.Second
+
+// Watcher reloads the configuration file when it changes. Invalid configurations are reported and
+// skipped, the settings applied on restart only are kept. It's a manager.Runnable run by every replica.
+type Watcher struct {
+	file     string
+	base     Config
+	current  Config
+	interval time.Duration
+	log      logr.Logger
+	onChange func(previous Config, next Config) error
+	// data is the content of the file the last time it was read
+	data []byte
+}
+
+// NewWatcher returns a watcher of file, which sets the fields of base, the configuration set by the
+// flags. The current configuration was loaded from file at startup. onChange applies the next
+// configuration whenever the reloaded one differs, the previous one is kept if it fails.
+func NewWatcher(file string, base Config, current Config, interval time.Duration, log logr.Logger,
+	onChange func(previous Config, next Config) error) *Watcher {
+
+	return &Watcher{
+		file:     file,
+		base:     base,
+		current:  current,
+		interval: interval,
+		log:      log,
+		onChange: onChange,
+	}
+}
+
+// Start checks the file at every interval until stop is closed
+func (w *Watcher) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			w.reload()
+		}
+	}
+}
+
+// NeedLeaderElection returns false, every replica applies the configuration
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+// reload reads the file and applies it if its content changed
+func (w *Watcher) reload() {
+	data, err := ioutil.ReadFile(w.file)
+	if err != nil {
+		w.log.Error(err, "unable to read the configuration, the current one is kept")
+		return
+	}
+	if w.data != nil && bytes.Equal(data, w.data) {
+		return
+	}
+	w.data = data
+
+	loaded, err := parse(w.file, data, w.base)
+	if err == nil {
+		err = loaded.Validate()
+	}
+	if err != nil {
+		w.log.Error(err, "invalid configuration, the current one is kept")
+		return
+	}
+	next, pending := w.current.Reloaded(loaded)
+	if len(pending) > 0 {
+		w.log.Info("configuration changed, the settings are applied on restart", "settings", pending)
+	}
+	if reflect.DeepEqual(next, w.current) {
+		return
+	}
+	if err := w.onChange(w.current, next); err != nil {
+		w.log.Error(err, "unable to apply the configuration, the current one is kept")
+		return
+	}
+	w.log.Info("configuration reloaded")
+	w.current = next
+}
@@ -22,36 +22,49 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 
 	appsv1 "k8s.io/api/apps/v1"
 )
 
 // DeploymentReconciler reconciles a Deployment object
 type DeploymentReconciler struct {
-	client  client.Client
-	log     logr.Logger
-	scheme  *runtime.Scheme
-	handler *stub.HPAHandler
+	client   client.Client
+	log      logr.Logger
+	scheme   *runtime.Scheme
+	handler  *stub.HPAHandler
+	scope    *Scope
+	requeuer *Requeuer
 }
 
-func NewDeploymentReconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, handler *stub.HPAHandler) *DeploymentReconciler {
+func NewDeploymentReconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, handler *stub.HPAHandler, scope *Scope, requeuer *Requeuer) *DeploymentReconciler {
 	return &DeploymentReconciler{
-		client:  client,
-		log:     log,
-		scheme:  scheme,
-		handler: handler,
+		client:   client,
+		log:      log,
+		scheme:   scheme,
+		handler:  handler,
+		scope:    scope,
+		requeuer: requeuer,
 	}
 }
 
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=autoscaling.k8s.io,resources=verticalpodautoscalers,verbs=get;create;update;delete
+// +kubebuilder:rbac:groups=keda.sh,resources=scaledobjects,verbs=get;create;update;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;delete
 
 func (r *DeploymentReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
-	_ = r.log.WithValues("deployment", req.NamespacedName)
+	log := r.log.WithValues(
+		"namespace", req.Namespace, "name", req.Name, "kind", "Deployment", "reconcileID", uuid.New().String())
+	ctx := stub.NewContextWithLogger(context.Background(), log)
 
 	deployment := &appsv1.Deployment{}
 	err := r.client.Get(ctx, req.NamespacedName, deployment)
@@ -59,21 +72,73 @@ func (r *DeploymentReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		if errors.IsNotFound(err) {
 			// Object not found, return.  Created objects are automatically garbage collected.
 			// For additional cleanup logic use finalizers.
+			r.handler.ForgetWorkload("Deployment", req.Namespace, req.Name)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
+		log.Error(err, "unable to fetch Deployment")
 		return reconcile.Result{}, err
 	}
 
-	r.handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
-		deployment.Kind, deployment.APIVersion,
-		deployment.Annotations, deployment.Spec.Template.Annotations)
+	inScope, err := r.scope.current().contains(ctx, r.client, deployment)
+	if err != nil {
+		log.Error(err, "unable to check scope")
+		return reconcile.Result{}, err
+	}
+	if !inScope {
+		log.V(1).Info("Deployment is out of scope")
+		r.handler.ForgetWorkload("Deployment", req.Namespace, req.Name)
+		return reconcile.Result{}, nil
+	}
+	if r.handler.IsShadowScaleTarget(deployment.Labels) {
+		log.V(1).Info("Deployment is the scale target of a shadow HPA")
+		return reconcile.Result{}, nil
+	}
+
+	// TypeMeta is not populated on objects read from the cache
+	gvk := appsv1.SchemeGroupVersion.WithKind("Deployment")
+	err = r.handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		gvk.Kind, gvk.GroupVersion().String(),
+		deployment.Annotations, deployment.Spec.Template.Annotations, deployment.Spec.Selector)
 
-	return ctrl.Result{}, nil
+	return ctrl.Result{}, err
 }
 
 func (r *DeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&appsv1.Deployment{}).
-		Complete(r)
+		WithEventFilter(r.scope.predicate())
+	if src, eventHandler := r.scope.namespaceWatch(r.listInNamespace); src != nil {
+		builder = builder.Watches(src, eventHandler)
+	}
+	if r.requeuer != nil {
+		builder = builder.Watches(r.requeuer.source(r.listInScope), &handler.EnqueueRequestForObject{})
+	}
+	return builder.Complete(r)
+}
+
+func (r *DeploymentReconciler) listInNamespace(namespace string) []types.NamespacedName {
+	workloads := &appsv1.DeploymentList{}
+	if err := r.client.List(context.Background(), workloads, r.scope.current().listOptions(namespace)...); err != nil {
+		r.log.Error(err, "unable to list Deployments", "namespace", namespace)
+		return nil
+	}
+	names := make([]types.NamespacedName, 0, len(workloads.Items))
+	for _, workload := range workloads.Items {
+		names = append(names, types.NamespacedName{Namespace: workload.Namespace, Name: workload.Name})
+	}
+	return names
+}
+
+// listInScope returns the events requeueing the Deployments in scope
+func (r *DeploymentReconciler) listInScope() ([]event.GenericEvent, error) {
+	workloads := &appsv1.DeploymentList{}
+	if err := r.client.List(context.Background(), workloads, r.scope.current().listOptions("")...); err != nil {
+		return nil, err
+	}
+	events := make([]event.GenericEvent, 0, len(workloads.Items))
+	for i := range workloads.Items {
+		events = append(events, event.GenericEvent{Meta: &workloads.Items[i], Object: &workloads.Items[i]})
+	}
+	return events, nil
 }
@@ -0,0 +1,105 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// CacheSyncCheck is a readiness check which passes once the informers of the manager cache are
+// synced. It's a manager.Runnable: the manager starts it after starting the cache.
+type CacheSyncCheck struct {
+	informers cache.Informers
+	mu        sync.RWMutex
+	synced    bool
+}
+
+func NewCacheSyncCheck(informers cache.Informers) *CacheSyncCheck {
+	return &CacheSyncCheck{informers: informers}
+}
+
+// Start waits for the informers to sync
+func (c *CacheSyncCheck) Start(stop <-chan struct{}) error {
+	if c.informers.WaitForCacheSync(stop) {
+		c.mu.Lock()
+		c.synced = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// NeedLeaderElection returns false, every replica needs its cache
+func (c *CacheSyncCheck) NeedLeaderElection() bool {
+	return false
+}
+
+// Check implements healthz.Checker
+func (c *CacheSyncCheck) Check(_ *http.Request) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.synced {
+		return fmt.Errorf("caches are not synced")
+	}
+	return nil
+}
+
+// ReconcileCheck is a readiness check which fails when the leader hasn't reconciled a workload
+// successfully within maxAge. The replicas which aren't leading don't reconcile, the check always
+// passes on them. It's a manager.Runnable run by the leader only.
+type ReconcileCheck struct {
+	handler *stub.HPAHandler
+	maxAge  time.Duration
+	mu      sync.RWMutex
+	// leadingSince is the zero time unless this replica is the leader
+	leadingSince time.Time
+	now          func() time.Time
+}
+
+func NewReconcileCheck(handler *stub.HPAHandler, maxAge time.Duration) *ReconcileCheck {
+	return &ReconcileCheck{handler: handler, maxAge: maxAge, now: time.Now}
+}
+
+// Start is called once this replica is elected as the leader
+func (c *ReconcileCheck) Start(stop <-chan struct{}) error {
+	c.mu.Lock()
+	c.leadingSince = c.now()
+	c.mu.Unlock()
+	<-stop
+	return nil
+}
+
+// Check implements healthz.Checker
+func (c *ReconcileCheck) Check(_ *http.Request) error {
+	c.mu.RLock()
+	since := c.leadingSince
+	c.mu.RUnlock()
+	if since.IsZero() {
+		return nil
+	}
+	if last := c.handler.LastSuccessfulReconcile(); last.After(since) {
+		since = last
+	}
+	if age := c.now().Sub(since); age > c.maxAge {
+		return fmt.Errorf("no reconcile succeeded for %s", age.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCacheSyncCheck(t *testing.T) {
+
+	synced := false
+	informers := &informertest.FakeInformers{Synced: &synced}
+	check := NewCacheSyncCheck(informers)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Check should fail before the caches are synced")
+	}
+	if err := check.Start(stop); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Check should fail while the caches are not synced")
+	}
+	synced = true
+	if err := check.Start(stop); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestReconcileCheck(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+	handler, err := stub.NewHandler(fake.NewFakeClientWithScheme(scheme, deployment), nil, stub.Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check := NewReconcileCheck(handler, time.Hour)
+	now := time.Now()
+	check.now = func() time.Time { return now }
+
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Check should pass before the replica leads: %v", err)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		_ = check.Start(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	for {
+		check.mu.RLock()
+		leading := !check.leadingSince.IsZero()
+		check.mu.RUnlock()
+		if leading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Check should pass within the timeout of the election: %v", err)
+	}
+	now = now.Add(time.Hour)
+	expected := "no reconcile succeeded for 1h30m0s"
+	if err := check.Check(nil); err == nil || err.Error() != expected {
+		t.Errorf("Error expected: %v actual: %v", expected, err)
+	}
+
+	err = handler.HandleReplicaSet(context.Background(), deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now = time.Now().Add(30 * time.Minute)
+	if err := check.Check(nil); err != nil {
+		t.Errorf("Check should pass within the timeout of the last reconcile: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if err := check.Check(nil); err == nil {
+		t.Errorf("Check should fail after the timeout of the last reconcile")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// IntrospectionPath is the path the workload states are served at
+const IntrospectionPath = "/workloads"
+
+// IntrospectionServer serves the autoscaling state of the workloads in scope which have autoscale
+// annotations, as JSON. The namespace and status query parameters filter the workloads by
+// namespace and by the phase of their status annotation.
+type IntrospectionServer struct {
+	addr    string
+	client  client.Client
+	log     logr.Logger
+	handler *stub.HPAHandler
+	scope   *Scope
+}
+
+func NewIntrospectionServer(addr string, client client.Client, log logr.Logger, handler *stub.HPAHandler, scope *Scope) *IntrospectionServer {
+	return &IntrospectionServer{
+		addr:    addr,
+		client:  client,
+		log:     log,
+		handler: handler,
+		scope:   scope,
+	}
+}
+
+// Start serves the introspection API until stop is closed, it implements manager.Runnable
+func (s *IntrospectionServer) Start(stop <-chan struct{}) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(IntrospectionPath, s)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-stop
+		if err := server.Shutdown(context.Background()); err != nil {
+			s.log.Error(err, "unable to shut down the introspection server")
+		}
+	}()
+	s.log.Info("serving introspection API", "addr", s.addr, "path", IntrospectionPath)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection returns false, every replica serves the introspection API
+func (s *IntrospectionServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *IntrospectionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	status := r.URL.Query().Get("status")
+	states, err := s.workloadStates(r.Context(), namespace, status)
+	if err != nil {
+		s.log.Error(err, "unable to list the workload states")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(states); err != nil {
+		s.log.Error(err, "unable to write the workload states")
+	}
+}
+
+// workloadStates lists the states of the Deployments and StatefulSets of namespace, or of every
+// namespace if it's empty, which are in phase status, unless it's empty
+func (s *IntrospectionServer) workloadStates(ctx context.Context, namespace string, status string) ([]*stub.WorkloadState, error) {
+	// the workloads are listed with the same scope even if it's reloaded meanwhile
+	scope := s.scope.current()
+	states := []*stub.WorkloadState{}
+	add := func(state *stub.WorkloadState) {
+		if state != nil && (status == "" || strings.EqualFold(state.Phase, status)) {
+			states = append(states, state)
+		}
+	}
+
+	deployments := &appsv1.DeploymentList{}
+	if err := s.client.List(ctx, deployments, scope.listOptions(namespace)...); err != nil {
+		return nil, err
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if inScope, err := scope.contains(ctx, s.client, deployment); err != nil {
+			return nil, err
+		} else if !inScope || s.handler.IsShadowScaleTarget(deployment.Labels) {
+			continue
+		}
+		gvk := appsv1.SchemeGroupVersion.WithKind("Deployment")
+		state, err := s.handler.WorkloadState(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+			gvk.Kind, gvk.GroupVersion().String(),
+			deployment.Annotations, deployment.Spec.Template.Annotations, deployment.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		add(state)
+	}
+
+	statefulsets := &appsv1.StatefulSetList{}
+	if err := s.client.List(ctx, statefulsets, scope.listOptions(namespace)...); err != nil {
+		return nil, err
+	}
+	for i := range statefulsets.Items {
+		statefulset := &statefulsets.Items[i]
+		if inScope, err := scope.contains(ctx, s.client, statefulset); err != nil {
+			return nil, err
+		} else if !inScope {
+			continue
+		}
+		gvk := appsv1.SchemeGroupVersion.WithKind("StatefulSet")
+		state, err := s.handler.WorkloadState(ctx, statefulset.UID, statefulset.Name, statefulset.Namespace,
+			gvk.Kind, gvk.GroupVersion().String(),
+			statefulset.Annotations, statefulset.Spec.Template.Annotations, statefulset.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		add(state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Namespace != states[j].Namespace {
+			return states[i].Namespace < states[j].Namespace
+		}
+		if states[i].Name != states[j].Name {
+			return states[i].Name < states[j].Name
+		}
+		return states[i].Kind < states[j].Kind
+	})
+	return states, nil
+}
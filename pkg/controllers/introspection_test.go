@@ -0,0 +1,147 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/banzaicloud/hpa-operator/pkg/config"
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestIntrospectionServer(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	handler, err := stub.NewHandler(nil, nil, stub.Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "5",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+	}
+	web := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a", UID: "web", Annotations: map[string]string{
+			"autoscaling.banzaicloud.io/hpa-status": `{"phase":"Active","hpa":"web"}`,
+		}},
+	}
+	for key, value := range annotations {
+		web.Annotations[key] = value
+	}
+	hpa, err := handler.DesiredHorizontalPodAutoscaler(context.Background(), web.UID, web.Name, web.Namespace,
+		"Deployment", "apps/v1", annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hpa.Spec.MaxReplicas = 3
+	hpa.Status.CurrentReplicas = 2
+	hpa.Status.DesiredReplicas = 3
+	worker := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "team-b", Annotations: map[string]string{
+			"hpa.autoscaling.banzaicloud.io/minReplicas": "1",
+			"autoscaling.banzaicloud.io/hpa-status":      `{"phase":"Invalid","error":"maxReplicas is missing"}`,
+		}},
+	}
+	plain := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "team-a"}}
+	db := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-a", Annotations: annotations}}
+
+	c := fake.NewFakeClientWithScheme(scheme, web, hpa, worker, plain, db)
+	handler, err = stub.NewHandler(c, nil, stub.Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server := NewIntrospectionServer(":0", c, ctrl.Log.WithName("introspection"), handler, NewScope(config.Scope{}))
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "all", query: "", expected: []string{"team-a/db", "team-a/web", "team-b/worker"}},
+		{name: "namespace", query: "?namespace=team-b", expected: []string{"team-b/worker"}},
+		{name: "status", query: "?status=active", expected: []string{"team-a/web"}},
+		{name: "no match", query: "?namespace=team-b&status=Active", expected: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, IntrospectionPath+test.query, nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Status code expected: %v actual: %v %s", http.StatusOK, recorder.Code, recorder.Body)
+			}
+			var states []stub.WorkloadState
+			if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			names := []string{}
+			for _, state := range states {
+				names = append(names, state.Namespace+"/"+state.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("Workloads expected: %v actual: %v", test.expected, names)
+			}
+		})
+	}
+
+	states, err := server.workloadStates(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dbState, webState, workerState := states[0], states[1], states[2]
+
+	if webState.Phase != "Active" || webState.Config.Backend != stub.BackendHPA || webState.HPA == nil {
+		t.Errorf("Active state expected, actual: %+v", webState)
+	}
+	if webState.CurrentReplicas == nil || *webState.CurrentReplicas != 2 || webState.DesiredReplicas == nil || *webState.DesiredReplicas != 3 {
+		t.Errorf("Replicas expected: 2 -> 3 actual: %v -> %v", webState.CurrentReplicas, webState.DesiredReplicas)
+	}
+	if expected := []string{"spec.maxReplicas: 3 -> 5"}; !reflect.DeepEqual(webState.Drift, expected) {
+		t.Errorf("Drift expected: %v actual: %v", expected, webState.Drift)
+	}
+
+	if expected := []string{"HorizontalPodAutoscaler db doesn't exist"}; !reflect.DeepEqual(dbState.Drift, expected) {
+		t.Errorf("Drift expected: %v actual: %v", expected, dbState.Drift)
+	}
+	if dbState.Kind != "StatefulSet" || dbState.Phase != "" || dbState.CurrentReplicas != nil {
+		t.Errorf("Unreconciled StatefulSet expected, actual: %+v", dbState)
+	}
+
+	if workerState.Phase != "Invalid" || workerState.LastError != "maxReplicas is missing" || workerState.HPA != nil {
+		t.Errorf("Invalid state expected, actual: %+v", workerState)
+	}
+	expected := []string{
+		"hpa.autoscaling.banzaicloud.io/maxReplicas annotation is missing for deployment worker",
+		"no valid metrics configured for worker",
+	}
+	if !reflect.DeepEqual(workerState.Config.Errors, expected) {
+		t.Errorf("Invalid annotations expected: %v actual: %v", expected, workerState.Config.Errors)
+	}
+}
@@ -0,0 +1,468 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const statusAnnotation = "autoscaling.banzaicloud.io/hpa-status"
+
+func autoscaleAnnotations(maxReplicas string) map[string]string {
+	return map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  maxReplicas,
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+	}
+}
+
+func createNamespace(t *testing.T) string {
+	t.Helper()
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "hpa-operator-test-"}}
+	if err := k8sClient.Create(context.Background(), namespace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return namespace.Name
+}
+
+func podTemplate(annotations map[string]string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"app": "test"},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test", Image: "nginx"}},
+		},
+	}
+}
+
+func newDeployment(namespace string, annotations map[string]string, podAnnotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+			Template: podTemplate(podAnnotations),
+		},
+	}
+}
+
+func getHPA(namespace string) (*v2beta2.HorizontalPodAutoscaler, error) {
+	hpa := &v2beta2.HorizontalPodAutoscaler{}
+	err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "test"}, hpa)
+	return hpa, err
+}
+
+func hpaWithMaxReplicas(namespace string, maxReplicas int32) func() error {
+	return func() error {
+		hpa, err := getHPA(namespace)
+		if err != nil {
+			return err
+		}
+		if hpa.Spec.MaxReplicas != maxReplicas {
+			return fmt.Errorf("maxReplicas expected: %v actual: %v", maxReplicas, hpa.Spec.MaxReplicas)
+		}
+		return nil
+	}
+}
+
+func workloadStatusPhase(obj interface {
+	GetAnnotations() map[string]string
+}) (string, error) {
+	value, ok := obj.GetAnnotations()[statusAnnotation]
+	if !ok {
+		return "", fmt.Errorf("status annotation is missing")
+	}
+	status := struct {
+		Phase string `json:"phase"`
+	}{}
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return "", err
+	}
+	return status.Phase, nil
+}
+
+func deploymentWithPhase(namespace string, phase string) func() error {
+	return func() error {
+		deployment := &appsv1.Deployment{}
+		if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+			return err
+		}
+		actual, err := workloadStatusPhase(deployment)
+		if err != nil {
+			return err
+		}
+		if actual != phase {
+			return fmt.Errorf("phase expected: %v actual: %v", phase, actual)
+		}
+		return nil
+	}
+}
+
+// deploymentUnchanged fails once the deployment is written again, e.g. by a reconcile loop
+func deploymentUnchanged(t *testing.T, namespace string) func() error {
+	t.Helper()
+	deployment := &appsv1.Deployment{}
+	if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return func() error {
+		actual := &appsv1.Deployment{}
+		if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "test"}, actual); err != nil {
+			return err
+		}
+		if actual.ResourceVersion != deployment.ResourceVersion {
+			return fmt.Errorf("resourceVersion expected: %v actual: %v", deployment.ResourceVersion, actual.ResourceVersion)
+		}
+		return nil
+	}
+}
+
+// updateDeployment retries fn on conflicts, the operator writes the status annotation concurrently
+func updateDeployment(t *testing.T, namespace string, fn func(deployment *appsv1.Deployment)) {
+	t.Helper()
+	eventually(t, func() error {
+		deployment := &appsv1.Deployment{}
+		if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+			return err
+		}
+		fn(deployment)
+		return k8sClient.Update(context.Background(), deployment)
+	})
+}
+
+func TestDeploymentLifecycle(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+	namespace := createNamespace(t)
+
+	deployment := newDeployment(namespace, autoscaleAnnotations("3"), nil)
+	if err := k8sClient.Create(ctx, deployment); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// create
+	eventually(t, hpaWithMaxReplicas(namespace, 3))
+	eventually(t, deploymentWithPhase(namespace, "Active"))
+	// writing the status bumps the generation of the deployment, it must not trigger another write
+	consistently(t, deploymentUnchanged(t, namespace))
+
+	hpa, err := getHPA(namespace)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	target := hpa.Spec.ScaleTargetRef
+	if target.Kind != "Deployment" || target.APIVersion != "apps/v1" || target.Name != "test" {
+		t.Errorf("Scale target expected: apps/v1 Deployment test actual: %v", target)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Resource == nil || hpa.Spec.Metrics[0].Resource.Name != corev1.ResourceCPU {
+		t.Errorf("Metrics expected: cpu actual: %v", hpa.Spec.Metrics)
+	}
+
+	// the garbage collector deletes the HPA along with the workload through the controller reference
+	owner := metav1.GetControllerOf(hpa)
+	if owner == nil {
+		t.Fatalf("Controller reference is missing")
+	}
+	if owner.UID != deployment.UID || owner.Kind != "Deployment" || owner.APIVersion != "apps/v1" {
+		t.Errorf("Controller reference expected: %v actual: %v", deployment.UID, owner)
+	}
+	if owner.BlockOwnerDeletion == nil || !*owner.BlockOwnerDeletion {
+		t.Errorf("Controller reference should block owner deletion")
+	}
+
+	// update
+	updateDeployment(t, namespace, func(deployment *appsv1.Deployment) {
+		deployment.Annotations["hpa.autoscaling.banzaicloud.io/maxReplicas"] = "5"
+	})
+	eventually(t, hpaWithMaxReplicas(namespace, 5))
+
+	// invalid annotations leave the HPA untouched
+	updateDeployment(t, namespace, func(deployment *appsv1.Deployment) {
+		deployment.Annotations["hpa.autoscaling.banzaicloud.io/maxReplicas"] = "many"
+	})
+	eventually(t, deploymentWithPhase(namespace, "Invalid"))
+	consistently(t, hpaWithMaxReplicas(namespace, 5))
+
+	// delete
+	updateDeployment(t, namespace, func(deployment *appsv1.Deployment) {
+		deployment.Annotations = nil
+	})
+	eventually(t, func() error {
+		if _, err := getHPA(namespace); !errors.IsNotFound(err) {
+			return fmt.Errorf("HPA should be deleted: %v", err)
+		}
+		return nil
+	})
+	eventually(t, func() error {
+		deployment := &appsv1.Deployment{}
+		if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+			return err
+		}
+		if _, ok := deployment.Annotations[statusAnnotation]; ok {
+			return fmt.Errorf("status annotation should be removed")
+		}
+		return nil
+	})
+}
+
+func TestStatefulSetLifecycle(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+	namespace := createNamespace(t)
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Namespace:   namespace,
+			Annotations: autoscaleAnnotations("4"),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+			Template: podTemplate(nil),
+		},
+	}
+	if err := k8sClient.Create(ctx, statefulSet); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	eventually(t, hpaWithMaxReplicas(namespace, 4))
+
+	hpa, err := getHPA(namespace)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if owner := metav1.GetControllerOf(hpa); owner == nil || owner.UID != statefulSet.UID || owner.Kind != "StatefulSet" {
+		t.Errorf("Controller reference expected: %v actual: %v", statefulSet.UID, owner)
+	}
+	if hpa.Spec.ScaleTargetRef.Kind != "StatefulSet" {
+		t.Errorf("Scale target kind expected: StatefulSet actual: %v", hpa.Spec.ScaleTargetRef.Kind)
+	}
+}
+
+func TestHPANotOwnedIsLeftAlone(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+	namespace := createNamespace(t)
+
+	minReplicas := int32(1)
+	foreign := &v2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: namespace},
+		Spec: v2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: v2beta2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "test"},
+			MinReplicas:    &minReplicas,
+			MaxReplicas:    10,
+		},
+	}
+	if err := k8sClient.Create(ctx, foreign); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := k8sClient.Create(ctx, newDeployment(namespace, autoscaleAnnotations("3"), nil)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	eventually(t, deploymentWithPhase(namespace, "Conflict"))
+	consistently(t, hpaWithMaxReplicas(namespace, 10))
+
+	// removing the annotations doesn't delete an HPA created by someone else
+	updateDeployment(t, namespace, func(deployment *appsv1.Deployment) {
+		deployment.Annotations = nil
+	})
+	consistently(t, hpaWithMaxReplicas(namespace, 10))
+}
+
+func TestAnnotationPrecedence(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+
+	t.Run("pod template annotations are used without workload annotations", func(t *testing.T) {
+		namespace := createNamespace(t)
+		if err := k8sClient.Create(ctx, newDeployment(namespace, nil, autoscaleAnnotations("6"))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		eventually(t, hpaWithMaxReplicas(namespace, 6))
+	})
+
+	t.Run("workload annotations take precedence", func(t *testing.T) {
+		namespace := createNamespace(t)
+		if err := k8sClient.Create(ctx, newDeployment(namespace, autoscaleAnnotations("2"), autoscaleAnnotations("6"))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		eventually(t, hpaWithMaxReplicas(namespace, 2))
+		consistently(t, hpaWithMaxReplicas(namespace, 2))
+	})
+
+	t.Run("workload and pod template annotations are merged if selected", func(t *testing.T) {
+		namespace := createNamespace(t)
+		annotations := map[string]string{
+			"autoscaling.banzaicloud.io/annotation-merge": "Workload",
+			"hpa.autoscaling.banzaicloud.io/minReplicas":  "1",
+			"hpa.autoscaling.banzaicloud.io/maxReplicas":  "2",
+		}
+		podAnnotations := map[string]string{
+			"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "6",
+			"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+		}
+		if err := k8sClient.Create(ctx, newDeployment(namespace, annotations, podAnnotations)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		eventually(t, hpaWithMaxReplicas(namespace, 2))
+		eventually(t, func() error {
+			events := &corev1.EventList{}
+			if err := k8sClient.List(ctx, events, client.InNamespace(namespace)); err != nil {
+				return err
+			}
+			for _, event := range events.Items {
+				if event.Reason == "AnnotationConflict" && event.InvolvedObject.Kind == "Deployment" &&
+					strings.Contains(event.Message, "hpa.autoscaling.banzaicloud.io/maxReplicas") {
+					return nil
+				}
+			}
+			return fmt.Errorf("AnnotationConflict event not found in %v", events.Items)
+		})
+	})
+
+	t.Run("pod template annotations take precedence if selected", func(t *testing.T) {
+		namespace := createNamespace(t)
+		annotations := autoscaleAnnotations("2")
+		annotations["autoscaling.banzaicloud.io/annotation-merge"] = "PodTemplate"
+		if err := k8sClient.Create(ctx, newDeployment(namespace, annotations, autoscaleAnnotations("6"))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		eventually(t, hpaWithMaxReplicas(namespace, 6))
+	})
+}
+
+func TestVPAWithoutCRD(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+
+	namespace := createNamespace(t)
+	annotations := autoscaleAnnotations("3")
+	annotations["vpa.autoscaling.banzaicloud.io/updateMode"] = "Off"
+	if err := k8sClient.Create(ctx, newDeployment(namespace, annotations, nil)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the HPA is generated even though the VPA API isn't installed
+	eventually(t, hpaWithMaxReplicas(namespace, 3))
+	eventually(t, func() error {
+		deployment := &appsv1.Deployment{}
+		if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+			return err
+		}
+		value := deployment.Annotations["autoscaling.banzaicloud.io/vpa-status"]
+		if !strings.Contains(value, `"phase":"Error"`) || !strings.Contains(value, "is not installed") {
+			return fmt.Errorf("VPA status expected to report the missing API, actual: %v", value)
+		}
+		return nil
+	})
+	consistently(t, deploymentUnchanged(t, namespace))
+}
+
+func TestShadowMetrics(t *testing.T) {
+	requireEnvironment(t)
+	ctx := context.Background()
+
+	namespace := createNamespace(t)
+	annotations := autoscaleAnnotations("3")
+	annotations["prometheus.requests.hpa.autoscaling.banzaicloud.io/query"] = "sum(rate(http_requests_total[1m]))"
+	annotations["prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue"] = "10"
+	annotations["prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow"] = "true"
+	if err := k8sClient.Create(ctx, newDeployment(namespace, annotations, nil)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shadowKey := client.ObjectKey{Namespace: namespace, Name: "test-shadow"}
+	eventually(t, func() error {
+		return k8sClient.Get(ctx, shadowKey, &v2beta2.HorizontalPodAutoscaler{})
+	})
+	eventually(t, deploymentWithPhase(namespace, "Active"))
+
+	hpa, err := getHPA(namespace)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Resource == nil {
+		t.Errorf("Metrics expected: cpu actual: %v", hpa.Spec.Metrics)
+	}
+	shadow := &v2beta2.HorizontalPodAutoscaler{}
+	if err := k8sClient.Get(ctx, shadowKey, shadow); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(shadow.Spec.Metrics) != 1 || shadow.Spec.Metrics[0].External == nil {
+		t.Errorf("Shadow metrics expected: requests actual: %v", shadow.Spec.Metrics)
+	}
+	if target := shadow.Spec.ScaleTargetRef; target.Kind != "Deployment" || target.Name != "test-shadow" {
+		t.Errorf("Shadow scale target expected: Deployment test-shadow actual: %v", target)
+	}
+	target := &appsv1.Deployment{}
+	if err := k8sClient.Get(ctx, shadowKey, target); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !target.Spec.Paused || metav1.GetControllerOf(target) == nil || metav1.GetControllerOf(target).Name != "test" {
+		t.Errorf("Shadow scale target should be paused and owned by the workload: %v", target)
+	}
+	// the shadow scale target isn't reconciled
+	if _, ok := target.Annotations[statusAnnotation]; ok {
+		t.Errorf("Shadow scale target should have no status annotation")
+	}
+
+	// promoted into the live HPA
+	updateDeployment(t, namespace, func(deployment *appsv1.Deployment) {
+		delete(deployment.Annotations, "prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow")
+	})
+	eventually(t, func() error {
+		hpa, err := getHPA(namespace)
+		if err != nil {
+			return err
+		}
+		if len(hpa.Spec.Metrics) != 2 {
+			return fmt.Errorf("metrics expected: cpu, requests actual: %v", hpa.Spec.Metrics)
+		}
+		return nil
+	})
+	eventually(t, func() error {
+		if err := k8sClient.Get(ctx, shadowKey, &v2beta2.HorizontalPodAutoscaler{}); !errors.IsNotFound(err) {
+			return fmt.Errorf("shadow HPA should be deleted: %v", err)
+		}
+		if err := k8sClient.Get(ctx, shadowKey, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+			return fmt.Errorf("shadow scale target should be deleted: %v", err)
+		}
+		deployment := &appsv1.Deployment{}
+		if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "test"}, deployment); err != nil {
+			return err
+		}
+		if _, ok := deployment.Annotations["autoscaling.banzaicloud.io/shadow-hpa-status"]; ok {
+			return fmt.Errorf("shadow status annotation should be removed")
+		}
+		return nil
+	})
+}
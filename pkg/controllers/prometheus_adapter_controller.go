@@ -0,0 +1,70 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// prometheusAdapterRequest is the single request of the PrometheusAdapterReconciler, the rules of
+// every HPA are written at once
+var prometheusAdapterRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: "prometheus-adapter-rules"}}
+
+// PrometheusAdapterReconciler keeps the prometheus-adapter rules in sync with the HPAs. Every HPA
+// event is mapped to the same request, so the queue coalesces bursts of them into one rewrite.
+type PrometheusAdapterReconciler struct {
+	log     logr.Logger
+	handler *stub.HPAHandler
+}
+
+func NewPrometheusAdapterReconciler(log logr.Logger, handler *stub.HPAHandler) *PrometheusAdapterReconciler {
+	return &PrometheusAdapterReconciler{
+		log:     log,
+		handler: handler,
+	}
+}
+
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update
+
+func (r *PrometheusAdapterReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	log := r.log.WithValues("reconcileID", uuid.New().String())
+	ctx := stub.NewContextWithLogger(context.Background(), log)
+	return ctrl.Result{}, r.handler.SyncPrometheusAdapterRules(ctx)
+}
+
+func (r *PrometheusAdapterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := controller.New("prometheus-adapter", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &v2beta2.HorizontalPodAutoscaler{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{prometheusAdapterRequest}
+		}),
+	})
+}
@@ -0,0 +1,86 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Requeuer requeues every workload in scope on demand, e.g. once the options of the handler are
+// reloaded. It's a manager.Runnable run by the leader only, like the reconcilers: the requests of
+// the other replicas are dropped, their reconcilers handle every workload once they are elected.
+type Requeuer struct {
+	log     logr.Logger
+	pending chan struct{}
+	targets []requeueTarget
+}
+
+// requeueTarget is a reconciler receiving the requeued workloads listed by list through events
+type requeueTarget struct {
+	list   func() ([]event.GenericEvent, error)
+	events chan event.GenericEvent
+}
+
+func NewRequeuer(log logr.Logger) *Requeuer {
+	return &Requeuer{log: log, pending: make(chan struct{}, 1)}
+}
+
+// source registers a reconciler listing its workloads in scope by list, and returns the source of
+// its requeue events. It's called while the reconcilers are set up, before Start.
+func (r *Requeuer) source(list func() ([]event.GenericEvent, error)) source.Source {
+	events := make(chan event.GenericEvent)
+	r.targets = append(r.targets, requeueTarget{list: list, events: events})
+	return &source.Channel{Source: events}
+}
+
+// RequeueAll requeues every workload in scope, it doesn't block. Requests made while the
+// workloads are being requeued are merged into one.
+func (r *Requeuer) RequeueAll() {
+	select {
+	case r.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Start requeues the workloads on request until stop is closed
+func (r *Requeuer) Start(stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-r.pending:
+		}
+		count := 0
+		for _, target := range r.targets {
+			events, err := target.list()
+			if err != nil {
+				r.log.Error(err, "unable to list workloads to requeue")
+				continue
+			}
+			for _, e := range events {
+				select {
+				case target.events <- e:
+					count++
+				case <-stop:
+					return nil
+				}
+			}
+		}
+		r.log.Info("workloads requeued", "count", count)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/banzaicloud/hpa-operator/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Scope is the scope of the reconcilers and the introspection server, shared by them so a reload
+// applies to all of them at once. The watched namespaces can't be changed, the manager cache is
+// restricted to them.
+type Scope struct {
+	mu    sync.RWMutex
+	scope config.Scope
+	// watchesNamespaces tells whether the namespaces were watched from the start, which is the
+	// case only if a namespace selector was set
+	watchesNamespaces bool
+}
+
+func NewScope(scope config.Scope) *Scope {
+	return &Scope{
+		scope:             scope,
+		watchesNamespaces: scope.NamespaceSelector != nil,
+	}
+}
+
+// Reload replaces the selectors of the scope. The workloads which enter the scope are handled on
+// their next reconcile, the ones which leave it keep their HPA. A namespace selector can be set only
+// if one was set at start, the namespaces aren't watched otherwise.
+func (s *Scope) Reload(scope config.Scope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !reflect.DeepEqual(scope.Namespaces, s.scope.Namespaces) {
+		return fmt.Errorf("watched namespaces can't be changed from %v to %v", s.scope.Namespaces, scope.Namespaces)
+	}
+	if scope.NamespaceSelector != nil && !s.watchesNamespaces {
+		return fmt.Errorf("namespace selector can't be set, it wasn't set at start")
+	}
+	s.scope = scope
+	return nil
+}
+
+// current returns the scope the workloads are checked against until the next reload
+func (s *Scope) current() workloadScope {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return workloadScope{s.scope}
+}
+
+// workloadScope checks the scope of the reconcilers against the cluster and the watch events
+type workloadScope struct {
+	config.Scope
+}
+
+// contains tells whether the workload is in scope, including the labels of its namespace.
+func (s workloadScope) contains(ctx context.Context, c client.Client, meta metav1.Object) (bool, error) {
+	if !s.WorkloadMatches(meta) {
+		return false, nil
+	}
+	if s.NamespaceSelector == nil {
+		return true, nil
+	}
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: meta.GetNamespace()}, namespace); err != nil {
+		return false, err
+	}
+	return s.NamespaceSelector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// listOptions selects the workloads of namespace which match the workload selector.
+func (s workloadScope) listOptions(namespace string) []client.ListOption {
+	opts := []client.ListOption{client.InNamespace(namespace)}
+	if s.WorkloadSelector != nil {
+		opts = append(opts, client.MatchingLabelsSelector{Selector: s.WorkloadSelector})
+	}
+	return opts
+}
+
+// predicate drops the events of workloads out of scope before they are queued.
+// Namespace events are let through, they are filtered by the namespace selector.
+func (s *Scope) predicate() predicate.Predicate {
+	matches := func(meta metav1.Object, obj runtime.Object) bool {
+		if _, ok := obj.(*corev1.Namespace); ok {
+			return true
+		}
+		return s.current().WorkloadMatches(meta)
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return matches(e.Meta, e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return matches(e.MetaNew, e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return matches(e.Meta, e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return matches(e.Meta, e.Object)
+		},
+	}
+}
+
+// namespaceWatch returns a source and handler which requeue the workloads listed by list
+// on every event of a matching namespace, so they are picked up once the labels of the
+// namespace start matching the namespace selector. It returns nil if no namespace selector was set
+// at start.
+func (s *Scope) namespaceWatch(list func(namespace string) []types.NamespacedName) (source.Source, handler.EventHandler) {
+	if !s.watchesNamespaces {
+		return nil, nil
+	}
+	mapper := handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+		scope := s.current()
+		if scope.NamespaceSelector == nil || !scope.NamespaceListed(obj.Meta.GetName()) ||
+			!scope.NamespaceSelector.Matches(labels.Set(obj.Meta.GetLabels())) {
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, name := range list(obj.Meta.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: name})
+		}
+		return requests
+	})
+	return &source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{ToRequests: mapper}
+}
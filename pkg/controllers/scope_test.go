@@ -0,0 +1,132 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/banzaicloud/hpa-operator/pkg/config"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestScopeContains(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	c := fake.NewFakeClientWithScheme(scheme,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"autoscaling": "enabled"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+	)
+
+	tests := []struct {
+		name      string
+		scope     config.Scope
+		namespace string
+		labels    map[string]string
+		expected  bool
+	}{
+		{name: "zero value matches everything", scope: config.Scope{}, namespace: "team-b", expected: true},
+		{name: "listed namespace", scope: config.Scope{Namespaces: []string{"team-a", "team-b"}}, namespace: "team-b", expected: true},
+		{name: "unlisted namespace", scope: config.Scope{Namespaces: []string{"team-a"}}, namespace: "team-b", expected: false},
+		{
+			name:      "matching namespace labels",
+			scope:     config.Scope{NamespaceSelector: labels.SelectorFromSet(labels.Set{"autoscaling": "enabled"})},
+			namespace: "team-a",
+			expected:  true,
+		},
+		{
+			name:      "not matching namespace labels",
+			scope:     config.Scope{NamespaceSelector: labels.SelectorFromSet(labels.Set{"autoscaling": "enabled"})},
+			namespace: "team-b",
+			expected:  false,
+		},
+		{
+			name:      "matching workload labels",
+			scope:     config.Scope{WorkloadSelector: labels.SelectorFromSet(labels.Set{"hpa": "true"})},
+			namespace: "team-b",
+			labels:    map[string]string{"hpa": "true"},
+			expected:  true,
+		},
+		{
+			name:      "not matching workload labels",
+			scope:     config.Scope{WorkloadSelector: labels.SelectorFromSet(labels.Set{"hpa": "true"})},
+			namespace: "team-b",
+			expected:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: test.namespace, Labels: test.labels},
+			}
+			actual, err := workloadScope{test.scope}.contains(context.Background(), c, deployment)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("Scope contains expected: %v actual: %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestScopeReload(t *testing.T) {
+
+	scope := NewScope(config.Scope{WorkloadSelector: labels.SelectorFromSet(labels.Set{"hpa": "true"})})
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team-a", Labels: map[string]string{"autoscaled": "true"}},
+	}
+	filter := scope.predicate()
+	create := event.CreateEvent{Meta: deployment, Object: deployment}
+	if filter.Create(create) {
+		t.Errorf("Deployment expected to be out of scope")
+	}
+
+	if err := scope.Reload(config.Scope{WorkloadSelector: labels.SelectorFromSet(labels.Set{"autoscaled": "true"})}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !filter.Create(create) {
+		t.Errorf("Deployment expected to be in scope after reload")
+	}
+	opts := &client.ListOptions{}
+	opts.ApplyOptions(scope.current().listOptions(""))
+	if opts.LabelSelector.String() != "autoscaled=true" {
+		t.Errorf("List selector expected: autoscaled=true actual: %v", opts.LabelSelector)
+	}
+
+	err := scope.Reload(config.Scope{Namespaces: []string{"team-a"}})
+	if err == nil || err.Error() != "watched namespaces can't be changed from [] to [team-a]" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err = scope.Reload(config.Scope{NamespaceSelector: labels.SelectorFromSet(labels.Set{"team": "a"})})
+	if err == nil || err.Error() != "namespace selector can't be set, it wasn't set at start" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if src, _ := scope.namespaceWatch(nil); src != nil {
+		t.Errorf("Namespaces expected not to be watched")
+	}
+}
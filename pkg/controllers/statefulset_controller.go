@@ -22,27 +22,35 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 
 	appsv1 "k8s.io/api/apps/v1"
 )
 
 // StatefulSetReconciler reconciles a StatefulSet object
 type StatefulSetReconciler struct {
-	client  client.Client
-	log     logr.Logger
-	scheme  *runtime.Scheme
-	handler *stub.HPAHandler
+	client   client.Client
+	log      logr.Logger
+	scheme   *runtime.Scheme
+	handler  *stub.HPAHandler
+	scope    *Scope
+	requeuer *Requeuer
 }
 
-func NewStatefulsSetReconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, handler *stub.HPAHandler) *StatefulSetReconciler {
+func NewStatefulsSetReconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, handler *stub.HPAHandler, scope *Scope, requeuer *Requeuer) *StatefulSetReconciler {
 	return &StatefulSetReconciler{
-		client:  client,
-		log:     log,
-		scheme:  scheme,
-		handler: handler,
+		client:   client,
+		log:      log,
+		scheme:   scheme,
+		handler:  handler,
+		scope:    scope,
+		requeuer: requeuer,
 	}
 }
 
@@ -50,8 +58,9 @@ func NewStatefulsSetReconciler(client client.Client, log logr.Logger, scheme *ru
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
 
 func (r *StatefulSetReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
-	_ = r.log.WithValues("statefulset", req.NamespacedName)
+	log := r.log.WithValues(
+		"namespace", req.Namespace, "name", req.Name, "kind", "StatefulSet", "reconcileID", uuid.New().String())
+	ctx := stub.NewContextWithLogger(context.Background(), log)
 
 	deployment := &appsv1.StatefulSet{}
 	err := r.client.Get(ctx, req.NamespacedName, deployment)
@@ -59,21 +68,69 @@ func (r *StatefulSetReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		if errors.IsNotFound(err) {
 			// Object not found, return.  Created objects are automatically garbage collected.
 			// For additional cleanup logic use finalizers.
+			r.handler.ForgetWorkload("StatefulSet", req.Namespace, req.Name)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
+		log.Error(err, "unable to fetch StatefulSet")
 		return reconcile.Result{}, err
 	}
 
-	r.handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
-		deployment.Kind, deployment.APIVersion,
-		deployment.Annotations, deployment.Spec.Template.Annotations)
+	inScope, err := r.scope.current().contains(ctx, r.client, deployment)
+	if err != nil {
+		log.Error(err, "unable to check scope")
+		return reconcile.Result{}, err
+	}
+	if !inScope {
+		log.V(1).Info("StatefulSet is out of scope")
+		r.handler.ForgetWorkload("StatefulSet", req.Namespace, req.Name)
+		return reconcile.Result{}, nil
+	}
 
-	return ctrl.Result{}, nil
+	// TypeMeta is not populated on objects read from the cache
+	gvk := appsv1.SchemeGroupVersion.WithKind("StatefulSet")
+	err = r.handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		gvk.Kind, gvk.GroupVersion().String(),
+		deployment.Annotations, deployment.Spec.Template.Annotations, deployment.Spec.Selector)
+
+	return ctrl.Result{}, err
 }
 
 func (r *StatefulSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&appsv1.StatefulSet{}).
-		Complete(r)
+		WithEventFilter(r.scope.predicate())
+	if src, eventHandler := r.scope.namespaceWatch(r.listInNamespace); src != nil {
+		builder = builder.Watches(src, eventHandler)
+	}
+	if r.requeuer != nil {
+		builder = builder.Watches(r.requeuer.source(r.listInScope), &handler.EnqueueRequestForObject{})
+	}
+	return builder.Complete(r)
+}
+
+func (r *StatefulSetReconciler) listInNamespace(namespace string) []types.NamespacedName {
+	workloads := &appsv1.StatefulSetList{}
+	if err := r.client.List(context.Background(), workloads, r.scope.current().listOptions(namespace)...); err != nil {
+		r.log.Error(err, "unable to list StatefulSets", "namespace", namespace)
+		return nil
+	}
+	names := make([]types.NamespacedName, 0, len(workloads.Items))
+	for _, workload := range workloads.Items {
+		names = append(names, types.NamespacedName{Namespace: workload.Namespace, Name: workload.Name})
+	}
+	return names
+}
+
+// listInScope returns the events requeueing the StatefulSets in scope
+func (r *StatefulSetReconciler) listInScope() ([]event.GenericEvent, error) {
+	workloads := &appsv1.StatefulSetList{}
+	if err := r.client.List(context.Background(), workloads, r.scope.current().listOptions("")...); err != nil {
+		return nil, err
+	}
+	events := make([]event.GenericEvent, 0, len(workloads.Items))
+	for i := range workloads.Items {
+		events = append(events, event.GenericEvent{Meta: &workloads.Items[i], Object: &workloads.Items[i]})
+	}
+	return events, nil
 }
@@ -0,0 +1,170 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/hpa-operator/pkg/config"
+	"github.com/banzaicloud/hpa-operator/pkg/stub"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// The integration tests run the reconcilers against a local API server and etcd, they are
+// skipped if the binaries are not found. See envtest for the environment variables pointing to
+// them, e.g. KUBEBUILDER_ASSETS.
+
+const (
+	eventuallyTimeout  = 20 * time.Second
+	eventuallyInterval = 100 * time.Millisecond
+)
+
+// k8sClient reads and writes the API server directly, bypassing the cache of the manager.
+// It is nil if the integration environment isn't running.
+var k8sClient client.Client
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	if !envtestAssetsFound() {
+		fmt.Println("API server and etcd binaries not found, integration tests are skipped")
+		return m.Run()
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(os.Stderr)))
+
+	testEnv := &envtest.Environment{}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		fmt.Printf("unable to start test environment: %v\n", err)
+		return 1
+	}
+	defer func() {
+		if err := testEnv.Stop(); err != nil {
+			fmt.Printf("unable to stop test environment: %v\n", err)
+		}
+	}()
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme, MetricsBindAddress: "0"})
+	if err != nil {
+		fmt.Printf("unable to create manager: %v\n", err)
+		return 1
+	}
+	handler, err := stub.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("hpa-operator"), stub.Options{})
+	if err != nil {
+		fmt.Printf("unable to create handler: %v\n", err)
+		return 1
+	}
+	if err := NewDeploymentReconciler(mgr.GetClient(), ctrl.Log.WithName("Deployment"), scheme, handler, NewScope(config.Scope{}), nil).SetupWithManager(mgr); err != nil {
+		fmt.Printf("unable to create controller: %v\n", err)
+		return 1
+	}
+	if err := NewStatefulsSetReconciler(mgr.GetClient(), ctrl.Log.WithName("StatefulSet"), scheme, handler, NewScope(config.Scope{}), nil).SetupWithManager(mgr); err != nil {
+		fmt.Printf("unable to create controller: %v\n", err)
+		return 1
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(stop); err != nil {
+			fmt.Printf("unable to start manager: %v\n", err)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Printf("unable to create client: %v\n", err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+// envtestAssetsFound looks up the binaries the same way envtest does
+func envtestAssetsFound() bool {
+	apiServer := os.Getenv("TEST_ASSET_KUBE_APISERVER")
+	etcd := os.Getenv("TEST_ASSET_ETCD")
+	assets := os.Getenv("KUBEBUILDER_ASSETS")
+	if assets == "" {
+		assets = "/usr/local/kubebuilder/bin"
+	}
+	if apiServer == "" {
+		apiServer = filepath.Join(assets, "kube-apiserver")
+	}
+	if etcd == "" {
+		etcd = filepath.Join(assets, "etcd")
+	}
+	for _, path := range []string{apiServer, etcd} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func requireEnvironment(t *testing.T) {
+	if k8sClient == nil {
+		t.Skip("integration environment is not running")
+	}
+}
+
+// eventually polls condition until it returns nil or the timeout expires
+func eventually(t *testing.T, condition func() error) {
+	t.Helper()
+	deadline := time.Now().Add(eventuallyTimeout)
+	for {
+		err := condition()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met in %v: %v", eventuallyTimeout, err)
+		}
+		time.Sleep(eventuallyInterval)
+	}
+}
+
+// consistently checks that condition keeps returning nil for a while
+func consistently(t *testing.T, condition func() error) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := condition(); err != nil {
+			t.Fatalf("Condition not met: %v", err)
+		}
+		time.Sleep(eventuallyInterval)
+	}
+}
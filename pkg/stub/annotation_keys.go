@@ -0,0 +1,119 @@
+package stub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultAnnotationPrefix is the domain of the autoscale annotations, unless configured otherwise
+const DefaultAnnotationPrefix = "hpa.autoscaling.banzaicloud.io"
+
+// annotationKeys are the keys of the annotations and labels an operator instance reads and writes.
+// They are derived from the annotation prefix, so instances with different prefixes never touch
+// each other's workloads.
+type annotationKeys struct {
+	// prefix is the domain of the autoscale annotations, e.g. hpa.autoscaling.banzaicloud.io
+	prefix string
+	// regExp matches the autoscale annotations
+	regExp *regexp.Regexp
+	// status is the key of the status annotation, see updateStatus
+	status string
+	// vpaPrefix is the domain of the VPA annotations, e.g. vpa.autoscaling.banzaicloud.io
+	vpaPrefix string
+	// vpaStatus is the key of the VPA status annotation
+	vpaStatus string
+	// pdbStatus is the key of the PDB status annotation
+	pdbStatus string
+	// shadowStatus is the key of the shadow HPA status annotation
+	shadowStatus string
+	// shadowTarget is the key of the label naming the workload on the scale targets of the shadow HPAs
+	shadowTarget string
+	// mergeStrategy is the key of the annotation selecting how the workload and pod template annotations are merged
+	mergeStrategy string
+	// backend is the key of the annotation selecting the autoscaler backend of a workload
+	backend string
+	// schemaVersion is the key of the annotation declaring the schema version of the autoscale annotations
+	schemaVersion string
+	// instance is the key of the label holding the instance ID on the HPAs
+	instance string
+}
+
+// defaultAnnotationKeys are used by the tests and the helpers which aren't bound to a handler
+var defaultAnnotationKeys = mustAnnotationKeys(DefaultAnnotationPrefix, "")
+
+// newAnnotationKeys derives the keys from prefix, which has to be a DNS subdomain of at least two
+// labels. The status, merge strategy, backend, schema version and instance keys live under the parent
+// domain of prefix, e.g. autoscaling.banzaicloud.io, so they never match the autoscale annotation regexp.
+// The VPA annotations live under the vpa sub domain of the parent, e.g. vpa.autoscaling.banzaicloud.io.
+// The status key includes instanceID if it's set, instances sharing a prefix don't overwrite each
+// other's status.
+func newAnnotationKeys(prefix string, instanceID string) (*annotationKeys, error) {
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return nil, fmt.Errorf("annotation prefix %q is invalid: %s", prefix, strings.Join(errs, ", "))
+	}
+	labels := strings.SplitN(prefix, annotationSubDomainSeparator, 2)
+	if len(labels) != 2 {
+		return nil, fmt.Errorf("annotation prefix %q is invalid: it should contain at least two labels, e.g. hpa.example.com", prefix)
+	}
+	parent := labels[1]
+	if errs := validation.IsValidLabelValue(instanceID); len(errs) > 0 {
+		return nil, fmt.Errorf("instance ID %q is invalid: %s", instanceID, strings.Join(errs, ", "))
+	}
+
+	status, vpaStatus, pdbStatus, shadowStatus := "hpa-status", "vpa-status", "pdb-status", "shadow-hpa-status"
+	if instanceID != "" {
+		status += "-" + instanceID
+		vpaStatus += "-" + instanceID
+		pdbStatus += "-" + instanceID
+		shadowStatus += "-" + instanceID
+	}
+	keys := &annotationKeys{
+		prefix:        prefix,
+		regExp:        regexp.MustCompile("[a-zA-Z\\.]*" + regexp.QuoteMeta(prefix) + "\\/[a-zA-Z\\.]+"),
+		status:        parent + annotationDomainSeparator + status,
+		vpaPrefix:     vpaAnnotationPrefix + annotationSubDomainSeparator + parent,
+		vpaStatus:     parent + annotationDomainSeparator + vpaStatus,
+		pdbStatus:     parent + annotationDomainSeparator + pdbStatus,
+		shadowStatus:  parent + annotationDomainSeparator + shadowStatus,
+		shadowTarget:  parent + annotationDomainSeparator + "shadow-of",
+		mergeStrategy: parent + annotationDomainSeparator + "annotation-merge",
+		backend:       parent + annotationDomainSeparator + "autoscaler-backend",
+		schemaVersion: parent + annotationDomainSeparator + "annotation-schema",
+		instance:      parent + annotationDomainSeparator + "instance",
+	}
+	if keys.regExp.MatchString(keys.vpaPrefix + annotationDomainSeparator + vpaUpdateMode) {
+		return nil, fmt.Errorf("annotation prefix %q is invalid: it overlaps with the VPA annotations of %s", prefix, keys.vpaPrefix)
+	}
+	for _, key := range []string{keys.status, keys.shadowStatus} {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("instance ID %q is invalid: status annotation %s: %s", instanceID, key, strings.Join(errs, ", "))
+		}
+	}
+	return keys, nil
+}
+
+func mustAnnotationKeys(prefix string, instanceID string) *annotationKeys {
+	keys, err := newAnnotationKeys(prefix, instanceID)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// field returns the key of an annotation directly under the prefix, e.g. hpa.autoscaling.banzaicloud.io/minReplicas
+func (k *annotationKeys) field(field string) string {
+	return k.prefix + annotationDomainSeparator + field
+}
+
+// subDomain returns the domain of the annotations of a metric, e.g. cpu.hpa.autoscaling.banzaicloud.io
+func (k *annotationKeys) subDomain(subDomain string) string {
+	return subDomain + annotationSubDomainSeparator + k.prefix
+}
+
+// prometheus returns the key of a prometheus metric annotation, e.g. prometheus.<metricName>.hpa.autoscaling.banzaicloud.io/query
+func (k *annotationKeys) prometheus(metricName string, field string) string {
+	return k.subDomain(prometheusAnnotationPrefix+annotationSubDomainSeparator+metricName) + annotationDomainSeparator + field
+}
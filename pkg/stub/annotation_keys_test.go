@@ -0,0 +1,55 @@
+package stub
+
+import (
+	"testing"
+)
+
+func TestAnnotationKeys(t *testing.T) {
+
+	tests := []struct {
+		prefix         string
+		instanceID     string
+		expectedStatus string
+		expectedErr    bool
+	}{
+		{prefix: DefaultAnnotationPrefix, expectedStatus: "autoscaling.banzaicloud.io/hpa-status"},
+		{prefix: DefaultAnnotationPrefix, instanceID: "canary", expectedStatus: "autoscaling.banzaicloud.io/hpa-status-canary"},
+		{prefix: "hpa.example.com", expectedStatus: "example.com/hpa-status"},
+		{prefix: "autoscale.io", expectedStatus: "io/hpa-status"},
+		{prefix: "example", expectedErr: true},
+		{prefix: "vpa.example.com", expectedErr: true},
+		{prefix: "hpa.Example.com", expectedErr: true},
+		{prefix: "hpa.example.com/", expectedErr: true},
+		{prefix: DefaultAnnotationPrefix, instanceID: "canary/1", expectedErr: true},
+		{prefix: DefaultAnnotationPrefix, instanceID: "a-very-long-instance-id-which-does-not-fit-the-status-key", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix+" "+test.instanceID, func(t *testing.T) {
+			keys, err := newAnnotationKeys(test.prefix, test.instanceID)
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("Error expected: %v actual: %v", test.expectedErr, err)
+			}
+			if test.expectedErr {
+				return
+			}
+			if keys.status != test.expectedStatus {
+				t.Errorf("Status annotation expected: %v actual: %v", test.expectedStatus, keys.status)
+			}
+			// the annotations written by the operator must not be picked up as autoscale annotations
+			for _, key := range []string{keys.status, keys.vpaStatus, keys.shadowStatus, keys.shadowTarget, keys.mergeStrategy, keys.schemaVersion, keys.instance, keys.vpaPrefix + "/updateMode"} {
+				if keys.regExp.MatchString(key) {
+					t.Errorf("%v must not match %v", key, keys.regExp)
+				}
+			}
+			for _, key := range []string{keys.field("minReplicas"), keys.prometheus("requests", "query")} {
+				if !keys.regExp.MatchString(key) {
+					t.Errorf("%v should match %v", key, keys.regExp)
+				}
+			}
+			if keys.regExp.MatchString(defaultAnnotationKeys.field("minReplicas")) != (test.prefix == DefaultAnnotationPrefix) {
+				t.Errorf("%v should only match the annotations of its prefix", keys.regExp)
+			}
+		})
+	}
+}
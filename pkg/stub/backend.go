@@ -0,0 +1,135 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// The autoscaler backends, selected by the Backend option or per workload by the
+// annotationKeys.backend annotation
+const (
+	// BackendHPA generates HorizontalPodAutoscalers, it's the default
+	BackendHPA = "HPA"
+	// BackendKEDA generates KEDA ScaledObjects, KEDA creates the HPAs from them
+	BackendKEDA = "KEDA"
+)
+
+// autoscalerBackend writes the autoscaler of a workload. The autoscale annotations are always
+// parsed into an HPA, which the backends convert into their own objects.
+type autoscalerBackend interface {
+	ownedKind
+	// fromHorizontalPodAutoscaler converts hpa, the returned errors list the metrics which were
+	// skipped. The object is nil if it can't be generated at all.
+	fromHorizontalPodAutoscaler(hpa *v2beta2.HorizontalPodAutoscaler) (runtime.Object, []error)
+}
+
+// hpaBackend writes the HPA generated from the annotations. With prometheus-adapter its prometheus
+// metrics are pointed at the metrics exposed by the adapter, named with prometheusAdapterPrefix.
+type hpaBackend struct {
+	prometheusAdapterPrefix string
+}
+
+func (hpaBackend) kind() string {
+	return "HorizontalPodAutoscaler"
+}
+
+func (hpaBackend) objectName(workloadName string) string {
+	return workloadName
+}
+
+func (hpaBackend) newObject() runtime.Object {
+	return &v2beta2.HorizontalPodAutoscaler{}
+}
+
+func (b hpaBackend) fromHorizontalPodAutoscaler(hpa *v2beta2.HorizontalPodAutoscaler) (runtime.Object, []error) {
+	if b.prometheusAdapterPrefix != "" {
+		return pointAtPrometheusAdapter(hpa, b.prometheusAdapterPrefix), nil
+	}
+	return hpa, nil
+}
+
+func (hpaBackend) statusName(status *workloadStatus) *string {
+	return &status.HPA
+}
+
+// backend returns the backend selected for the workload by its annotations, or the default one
+func (h *HPAHandler) backend(annotations map[string]string) (autoscalerBackend, error) {
+	name, ok := annotations[h.keys.backend]
+	if !ok {
+		return h.defaultBackend, nil
+	}
+	backend, ok := h.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("%s value is invalid: %s, it should be %s or %s", h.keys.backend, name, BackendHPA, BackendKEDA)
+	}
+	return backend, nil
+}
+
+// handleAutoscalers writes the autoscaler of the workload by its backend, and deletes the objects
+// the other backends generated before the workload switched backends. The HPAs are read from the
+// cache, the objects of the other backends are only looked up if the status annotation names them.
+func (h *HPAHandler) handleAutoscalers(
+	ctx context.Context,
+	name string, namespace string, kind string,
+	annotations map[string]string,
+	desired *v2beta2.HorizontalPodAutoscaler, invalidErr error) (*workloadStatus, error) {
+
+	selected, err := h.backend(annotations)
+	if err != nil {
+		LoggerFromContext(ctx).Error(err, "invalid autoscaler backend")
+		return &workloadStatus{Phase: phaseInvalid, Error: err.Error()}, nil
+	}
+	status, err := h.handleAutoscaler(ctx, selected, name, namespace, kind, desired, invalidErr)
+
+	var previous workloadStatus
+	if current, ok := annotations[h.keys.status]; ok {
+		_ = json.Unmarshal([]byte(current), &previous)
+	}
+	for _, backendName := range []string{BackendHPA, BackendKEDA} {
+		backend := h.backends[backendName]
+		if backend == selected {
+			continue
+		}
+		if _, cached := backend.(hpaBackend); !cached && *backend.statusName(&previous) == "" {
+			continue
+		}
+		if _, cleanupErr := h.handleAutoscaler(ctx, backend, name, namespace, kind, nil, nil); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}
+	return status, err
+}
+
+// handleAutoscaler keeps the object of backend in sync with desired, the HPA generated from the
+// autoscale annotations along with invalidErr. The returned status is nil if the workload is not
+// autoscaled by backend, its object is deleted then.
+func (h *HPAHandler) handleAutoscaler(
+	ctx context.Context,
+	backend autoscalerBackend,
+	name string, namespace string, kind string,
+	desiredHPA *v2beta2.HorizontalPodAutoscaler, invalidErr error) (*workloadStatus, error) {
+
+	log := LoggerFromContext(ctx).WithValues("backend", backend.kind())
+	annotationsFound := desiredHPA != nil || invalidErr != nil
+	if invalidErr != nil {
+		log.Error(invalidErr, "invalid autoscale annotations")
+	}
+
+	var desired runtime.Object
+	if desiredHPA != nil {
+		var errs []error
+		desired, errs = backend.fromHorizontalPodAutoscaler(desiredHPA)
+		if len(errs) > 0 {
+			if invalid, ok := invalidErr.(*InvalidAnnotationsError); ok {
+				errs = append(invalid.Errors, errs...)
+			}
+			invalidErr = &InvalidAnnotationsError{Errors: errs}
+			log.Error(invalidErr, "autoscale annotations not supported by the backend")
+		}
+	}
+	return h.syncOwnedObject(ctx, backend, name, namespace, kind, desired, annotationsFound, invalidErr)
+}
@@ -0,0 +1,353 @@
+package stub
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The sub-domains of the kube-metrics-adapter collector annotations, e.g. jsonpath.<metricName>.hpa.autoscaling.banzaicloud.io
+const (
+	jsonPathAnnotationPrefix = "jsonpath"
+	influxDBAnnotationPrefix = "influxdb"
+	sqsAnnotationPrefix      = "sqs"
+	zmonAnnotationPrefix     = "zmon"
+)
+
+// The metrics and HPA annotations of the kube-metrics-adapter collectors
+const (
+	jsonPathMetricConfigAnnotation = "metric-config.pods.%s.json-path/"
+	influxDBMetricConfigAnnotation = "metric-config.external.flux-query.influxdb/"
+	influxDBQueryMetricName        = "flux-query"
+	sqsQueueLengthMetricName       = "sqs-queue-length"
+	zmonCheckMetricName            = "zmon-check"
+)
+
+// collector turns the annotations of a custom metric served by a kube-metrics-adapter collector,
+// e.g. prometheus.<metricName>.hpa.autoscaling.banzaicloud.io/query, into an HPA metric
+type collector interface {
+	// metric returns the HPA metric configured by fields, the annotations of the metric by their
+	// key without the domain, e.g. query
+	metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error)
+	// hpaAnnotations returns the annotations configuring the collector on the HPA. It's only
+	// called with fields accepted by metric.
+	hpaAnnotations(metricName string, fields map[string]string) map[string]string
+	// sensitiveFields returns the fields holding credentials and the HPA annotations they are
+	// copied to, both are redacted from the introspection API
+	sensitiveFields() (fields []string, hpaAnnotations []string)
+}
+
+// collectors are the collectors by the sub-domain of their annotations
+var collectors = map[string]collector{
+	prometheusAnnotationPrefix: prometheusCollector{},
+	jsonPathAnnotationPrefix:   jsonPathCollector{},
+	influxDBAnnotationPrefix:   influxDBCollector{},
+	sqsAnnotationPrefix:        sqsCollector{},
+	zmonAnnotationPrefix:       zmonCollector{},
+}
+
+// collectorNames returns the sub-domains of the collectors in alphabetical order
+func collectorNames() []string {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseCollectorMetric returns the metric named metricName of the collector registered as
+// collectorName, configured by the annotations of domain. The query field is expanded as a template
+// with data, see queryTemplateData. The HPA annotations of the collector are
+// added to hpa, unless they conflict with the annotations of another metric.
+func parseCollectorMetric(hpa *v2beta2.HorizontalPodAutoscaler, collectorName string, metricName string,
+	domain string, annotations map[string]string, data *queryTemplateData) (*v2beta2.MetricSpec, error) {
+
+	c, ok := collectors[collectorName]
+	if !ok {
+		return nil, fmt.Errorf("collector %s is not supported, it should be one of %s", collectorName, strings.Join(collectorNames(), ", "))
+	}
+	if !prometheusMetricNameRegExp.MatchString(metricName) {
+		return nil, fmt.Errorf("%s metric name %q should contain 1 to 63 letters only", collectorName, metricName)
+	}
+	fields := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, domain+annotationDomainSeparator) {
+			fields[strings.TrimPrefix(key, domain+annotationDomainSeparator)] = value
+		}
+	}
+	if query, ok := fields["query"]; ok {
+		expanded, err := data.expandQuery(metricName, query)
+		if err != nil {
+			return nil, err
+		}
+		fields["query"] = expanded
+	}
+	metric, err := c.metric(metricName, fields)
+	if err != nil {
+		return nil, err
+	}
+	hpaAnnotations := c.hpaAnnotations(metricName, fields)
+	for key, value := range hpaAnnotations {
+		if current, ok := hpa.Annotations[key]; ok && current != value {
+			return nil, fmt.Errorf("%s metric %s conflicts with another metric: %s is already set to %q", collectorName, metricName, key, current)
+		}
+	}
+	if len(hpaAnnotations) > 0 && len(hpa.Annotations) == 0 {
+		hpa.Annotations = make(map[string]string)
+	}
+	for key, value := range hpaAnnotations {
+		hpa.Annotations[key] = value
+	}
+	return metric, nil
+}
+
+// parseCollectorTarget returns the target of a custom metric, set by its targetValue or
+// targetAverageValue field. Pods metrics only accept targetAverageValue.
+func parseCollectorTarget(metricName string, fields map[string]string, podsMetric bool) (v2beta2.MetricTarget, error) {
+	parse := func(field string) (*resource.Quantity, error) {
+		value, err := resource.ParseQuantity(fields[field])
+		if err != nil {
+			return nil, fmt.Errorf("%s is invalid in custom metric: %s (%s)", field, metricName, err.Error())
+		}
+		if value.Sign() <= 0 {
+			return nil, fmt.Errorf("%s should be positive in custom metric: %s", field, metricName)
+		}
+		return &value, nil
+	}
+	if _, ok := fields[targetValue]; ok && !podsMetric {
+		value, err := parse(targetValue)
+		if err != nil {
+			return v2beta2.MetricTarget{}, err
+		}
+		return v2beta2.MetricTarget{Type: v2beta2.ValueMetricType, Value: value}, nil
+	}
+	if _, ok := fields[targetAverageValue]; ok {
+		value, err := parse(targetAverageValue)
+		if err != nil {
+			return v2beta2.MetricTarget{}, err
+		}
+		return v2beta2.MetricTarget{Type: v2beta2.AverageValueMetricType, AverageValue: value}, nil
+	}
+	if podsMetric {
+		return v2beta2.MetricTarget{}, fmt.Errorf("targetAverageValue is required for custom metric: %s", metricName)
+	}
+	return v2beta2.MetricTarget{}, fmt.Errorf("either targetValue or targetAverageValue is required for custom metric: %s", metricName)
+}
+
+// requireFields returns an error for the first of names missing from fields
+func requireFields(metricName string, fields map[string]string, names ...string) error {
+	for _, name := range names {
+		if fields[name] == "" {
+			return fmt.Errorf("%s is missing for custom metric: %s", name, metricName)
+		}
+	}
+	return nil
+}
+
+// externalMetric returns an External metric selecting the series of a collector by labels, which
+// have to be valid label values as they end up in a label selector
+func externalMetric(metricName string, name string, labels map[string]string, target v2beta2.MetricTarget) (*v2beta2.MetricSpec, error) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if errs := validation.IsValidLabelValue(labels[key]); len(errs) > 0 {
+			return nil, fmt.Errorf("%s is invalid in custom metric: %s (%s)", key, metricName, strings.Join(errs, ", "))
+		}
+	}
+	return &v2beta2.MetricSpec{
+		Type: v2beta2.ExternalMetricSourceType,
+		External: &v2beta2.ExternalMetricSource{
+			Metric: v2beta2.MetricIdentifier{
+				Name:     name,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+			},
+			Target: target,
+		},
+	}, nil
+}
+
+// prometheusCollector serves the result of a Prometheus query as an External metric, the query
+// is read from the HPA annotations by kube-metrics-adapter
+type prometheusCollector struct{}
+
+func (prometheusCollector) metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error) {
+	query, ok := fields["query"]
+	if !ok {
+		return nil, fmt.Errorf("query is missing for custom metric: %s", metricName)
+	}
+	if _, err := validatePromQL(query); err != nil {
+		return nil, fmt.Errorf("query is invalid in custom metric: %s (%v)", metricName, err)
+	}
+	target, err := parseCollectorTarget(metricName, fields, false)
+	if err != nil {
+		return nil, err
+	}
+	return externalMetric(metricName, prometheusQueryMetricName, map[string]string{prometheusQueryNameLabel: metricName}, target)
+}
+
+func (prometheusCollector) hpaAnnotations(metricName string, fields map[string]string) map[string]string {
+	return map[string]string{prometheusQueryMetricConfigAnnotation + metricName: fields["query"]}
+}
+
+func (prometheusCollector) sensitiveFields() ([]string, []string) {
+	return nil, nil
+}
+
+// jsonPathCollector serves a value of the JSON the pods expose over HTTP as a Pods metric
+type jsonPathCollector struct{}
+
+// jsonPathAggregators are the functions kube-metrics-adapter aggregates JSON arrays with
+var jsonPathAggregators = map[string]bool{"avg": true, "min": true, "max": true, "sum": true}
+
+func (jsonPathCollector) metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error) {
+	if err := requireFields(metricName, fields, "jsonKey", "port"); err != nil {
+		return nil, err
+	}
+	if port, err := strconv.Atoi(fields["port"]); err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("port is invalid in custom metric: %s (%s)", metricName, fields["port"])
+	}
+	if scheme, ok := fields["scheme"]; ok && scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("scheme is invalid in custom metric: %s (%s), it should be http or https", metricName, scheme)
+	}
+	if aggregator, ok := fields["aggregator"]; ok && !jsonPathAggregators[aggregator] {
+		return nil, fmt.Errorf("aggregator is invalid in custom metric: %s (%s), it should be avg, min, max or sum", metricName, aggregator)
+	}
+	target, err := parseCollectorTarget(metricName, fields, true)
+	if err != nil {
+		return nil, err
+	}
+	return &v2beta2.MetricSpec{
+		Type: v2beta2.PodsMetricSourceType,
+		Pods: &v2beta2.PodsMetricSource{
+			Metric: v2beta2.MetricIdentifier{Name: metricName},
+			Target: target,
+		},
+	}, nil
+}
+
+func (jsonPathCollector) hpaAnnotations(metricName string, fields map[string]string) map[string]string {
+	prefix := fmt.Sprintf(jsonPathMetricConfigAnnotation, metricName)
+	annotations := map[string]string{
+		prefix + "json-key": fields["jsonKey"],
+		prefix + "port":     fields["port"],
+		prefix + "path":     "/metrics",
+	}
+	if path, ok := fields["path"]; ok {
+		annotations[prefix+"path"] = path
+	}
+	if scheme, ok := fields["scheme"]; ok {
+		annotations[prefix+"scheme"] = scheme
+	}
+	if aggregator, ok := fields["aggregator"]; ok {
+		annotations[prefix+"aggregator"] = aggregator
+	}
+	return annotations
+}
+
+func (jsonPathCollector) sensitiveFields() ([]string, []string) {
+	return nil, nil
+}
+
+// influxDBCollector serves the result of a Flux query as an External metric. The connection of
+// kube-metrics-adapter to InfluxDB is configured per HPA, the metrics of a workload have to share it.
+type influxDBCollector struct{}
+
+func (influxDBCollector) metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error) {
+	if err := requireFields(metricName, fields, "query", "address", "token", "org"); err != nil {
+		return nil, err
+	}
+	target, err := parseCollectorTarget(metricName, fields, false)
+	if err != nil {
+		return nil, err
+	}
+	return externalMetric(metricName, influxDBQueryMetricName, map[string]string{prometheusQueryNameLabel: metricName}, target)
+}
+
+func (influxDBCollector) hpaAnnotations(metricName string, fields map[string]string) map[string]string {
+	return map[string]string{
+		influxDBMetricConfigAnnotation + "address":  fields["address"],
+		influxDBMetricConfigAnnotation + "token":    fields["token"],
+		influxDBMetricConfigAnnotation + "org":      fields["org"],
+		influxDBMetricConfigAnnotation + metricName: fields["query"],
+	}
+}
+
+func (influxDBCollector) sensitiveFields() ([]string, []string) {
+	return []string{"token"}, []string{influxDBMetricConfigAnnotation + "token"}
+}
+
+// sqsCollector serves the length of an AWS SQS queue as an External metric
+type sqsCollector struct{}
+
+func (sqsCollector) metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error) {
+	if err := requireFields(metricName, fields, "queue", "region"); err != nil {
+		return nil, err
+	}
+	target, err := parseCollectorTarget(metricName, fields, false)
+	if err != nil {
+		return nil, err
+	}
+	return externalMetric(metricName, sqsQueueLengthMetricName, map[string]string{
+		"queue-name": fields["queue"],
+		"region":     fields["region"],
+	}, target)
+}
+
+func (sqsCollector) hpaAnnotations(string, map[string]string) map[string]string {
+	return nil
+}
+
+func (sqsCollector) sensitiveFields() ([]string, []string) {
+	return nil, nil
+}
+
+// zmonCollector serves the result of a ZMON check as an External metric. The tags field filters
+// the check results, it's a comma separated list of name=value pairs.
+type zmonCollector struct{}
+
+func (zmonCollector) metric(metricName string, fields map[string]string) (*v2beta2.MetricSpec, error) {
+	if err := requireFields(metricName, fields, "checkID"); err != nil {
+		return nil, err
+	}
+	target, err := parseCollectorTarget(metricName, fields, false)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{"check-id": fields["checkID"]}
+	for field, label := range map[string]string{"key": "key", "duration": "duration", "aggregators": "aggregators"} {
+		if value, ok := fields[field]; ok {
+			labels[label] = value
+		}
+	}
+	if tags, ok := fields["tags"]; ok {
+		for _, tag := range strings.Split(tags, ",") {
+			parts := strings.SplitN(tag, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("tags is invalid in custom metric: %s (%s), it should be a comma separated list of name=value pairs", metricName, tags)
+			}
+			if errs := validation.IsQualifiedName("tag-" + parts[0]); len(errs) > 0 {
+				return nil, fmt.Errorf("tags is invalid in custom metric: %s (%s)", metricName, strings.Join(errs, ", "))
+			}
+			labels["tag-"+parts[0]] = parts[1]
+		}
+	}
+	return externalMetric(metricName, zmonCheckMetricName, labels, target)
+}
+
+func (zmonCollector) hpaAnnotations(string, map[string]string) map[string]string {
+	return nil
+}
+
+func (zmonCollector) sensitiveFields() ([]string, []string) {
+	return nil, nil
+}
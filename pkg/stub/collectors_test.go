@@ -0,0 +1,222 @@
+package stub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCollectors(t *testing.T) {
+
+	ten := resource.MustParse("10")
+	external := func(name string, labels map[string]string, target v2beta2.MetricTarget) *v2beta2.MetricSpec {
+		return &v2beta2.MetricSpec{
+			Type: v2beta2.ExternalMetricSourceType,
+			External: &v2beta2.ExternalMetricSource{
+				Metric: v2beta2.MetricIdentifier{Name: name, Selector: &metav1.LabelSelector{MatchLabels: labels}},
+				Target: target,
+			},
+		}
+	}
+	value := v2beta2.MetricTarget{Type: v2beta2.ValueMetricType, Value: &ten}
+	averageValue := v2beta2.MetricTarget{Type: v2beta2.AverageValueMetricType, AverageValue: &ten}
+
+	tests := []struct {
+		name                string
+		collector           string
+		fields              map[string]string
+		expectedMetric      *v2beta2.MetricSpec
+		expectedAnnotations map[string]string
+		expectedErr         string
+	}{
+		{
+			name:      "prometheus",
+			collector: prometheusAnnotationPrefix,
+			fields:    map[string]string{"query": "sum(requests)", "targetValue": "10"},
+			expectedMetric: external(prometheusQueryMetricName,
+				map[string]string{prometheusQueryNameLabel: "requests"}, value),
+			expectedAnnotations: map[string]string{prometheusQueryMetricConfigAnnotation + "requests": "sum(requests)"},
+		},
+		{
+			name:        "prometheus without query",
+			collector:   prometheusAnnotationPrefix,
+			fields:      map[string]string{"targetValue": "10"},
+			expectedErr: "query is missing for custom metric: requests",
+		},
+		{
+			name:        "prometheus without target",
+			collector:   prometheusAnnotationPrefix,
+			fields:      map[string]string{"query": "sum(requests)"},
+			expectedErr: "either targetValue or targetAverageValue is required for custom metric: requests",
+		},
+		{
+			name:      "jsonpath",
+			collector: jsonPathAnnotationPrefix,
+			fields:    map[string]string{"jsonKey": "$.requests", "port": "9090", "aggregator": "max", "targetAverageValue": "10"},
+			expectedMetric: &v2beta2.MetricSpec{
+				Type: v2beta2.PodsMetricSourceType,
+				Pods: &v2beta2.PodsMetricSource{Metric: v2beta2.MetricIdentifier{Name: "requests"}, Target: averageValue},
+			},
+			expectedAnnotations: map[string]string{
+				"metric-config.pods.requests.json-path/json-key":   "$.requests",
+				"metric-config.pods.requests.json-path/port":       "9090",
+				"metric-config.pods.requests.json-path/path":       "/metrics",
+				"metric-config.pods.requests.json-path/aggregator": "max",
+			},
+		},
+		{
+			name:        "jsonpath targetValue",
+			collector:   jsonPathAnnotationPrefix,
+			fields:      map[string]string{"jsonKey": "$.requests", "port": "9090", "targetValue": "10"},
+			expectedErr: "targetAverageValue is required for custom metric: requests",
+		},
+		{
+			name:        "jsonpath invalid port",
+			collector:   jsonPathAnnotationPrefix,
+			fields:      map[string]string{"jsonKey": "$.requests", "port": "http", "targetAverageValue": "10"},
+			expectedErr: "port is invalid in custom metric: requests (http)",
+		},
+		{
+			name:      "influxdb",
+			collector: influxDBAnnotationPrefix,
+			fields: map[string]string{"query": "from(bucket: \"requests\")", "address": "http://influxdb:8086",
+				"token": "secret", "org": "example", "targetAverageValue": "10"},
+			expectedMetric: external(influxDBQueryMetricName,
+				map[string]string{prometheusQueryNameLabel: "requests"}, averageValue),
+			expectedAnnotations: map[string]string{
+				influxDBMetricConfigAnnotation + "address":  "http://influxdb:8086",
+				influxDBMetricConfigAnnotation + "token":    "secret",
+				influxDBMetricConfigAnnotation + "org":      "example",
+				influxDBMetricConfigAnnotation + "requests": "from(bucket: \"requests\")",
+			},
+		},
+		{
+			name:        "influxdb without address",
+			collector:   influxDBAnnotationPrefix,
+			fields:      map[string]string{"query": "from(bucket: \"requests\")", "targetValue": "10"},
+			expectedErr: "address is missing for custom metric: requests",
+		},
+		{
+			name:      "sqs",
+			collector: sqsAnnotationPrefix,
+			fields:    map[string]string{"queue": "jobs", "region": "eu-west-1", "targetAverageValue": "10"},
+			expectedMetric: external(sqsQueueLengthMetricName,
+				map[string]string{"queue-name": "jobs", "region": "eu-west-1"}, averageValue),
+		},
+		{
+			name:        "sqs invalid queue",
+			collector:   sqsAnnotationPrefix,
+			fields:      map[string]string{"queue": "jobs queue", "region": "eu-west-1", "targetAverageValue": "10"},
+			expectedErr: "queue-name is invalid in custom metric: requests",
+		},
+		{
+			name:      "zmon",
+			collector: zmonAnnotationPrefix,
+			fields:    map[string]string{"checkID": "1234", "key": "requests", "tags": "application=shop", "targetValue": "10"},
+			expectedMetric: external(zmonCheckMetricName,
+				map[string]string{"check-id": "1234", "key": "requests", "tag-application": "shop"}, value),
+		},
+		{
+			name:        "zmon invalid tags",
+			collector:   zmonAnnotationPrefix,
+			fields:      map[string]string{"checkID": "1234", "tags": "application", "targetValue": "10"},
+			expectedErr: "tags is invalid in custom metric: requests (application)",
+		},
+		{
+			name:        "zmon invalid target",
+			collector:   zmonAnnotationPrefix,
+			fields:      map[string]string{"checkID": "1234", "targetValue": "-1"},
+			expectedErr: "targetValue should be positive in custom metric: requests",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := collectors[test.collector]
+			metric, err := c.metric("requests", test.fields)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Errorf("Error expected: %v actual: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(metric, test.expectedMetric) {
+				t.Errorf("Metric expected: %+v actual: %+v", test.expectedMetric, metric)
+			}
+			if annotations := c.hpaAnnotations("requests", test.fields); !reflect.DeepEqual(annotations, test.expectedAnnotations) {
+				t.Errorf("HPA annotations expected: %v actual: %v", test.expectedAnnotations, annotations)
+			}
+		})
+	}
+}
+
+func TestParseCollectorMetrics(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		expectedMetrics int
+		expectedErr     []string
+	}{
+		{
+			name: "collectors side by side",
+			annotations: map[string]string{
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":       "sum(requests)",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/queue":                  "jobs",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/region":                 "eu-west-1",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/targetAverageValue":     "10",
+			},
+			expectedMetrics: 2,
+		},
+		{
+			name: "unknown collector",
+			annotations: map[string]string{
+				"graphite.requests.hpa.autoscaling.banzaicloud.io/query": "requests",
+			},
+			expectedErr: []string{"collector graphite is not supported, it should be one of influxdb, jsonpath, prometheus, sqs, zmon"},
+		},
+		{
+			name: "conflicting InfluxDB connections",
+			annotations: map[string]string{
+				"influxdb.a.hpa.autoscaling.banzaicloud.io/query":              "a",
+				"influxdb.a.hpa.autoscaling.banzaicloud.io/address":            "http://a:8086",
+				"influxdb.a.hpa.autoscaling.banzaicloud.io/token":              "secret",
+				"influxdb.a.hpa.autoscaling.banzaicloud.io/org":                "example",
+				"influxdb.a.hpa.autoscaling.banzaicloud.io/targetValue":        "10",
+				"influxdb.b.hpa.autoscaling.banzaicloud.io/query":              "b",
+				"influxdb.b.hpa.autoscaling.banzaicloud.io/address":            "http://b:8086",
+				"influxdb.b.hpa.autoscaling.banzaicloud.io/token":              "secret",
+				"influxdb.b.hpa.autoscaling.banzaicloud.io/org":                "example",
+				"influxdb.b.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+			},
+			expectedMetrics: 1,
+			expectedErr:     []string{"influxdb metric b conflicts with another metric: " + influxDBMetricConfigAnnotation + "address is already set to \"http://a:8086\""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := &v2beta2.HorizontalPodAutoscaler{}
+			metrics, errs := defaultAnnotationKeys.parseMetrics(hpa, test.annotations, newQueryTemplateData("test", "default", "Deployment", nil))
+			if len(metrics) != test.expectedMetrics {
+				t.Errorf("Metrics expected: %v actual: %v", test.expectedMetrics, metrics)
+			}
+			if len(errs) != len(test.expectedErr) {
+				t.Fatalf("Errors expected: %v actual: %v", test.expectedErr, errs)
+			}
+			for i := range errs {
+				if errs[i].Error() != test.expectedErr[i] {
+					t.Errorf("Error expected: %v actual: %v", test.expectedErr[i], errs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package stub
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The schema versions of the dotted autoscale annotations, a workload may declare the version it
+// uses in the annotationKeys.schemaVersion annotation
+const (
+	// schemaV1 is the format before 0.1.5, with pod.<prefix>/<metricName> keys for Pods metrics
+	schemaV1 = "v1"
+	// schemaV2 is the current format
+	schemaV2 = "v2"
+)
+
+// schemaVersions are the known schema versions, oldest first
+var schemaVersions = []string{schemaV1, schemaV2}
+
+// deprecatedKey is an autoscale annotation key removed from the schema, which is still accepted
+// unless the workload declares a schema version it isn't part of
+type deprecatedKey struct {
+	// name identifies the key in the events and the metrics, e.g. pod.<prefix>/<metricName>
+	name string
+	// removedIn is the schema version the key is missing from
+	removedIn string
+	// translate returns the annotations of the current schema replacing the annotation key: value,
+	// ok is false if key isn't an instance of this deprecated key
+	translate func(k *annotationKeys, key string, value string) (replacements map[string]string, ok bool)
+}
+
+// deprecatedKeys is the registry of the deprecated keys. Entries are never removed, the workloads
+// still using a key would silently lose their metrics.
+var deprecatedKeys = []deprecatedKey{
+	{
+		// the Pods metrics served by the custom metrics API are replaced by prometheus metrics
+		// averaging the series of the same name over the pods of the workload
+		name:      "pod.<prefix>/<metricName>",
+		removedIn: schemaV2,
+		translate: func(k *annotationKeys, key string, value string) (map[string]string, bool) {
+			domain := k.subDomain("pod") + annotationDomainSeparator
+			if !strings.HasPrefix(key, domain) {
+				return nil, false
+			}
+			seriesName := strings.TrimPrefix(key, domain)
+			metricName := deprecatedPodMetricName(seriesName)
+			series := seriesName + "{"
+			if !promQLMetricNameRegExp.MatchString(seriesName) {
+				// e.g. the dashes of a custom metric name
+				series = fmt.Sprintf(`{__name__=%q,`, seriesName)
+			}
+			return map[string]string{
+				k.prometheus(metricName, "query"):            fmt.Sprintf(`sum(%snamespace="{{.Namespace}}",{{.Selector}}})`, series),
+				k.prometheus(metricName, targetAverageValue): value,
+			}, true
+		},
+	},
+}
+
+var deprecatedAnnotationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "hpa_operator_deprecated_annotations_total",
+	Help: "Number of deprecated autoscale annotations found while generating HPAs, by deprecated key.",
+}, []string{"key"})
+
+func init() {
+	metrics.Registry.MustRegister(deprecatedAnnotationsTotal)
+}
+
+// promQLMetricNameRegExp matches the metric names which can be used as is in a PromQL selector
+var promQLMetricNameRegExp = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// digitNames spell the digits of the series names, the prometheus metric names are letters only
+var digitNames = [...]string{"Zero", "One", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine"}
+
+// deprecatedPodMetricName returns the name of the prometheus metric replacing a deprecated pod
+// metric, matching prometheusMetricNameRegExp, e.g. podHttpRequests for http_requests and
+// podHttpTwoXxTotal for http_2xx_total. The other characters start a new word. Names too long are
+// truncated, and suffixed with a hash of the series name to keep them apart.
+func deprecatedPodMetricName(seriesName string) string {
+	name := "pod"
+	wordStart := true
+	for _, r := range seriesName {
+		switch {
+		case r >= '0' && r <= '9':
+			name += digitNames[r-'0']
+			wordStart = true
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+			if wordStart {
+				name += strings.ToUpper(string(r))
+			} else {
+				name += string(r)
+			}
+			wordStart = false
+		default:
+			wordStart = true
+		}
+	}
+	const maxLength, hashLength = 63, 7
+	if len(name) <= maxLength {
+		return name
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(seriesName))
+	sum := hash.Sum32()
+	suffix := make([]byte, hashLength)
+	for i := range suffix {
+		// 26^7 letters cover the 32 bit hash
+		suffix[i] = byte('a' + sum%26)
+		sum /= 26
+	}
+	return name[:maxLength-hashLength] + string(suffix)
+}
+
+// deprecation is a deprecated key found in the annotations of a workload
+type deprecation struct {
+	// key is the deprecated key, e.g. pod.hpa.autoscaling.banzaicloud.io/requests
+	key string
+	// replacements are the annotations of the current schema, e.g.
+	// prometheus.requests.hpa.autoscaling.banzaicloud.io/query and targetAverageValue
+	replacements map[string]string
+	// name is the name of the registry entry
+	name string
+}
+
+// replacementKeys returns the keys of the replacements, sorted
+func (d deprecation) replacementKeys() []string {
+	keys := make([]string, 0, len(d.replacements))
+	for key := range d.replacements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// replaced returns whether annotations set any of the replacements already
+func (d deprecation) replaced(annotations map[string]string) bool {
+	for key := range d.replacements {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d deprecation) String() string {
+	return d.key + " (use " + strings.Join(d.replacementKeys(), ", ") + ")"
+}
+
+// translateDeprecatedAnnotations returns annotations with the deprecated keys replaced by the keys
+// of the current schema, along with the deprecated keys found, sorted. The keys removed from the
+// declared schema version are left out and returned as errors; if no version is declared, the keys
+// of every version are accepted. The keys of the current schema win over a deprecated one translated
+// to any of them.
+func (k *annotationKeys) translateDeprecatedAnnotations(version string, annotations map[string]string) (map[string]string, []deprecation, []error) {
+	if version != "" && schemaVersionIndex(version) < 0 {
+		return nil, nil, []error{fmt.Errorf("%s value is invalid: %s, it should be one of %s",
+			k.schemaVersion, version, strings.Join(schemaVersions, ", "))}
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	translated := make(map[string]string, len(annotations))
+	var deprecations []deprecation
+	var errs []error
+	for _, key := range keys {
+		translated[key] = annotations[key]
+		for _, deprecated := range deprecatedKeys {
+			replacements, ok := deprecated.translate(k, key, annotations[key])
+			if !ok {
+				continue
+			}
+			delete(translated, key)
+			found := deprecation{key: key, replacements: replacements, name: deprecated.name}
+			if version != "" && schemaVersionIndex(version) >= schemaVersionIndex(deprecated.removedIn) {
+				errs = append(errs, fmt.Errorf("%s was removed in annotation schema %s, use %s",
+					key, deprecated.removedIn, strings.Join(found.replacementKeys(), ", ")))
+				break
+			}
+			deprecations = append(deprecations, found)
+			if !found.replaced(annotations) {
+				for replacement, value := range replacements {
+					translated[replacement] = value
+				}
+			}
+			break
+		}
+	}
+	return translated, deprecations, errs
+}
+
+func schemaVersionIndex(version string) int {
+	for i, known := range schemaVersions {
+		if known == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// rewriteDeprecatedAnnotations replaces the deprecated keys in the annotations of the workload by
+// the annotations of the current schema. A deprecated key is just removed if any of its replacements
+// is set already.
+func (h *HPAHandler) rewriteDeprecatedAnnotations(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, deprecations []deprecation) error {
+
+	patch := make(map[string]interface{}, 2*len(deprecations))
+	keys := make([]string, 0, len(deprecations))
+	for _, deprecated := range deprecations {
+		patch[deprecated.key] = nil
+		if !deprecated.replaced(annotations) {
+			for replacement, value := range deprecated.replacements {
+				patch[replacement] = value
+			}
+		}
+		keys = append(keys, deprecated.String())
+	}
+
+	log := LoggerFromContext(ctx)
+	if err := h.patchAnnotations(ctx, name, namespace, kind, apiVersion, patch); err != nil {
+		log.Error(err, "failed to rewrite deprecated autoscale annotations")
+		return err
+	}
+	log.Info("deprecated autoscale annotations rewritten", "keys", keys)
+	if h.recorder != nil {
+		ref := &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name, Namespace: namespace, UID: UID}
+		h.recorder.Eventf(ref, corev1.EventTypeNormal, "DeprecatedAnnotationRewritten",
+			"Deprecated autoscale annotations are rewritten: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
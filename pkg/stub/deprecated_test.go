@@ -0,0 +1,281 @@
+package stub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestTranslateDeprecatedAnnotations(t *testing.T) {
+
+	tests := []struct {
+		name                 string
+		version              string
+		annotations          map[string]string
+		expected             map[string]string
+		expectedDeprecations []string
+		expectedErr          string
+	}{
+		{
+			name: "current keys are kept",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+			},
+			expected: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+			},
+		},
+		{
+			name: "deprecated keys are translated",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":       "3",
+				"pod.hpa.autoscaling.banzaicloud.io/http_requests": "10",
+			},
+			expected: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                                   "3",
+				"prometheus.podHttpRequests.hpa.autoscaling.banzaicloud.io/query":              `sum(http_requests{namespace="{{.Namespace}}",{{.Selector}}})`,
+				"prometheus.podHttpRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+			},
+			expectedDeprecations: []string{"pod.hpa.autoscaling.banzaicloud.io/http_requests"},
+		},
+		{
+			name: "series names invalid in PromQL are selected by name",
+			annotations: map[string]string{
+				"pod.hpa.autoscaling.banzaicloud.io/nginx-requests": "10",
+			},
+			expected: map[string]string{
+				"prometheus.podNginxRequests.hpa.autoscaling.banzaicloud.io/query":              `sum({__name__="nginx-requests",namespace="{{.Namespace}}",{{.Selector}}})`,
+				"prometheus.podNginxRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+			},
+			expectedDeprecations: []string{"pod.hpa.autoscaling.banzaicloud.io/nginx-requests"},
+		},
+		{
+			name:    "declared v1 schema",
+			version: schemaV1,
+			annotations: map[string]string{
+				"pod.hpa.autoscaling.banzaicloud.io/requests": "10",
+			},
+			expected: map[string]string{
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/query":              `sum(requests{namespace="{{.Namespace}}",{{.Selector}}})`,
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+			},
+			expectedDeprecations: []string{"pod.hpa.autoscaling.banzaicloud.io/requests"},
+		},
+		{
+			name: "current keys win",
+			annotations: map[string]string{
+				"pod.hpa.autoscaling.banzaicloud.io/requests":                 "10",
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/query": "sum(http_requests)",
+			},
+			expected: map[string]string{
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/query": "sum(http_requests)",
+			},
+			expectedDeprecations: []string{"pod.hpa.autoscaling.banzaicloud.io/requests"},
+		},
+		{
+			name:    "removed from the declared schema",
+			version: schemaV2,
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":  "3",
+				"pod.hpa.autoscaling.banzaicloud.io/requests": "10",
+			},
+			expected: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas": "3",
+			},
+			expectedErr: "pod.hpa.autoscaling.banzaicloud.io/requests was removed in annotation schema v2, use prometheus.podRequests.hpa.autoscaling.banzaicloud.io/query, " +
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue",
+		},
+		{
+			name:    "unknown schema version",
+			version: "v3",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas": "3",
+			},
+			expectedErr: "autoscaling.banzaicloud.io/annotation-schema value is invalid: v3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translated, deprecations, errs := defaultAnnotationKeys.translateDeprecatedAnnotations(test.version, test.annotations)
+			if !reflect.DeepEqual(translated, test.expected) {
+				t.Errorf("Annotations expected: %v actual: %v", test.expected, translated)
+			}
+			var deprecatedKeys []string
+			for _, deprecated := range deprecations {
+				deprecatedKeys = append(deprecatedKeys, deprecated.key)
+			}
+			if !reflect.DeepEqual(deprecatedKeys, test.expectedDeprecations) {
+				t.Errorf("Deprecated keys expected: %v actual: %v", test.expectedDeprecations, deprecatedKeys)
+			}
+			if test.expectedErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("Unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.expectedErr) {
+				t.Errorf("Error expected: %v actual: %v", test.expectedErr, errs)
+			}
+		})
+	}
+}
+
+func TestDeprecatedPodMetricName(t *testing.T) {
+
+	long := strings.Repeat("kafka_consumergroup_", 4)
+	tests := []struct {
+		seriesName string
+		expected   string
+	}{
+		{seriesName: "requests", expected: "podRequests"},
+		{seriesName: "http_requests", expected: "podHttpRequests"},
+		{seriesName: "http_2xx_total", expected: "podHttpTwoXxTotal"},
+		{seriesName: "http_5xx_total", expected: "podHttpFiveXxTotal"},
+		{seriesName: "nginx-requests.per_second", expected: "podNginxRequestsPerSecond"},
+		{seriesName: long + "lag", expected: "podKafkaConsumergroupKafkaConsumergroupKafkaConsumergrou" + "hcqznqi"},
+		{seriesName: long + "lag_sum", expected: "podKafkaConsumergroupKafkaConsumergroupKafkaConsumergrou" + "jfxsepj"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.seriesName, func(t *testing.T) {
+			actual := deprecatedPodMetricName(test.seriesName)
+			if actual != test.expected {
+				t.Errorf("Metric name expected: %v actual: %v", test.expected, actual)
+			}
+			if !prometheusMetricNameRegExp.MatchString(actual) {
+				t.Errorf("Metric name %v doesn't match %v", actual, prometheusMetricNameRegExp)
+			}
+
+			// the translated metric is accepted
+			annotations, _, errs := defaultAnnotationKeys.translateDeprecatedAnnotations("", map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":            "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":            "3",
+				"pod.hpa.autoscaling.banzaicloud.io/" + test.seriesName: "10",
+			})
+			if len(errs) > 0 {
+				t.Fatalf("Unexpected errors: %v", errs)
+			}
+			hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(hpa.Spec.Metrics) != 1 {
+				t.Errorf("Prometheus metric expected, actual: %v", hpa.Spec.Metrics)
+			}
+		})
+	}
+}
+
+func TestHandleReplicaSetDeprecatedAnnotations(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+		"pod.hpa.autoscaling.banzaicloud.io/requests":                           "10",
+		"pod.hpa.autoscaling.banzaicloud.io/queue":                              "5",
+		"prometheus.podQueue.hpa.autoscaling.banzaicloud.io/query":              "sum(queue_length)",
+		"prometheus.podQueue.hpa.autoscaling.banzaicloud.io/targetAverageValue": "20",
+	}
+
+	for _, rewrite := range []bool{false, true} {
+		scheme := runtime.NewScheme()
+		_ = clientgoscheme.AddToScheme(scheme)
+
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: annotations},
+		}
+		c := fake.NewFakeClientWithScheme(scheme, deployment)
+		recorder := record.NewFakeRecorder(10)
+		handler, err := NewHandler(c, recorder, Options{RewriteDeprecatedAnnotations: rewrite})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		counter := deprecatedAnnotationsTotal.WithLabelValues("pod.<prefix>/<metricName>")
+		before := testutil.ToFloat64(counter)
+		ctx := context.Background()
+		err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+			"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if actual := testutil.ToFloat64(counter) - before; actual != 2 {
+			t.Errorf("Deprecated annotations counted expected: %v actual: %v", 2, actual)
+		}
+
+		hpa := &v2beta2.HorizontalPodAutoscaler{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, hpa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var targets []string
+		for _, metric := range hpa.Spec.Metrics {
+			metricName, err := prometheusQueryName(metric.External)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			targets = append(targets, metricName+"="+metric.External.Target.AverageValue.String()+" "+
+				hpa.Annotations[prometheusQueryMetricConfigAnnotation+metricName])
+		}
+		expectedTargets := []string{
+			"podQueue=20 sum(queue_length)",
+			`podRequests=10 sum(requests{namespace="default",})`,
+		}
+		if !reflect.DeepEqual(targets, expectedTargets) {
+			t.Errorf("Prometheus metrics expected: %v actual: %v", expectedTargets, targets)
+		}
+
+		events := []string{<-recorder.Events}
+		if rewrite {
+			events = append(events, <-recorder.Events)
+		}
+		if !strings.HasPrefix(events[0], "Warning DeprecatedAnnotation Deprecated autoscale annotations are used on the Deployment: "+
+			"pod.hpa.autoscaling.banzaicloud.io/queue (use prometheus.podQueue.hpa.autoscaling.banzaicloud.io/query, "+
+			"prometheus.podQueue.hpa.autoscaling.banzaicloud.io/targetAverageValue)") {
+			t.Errorf("Deprecation event expected, actual: %v", events[0])
+		}
+
+		actual := &appsv1.Deployment{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := map[string]string{
+			"pod.hpa.autoscaling.banzaicloud.io/requests":                           "10",
+			"pod.hpa.autoscaling.banzaicloud.io/queue":                              "5",
+			"prometheus.podQueue.hpa.autoscaling.banzaicloud.io/targetAverageValue": "20",
+		}
+		if rewrite {
+			if !strings.HasPrefix(events[1], "Normal DeprecatedAnnotationRewritten") {
+				t.Errorf("Rewrite event expected, actual: %v", events[1])
+			}
+			expected = map[string]string{
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/query":              `sum(requests{namespace="{{.Namespace}}",{{.Selector}}})`,
+				"prometheus.podRequests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+				"prometheus.podQueue.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "20",
+			}
+		}
+		for key, value := range expected {
+			if actual.Annotations[key] != value {
+				t.Errorf("Annotation %v expected: %v actual: %v", key, value, actual.Annotations[key])
+			}
+		}
+		if rewrite {
+			for key := range actual.Annotations {
+				if strings.HasPrefix(key, "pod.") {
+					t.Errorf("Deprecated annotation should be removed: %v", key)
+				}
+			}
+		}
+	}
+}
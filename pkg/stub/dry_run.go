@@ -0,0 +1,230 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The changes reported in dry-run mode
+const (
+	dryRunCreate = "create"
+	dryRunUpdate = "update"
+	dryRunDelete = "delete"
+)
+
+var dryRunChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "hpa_operator_dry_run_changes",
+	Help: "Changes the operator would make in dry-run mode, 1 for each object it would create, update or delete.",
+}, []string{"namespace", "name", "kind", "action"})
+
+func init() {
+	metrics.Registry.MustRegister(dryRunChanges)
+}
+
+// dryRunClient sends the writes of the handler as server-side dry-run requests: the API server
+// validates and admits them, but doesn't persist them. The writes the API server, or one of its
+// admission webhooks, can't dry-run are skipped.
+type dryRunClient struct {
+	client.Client
+}
+
+func (c dryRunClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	return dryRunResult(ctx, c.Client.Create(ctx, obj, append(opts, client.DryRunAll)...))
+}
+
+func (c dryRunClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	return dryRunResult(ctx, c.Client.Update(ctx, obj, append(opts, client.DryRunAll)...))
+}
+
+func (c dryRunClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return dryRunResult(ctx, c.Client.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...))
+}
+
+func (c dryRunClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	return dryRunResult(ctx, c.Client.Delete(ctx, obj, append(opts, client.DryRunAll)...))
+}
+
+// DeleteAllOf has no dry-run option, it's skipped
+func (c dryRunClient) DeleteAllOf(ctx context.Context, obj runtime.Object, opts ...client.DeleteAllOfOption) error {
+	LoggerFromContext(ctx).V(1).Info("dry run: delete all of is skipped")
+	return nil
+}
+
+func (c dryRunClient) Status() client.StatusWriter {
+	return dryRunStatusWriter{c.Client.Status()}
+}
+
+// dryRunStatusWriter is the status writer of dryRunClient
+type dryRunStatusWriter struct {
+	client.StatusWriter
+}
+
+func (w dryRunStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	return dryRunResult(ctx, w.StatusWriter.Update(ctx, obj, append(opts, client.DryRunAll)...))
+}
+
+func (w dryRunStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return dryRunResult(ctx, w.StatusWriter.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...))
+}
+
+// dryRunResult ignores the error of a dry-run request the API server doesn't support
+func dryRunResult(ctx context.Context, err error) error {
+	if err != nil && errors.IsBadRequest(err) && strings.Contains(strings.ToLower(err.Error()), "dry") {
+		LoggerFromContext(ctx).V(1).Info("server-side dry-run is not supported, the request is skipped", "reason", err.Error())
+		return nil
+	}
+	return err
+}
+
+// clearDryRun removes the changes reported for the object of kind named name
+func (h *HPAHandler) clearDryRun(kind string, name string, namespace string) {
+	if !h.dryRun {
+		return
+	}
+	for _, action := range []string{dryRunCreate, dryRunUpdate, dryRunDelete} {
+		dryRunChanges.DeleteLabelValues(namespace, name, kind, action)
+	}
+}
+
+// reportDryRun logs the change the handler would make in dry-run mode, turning current into desired,
+// and reports it as an event of the owner of the objects and in the dry-run changes metric. A nil
+// current means the object would be created, a nil desired that it would be deleted. Only the
+// labels, annotations and spec are compared, an update without changes isn't reported.
+func (h *HPAHandler) reportDryRun(ctx context.Context, kind string, name string, namespace string, current runtime.Object, desired runtime.Object) {
+	if !h.dryRun {
+		return
+	}
+	h.clearDryRun(kind, name, namespace)
+	log := LoggerFromContext(ctx)
+
+	var action string
+	var changes []string
+	switch {
+	case current == nil:
+		action = dryRunCreate
+	case desired == nil:
+		action = dryRunDelete
+	default:
+		action = dryRunUpdate
+		var err error
+		if changes, err = objectChanges(current, desired); err != nil {
+			log.Error(err, "failed to compare "+kind)
+			return
+		}
+		if len(changes) == 0 {
+			log.V(1).Info("dry run: " + kind + " is up to date")
+			return
+		}
+	}
+	dryRunChanges.WithLabelValues(namespace, name, kind, action).Set(1)
+
+	message := fmt.Sprintf("Dry run: %s %s would be %sd", kind, name, action)
+	if len(changes) > 0 {
+		message += ": " + strings.Join(changes, ", ")
+	}
+	if action == dryRunCreate {
+		log.Info("dry run: "+kind+" would be created", "object", desired)
+	} else {
+		log.Info("dry run: "+kind+" would be "+action+"d", "changes", changes)
+	}
+
+	owner := desired
+	if owner == nil {
+		owner = current
+	}
+	ownerMeta, err := meta.Accessor(owner)
+	if err != nil || h.recorder == nil {
+		return
+	}
+	if ref := metav1.GetControllerOf(ownerMeta); ref != nil {
+		h.recorder.Event(&corev1.ObjectReference{
+			APIVersion: ref.APIVersion, Kind: ref.Kind, Name: ref.Name, Namespace: namespace, UID: ref.UID,
+		}, corev1.EventTypeNormal, "DryRun", message)
+	}
+}
+
+// objectChanges lists the labels, annotations and spec fields of desired which differ from current
+func objectChanges(current runtime.Object, desired runtime.Object) ([]string, error) {
+	fields := func(obj runtime.Object) (map[string]interface{}, error) {
+		var content map[string]interface{}
+		if u, ok := obj.(runtime.Unstructured); ok {
+			content = u.UnstructuredContent()
+		} else {
+			var err error
+			if content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+				return nil, err
+			}
+		}
+		result := map[string]interface{}{"spec": content["spec"]}
+		if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+			result["metadata"] = map[string]interface{}{"labels": metadata["labels"], "annotations": metadata["annotations"]}
+		}
+		return result, nil
+	}
+	currentFields, err := fields(current)
+	if err != nil {
+		return nil, err
+	}
+	desiredFields, err := fields(desired)
+	if err != nil {
+		return nil, err
+	}
+	return fieldChanges("", currentFields, desiredFields), nil
+}
+
+// fieldChanges lists the fields of b which differ from a by their path, e.g. spec.maxReplicas: 3 -> 5.
+// Lists are compared as a whole.
+func fieldChanges(path string, a interface{}, b interface{}) []string {
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	aMap, aIsMap := a.(map[string]interface{})
+	bMap, bIsMap := b.(map[string]interface{})
+	if (aIsMap || a == nil) && (bIsMap || b == nil) {
+		keys := make([]string, 0, len(aMap)+len(bMap))
+		for key := range aMap {
+			keys = append(keys, key)
+		}
+		for key := range bMap {
+			if _, ok := aMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var changes []string
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			changes = append(changes, fieldChanges(fieldPath, aMap[key], bMap[key])...)
+		}
+		return changes
+	}
+	return []string{fmt.Sprintf("%s: %s -> %s", path, fieldValue(a), fieldValue(b))}
+}
+
+// fieldValue formats a field value as JSON, or <none> if it's not set
+func fieldValue(value interface{}) string {
+	if value == nil {
+		return "<none>"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -0,0 +1,161 @@
+package stub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFieldChanges(t *testing.T) {
+
+	current := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": nil, "annotations": map[string]interface{}{"a": "1", "b": "2"}},
+		"spec": map[string]interface{}{
+			"maxReplicas": int64(3),
+			"minReplicas": int64(1),
+			"metrics":     []interface{}{"cpu"},
+		},
+	}
+	desired := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"instance": "canary"}, "annotations": map[string]interface{}{"a": "1"}},
+		"spec": map[string]interface{}{
+			"maxReplicas": int64(5),
+			"minReplicas": int64(1),
+			"metrics":     []interface{}{"cpu", "memory"},
+		},
+	}
+	expected := []string{
+		`metadata.annotations.b: "2" -> <none>`,
+		`metadata.labels.instance: <none> -> "canary"`,
+		`spec.maxReplicas: 3 -> 5`,
+		`spec.metrics: ["cpu"] -> ["cpu","memory"]`,
+	}
+	if changes := fieldChanges("", current, desired); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes expected: %v actual: %v", expected, changes)
+	}
+	if changes := fieldChanges("", current, current); changes != nil {
+		t.Errorf("No changes expected, actual: %v", changes)
+	}
+}
+
+// dryRunCheckClient fails the test on writes which aren't dry-run requests
+type dryRunCheckClient struct {
+	client.Client
+	t *testing.T
+}
+
+func (c dryRunCheckClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	options := &client.CreateOptions{}
+	if options.ApplyOptions(opts); !reflect.DeepEqual(options.DryRun, []string{metav1.DryRunAll}) {
+		c.t.Errorf("Create should be a dry-run request: %v", obj)
+	}
+	return nil
+}
+
+func (c dryRunCheckClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	options := &client.UpdateOptions{}
+	if options.ApplyOptions(opts); !reflect.DeepEqual(options.DryRun, []string{metav1.DryRunAll}) {
+		c.t.Errorf("Update should be a dry-run request: %v", obj)
+	}
+	return nil
+}
+
+func (c dryRunCheckClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	options := &client.PatchOptions{}
+	if options.ApplyOptions(opts); !reflect.DeepEqual(options.DryRun, []string{metav1.DryRunAll}) {
+		c.t.Errorf("Patch should be a dry-run request: %v", obj)
+	}
+	return nil
+}
+
+func (c dryRunCheckClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	options := &client.DeleteOptions{}
+	if options.ApplyOptions(opts); !reflect.DeepEqual(options.DryRun, []string{metav1.DryRunAll}) {
+		c.t.Errorf("Delete should be a dry-run request: %v", obj)
+	}
+	return nil
+}
+
+func TestHandleReplicaSetDryRun(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "5",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "dry-run", UID: "uid", Annotations: annotations},
+	}
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), deployment.UID,
+		deployment.Name, deployment.Namespace, "Deployment", "apps/v1", annotations, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hpa.Spec.MaxReplicas = 3
+	c := fake.NewFakeClientWithScheme(scheme, deployment, hpa)
+	recorder := record.NewFakeRecorder(10)
+	handler, err := NewHandler(dryRunCheckClient{Client: c, t: t}, recorder, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "Normal DryRun Dry run: HorizontalPodAutoscaler test would be updated: spec.maxReplicas: 3 -> 5"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("Event expected: %v actual: %v", expected, event)
+	}
+	gauge := dryRunChanges.WithLabelValues("dry-run", "test", "HorizontalPodAutoscaler", dryRunUpdate)
+	if actual := testutil.ToFloat64(gauge); actual != 1 {
+		t.Errorf("Dry-run changes expected: %v actual: %v", 1, actual)
+	}
+
+	// up to date
+	hpa.Spec.MaxReplicas = 5
+	if err := c.Update(ctx, hpa); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("No event expected, actual: %v", <-recorder.Events)
+	}
+	gauge = dryRunChanges.WithLabelValues("dry-run", "test", "HorizontalPodAutoscaler", dryRunUpdate)
+	if actual := testutil.ToFloat64(gauge); actual != 0 {
+		t.Errorf("Dry-run changes expected: %v actual: %v", 0, actual)
+	}
+
+	// removed annotations
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = "Normal DryRun Dry run: HorizontalPodAutoscaler test would be deleted"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("Event expected: %v actual: %v", expected, event)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "dry-run"}, &v2beta2.HorizontalPodAutoscaler{}); err != nil {
+		t.Errorf("HPA should be left alone: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package stub
+
+import (
+	stderrors "errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/api/autoscaling/v2beta1"
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// metric names have to fit into a single annotation sub domain, and into the label value of the
+// external metric selector
+var prometheusMetricNameRegExp = regexp.MustCompile("^[a-zA-Z]{1,63}$")
+
+// AnnotationsFromHorizontalPodAutoscaler returns the autoscale annotations which make the operator
+// generate an equivalent of hpa, an autoscaling/v1, v2beta1 or v2beta2 HorizontalPodAutoscaler.
+// The annotations are meant to be put on the scale target of hpa. The returned errors list the
+// parts of hpa which can't be expressed by annotations, these are left out.
+func (h *HPAHandler) AnnotationsFromHorizontalPodAutoscaler(hpa runtime.Object) (map[string]string, []error) {
+	return h.snapshot().keys.annotationsFromHorizontalPodAutoscaler(hpa)
+}
+
+func (k *annotationKeys) annotationsFromHorizontalPodAutoscaler(hpa runtime.Object) (map[string]string, []error) {
+	converted, err := ConvertHorizontalPodAutoscaler(hpa)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errs []error
+	annotations := make(map[string]string)
+
+	minReplicas := int32(1)
+	if converted.Spec.MinReplicas != nil {
+		minReplicas = *converted.Spec.MinReplicas
+	}
+	annotations[k.field("minReplicas")] = strconv.Itoa(int(minReplicas))
+	annotations[k.field("maxReplicas")] = strconv.Itoa(int(converted.Spec.MaxReplicas))
+
+	add := func(key string, value string) {
+		if _, ok := annotations[key]; ok {
+			errs = append(errs, stderrors.New("more than one metric maps to annotation "+key))
+			return
+		}
+		annotations[key] = value
+	}
+
+	for i, metric := range converted.Spec.Metrics {
+		switch {
+		case metric.Type == v2beta2.ResourceMetricSourceType && metric.Resource != nil:
+			var prefix string
+			switch metric.Resource.Name {
+			case v1.ResourceCPU:
+				prefix = cpuAnnotationPrefix
+			case v1.ResourceMemory:
+				prefix = memoryAnnotationPrefix
+			default:
+				errs = append(errs, fmt.Errorf("metric %d: resource %s is not supported", i, metric.Resource.Name))
+				continue
+			}
+			key := k.subDomain(prefix) + annotationDomainSeparator
+			target := metric.Resource.Target
+			switch {
+			case target.Type == v2beta2.UtilizationMetricType && target.AverageUtilization != nil &&
+				(*target.AverageUtilization < 1 || *target.AverageUtilization > 100):
+				// Kubernetes accepts any positive utilization, the annotations are percentages
+				errs = append(errs, fmt.Errorf("metric %d: %s target utilization %d is out of the [1,100] range of the annotations",
+					i, metric.Resource.Name, *target.AverageUtilization))
+			case target.Type == v2beta2.UtilizationMetricType && target.AverageUtilization != nil:
+				add(key+targetAverageUtilization, strconv.Itoa(int(*target.AverageUtilization)))
+			case target.Type == v2beta2.AverageValueMetricType && target.AverageValue != nil:
+				add(key+targetAverageValue, target.AverageValue.String())
+			default:
+				errs = append(errs, fmt.Errorf("metric %d: %s target type %s is not supported", i, metric.Resource.Name, target.Type))
+			}
+
+		case metric.Type == v2beta2.ExternalMetricSourceType && metric.External != nil:
+			metricName, err := prometheusQueryName(metric.External)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("metric %d: %v", i, err))
+				continue
+			}
+			query, ok := converted.Annotations[prometheusQueryMetricConfigAnnotation+metricName]
+			if !ok {
+				errs = append(errs, fmt.Errorf("metric %d: query of prometheus metric %s is missing", i, metricName))
+				continue
+			}
+			target := metric.External.Target
+			switch {
+			case target.Type == v2beta2.ValueMetricType && target.Value != nil:
+				add(k.prometheus(metricName, targetValue), target.Value.String())
+			case target.Type == v2beta2.AverageValueMetricType && target.AverageValue != nil:
+				add(k.prometheus(metricName, targetAverageValue), target.AverageValue.String())
+			default:
+				errs = append(errs, fmt.Errorf("metric %d: prometheus metric %s target type %s is not supported", i, metricName, target.Type))
+				continue
+			}
+			annotations[k.prometheus(metricName, "query")] = query
+
+		default:
+			errs = append(errs, fmt.Errorf("metric %d: %s metrics are not supported", i, metric.Type))
+		}
+	}
+
+	return annotations, errs
+}
+
+// prometheusQueryName returns the name of a kube-metrics-adapter prometheus query metric
+func prometheusQueryName(external *v2beta2.ExternalMetricSource) (string, error) {
+	selector := external.Metric.Selector
+	if external.Metric.Name != prometheusQueryMetricName || selector == nil ||
+		len(selector.MatchExpressions) > 0 || len(selector.MatchLabels) != 1 {
+		return "", fmt.Errorf("external metric %s is not a prometheus query", external.Metric.Name)
+	}
+	metricName := selector.MatchLabels[prometheusQueryNameLabel]
+	if !prometheusMetricNameRegExp.MatchString(metricName) {
+		return "", fmt.Errorf("prometheus metric name %q should contain 1 to 63 letters only", metricName)
+	}
+	return metricName, nil
+}
+
+// ConvertHorizontalPodAutoscaler converts an autoscaling/v1 or v2beta1 HorizontalPodAutoscaler to v2beta2.
+// A v2beta2 HorizontalPodAutoscaler is returned as is.
+func ConvertHorizontalPodAutoscaler(hpa runtime.Object) (*v2beta2.HorizontalPodAutoscaler, error) {
+	switch hpa := hpa.(type) {
+	case *v2beta2.HorizontalPodAutoscaler:
+		return hpa, nil
+
+	case *v2beta1.HorizontalPodAutoscaler:
+		converted := &v2beta2.HorizontalPodAutoscaler{
+			ObjectMeta: hpa.ObjectMeta,
+			Spec: v2beta2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: v2beta2.CrossVersionObjectReference(hpa.Spec.ScaleTargetRef),
+				MinReplicas:    hpa.Spec.MinReplicas,
+				MaxReplicas:    hpa.Spec.MaxReplicas,
+			},
+		}
+		for _, metric := range hpa.Spec.Metrics {
+			converted.Spec.Metrics = append(converted.Spec.Metrics, convertV2beta1MetricSpec(metric))
+		}
+		return converted, nil
+
+	case *autoscalingv1.HorizontalPodAutoscaler:
+		if _, ok := hpa.Annotations["autoscaling.alpha.kubernetes.io/metrics"]; ok {
+			return nil, stderrors.New("metrics in the autoscaling.alpha.kubernetes.io/metrics annotation are not supported")
+		}
+		converted := &v2beta2.HorizontalPodAutoscaler{
+			ObjectMeta: hpa.ObjectMeta,
+			Spec: v2beta2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: v2beta2.CrossVersionObjectReference(hpa.Spec.ScaleTargetRef),
+				MinReplicas:    hpa.Spec.MinReplicas,
+				MaxReplicas:    hpa.Spec.MaxReplicas,
+			},
+		}
+		if hpa.Spec.TargetCPUUtilizationPercentage != nil {
+			converted.Spec.Metrics = []v2beta2.MetricSpec{
+				{
+					Type: v2beta2.ResourceMetricSourceType,
+					Resource: &v2beta2.ResourceMetricSource{
+						Name: v1.ResourceCPU,
+						Target: v2beta2.MetricTarget{
+							Type:               v2beta2.UtilizationMetricType,
+							AverageUtilization: hpa.Spec.TargetCPUUtilizationPercentage,
+						},
+					},
+				},
+			}
+		}
+		return converted, nil
+	}
+	return nil, fmt.Errorf("%T is not a HorizontalPodAutoscaler", hpa)
+}
+
+func convertV2beta1MetricSpec(metric v2beta1.MetricSpec) v2beta2.MetricSpec {
+	converted := v2beta2.MetricSpec{Type: v2beta2.MetricSourceType(metric.Type)}
+	switch {
+	case metric.Resource != nil:
+		converted.Resource = &v2beta2.ResourceMetricSource{Name: metric.Resource.Name}
+		if metric.Resource.TargetAverageUtilization != nil {
+			converted.Resource.Target = v2beta2.MetricTarget{
+				Type:               v2beta2.UtilizationMetricType,
+				AverageUtilization: metric.Resource.TargetAverageUtilization,
+			}
+		} else if metric.Resource.TargetAverageValue != nil {
+			converted.Resource.Target = v2beta2.MetricTarget{
+				Type:         v2beta2.AverageValueMetricType,
+				AverageValue: metric.Resource.TargetAverageValue,
+			}
+		}
+	case metric.External != nil:
+		converted.External = &v2beta2.ExternalMetricSource{
+			Metric: v2beta2.MetricIdentifier{
+				Name:     metric.External.MetricName,
+				Selector: metric.External.MetricSelector,
+			},
+		}
+		if metric.External.TargetValue != nil {
+			converted.External.Target = v2beta2.MetricTarget{
+				Type:  v2beta2.ValueMetricType,
+				Value: metric.External.TargetValue,
+			}
+		} else if metric.External.TargetAverageValue != nil {
+			converted.External.Target = v2beta2.MetricTarget{
+				Type:         v2beta2.AverageValueMetricType,
+				AverageValue: metric.External.TargetAverageValue,
+			}
+		}
+	case metric.Pods != nil:
+		converted.Pods = &v2beta2.PodsMetricSource{
+			Metric: v2beta2.MetricIdentifier{
+				Name:     metric.Pods.MetricName,
+				Selector: metric.Pods.Selector,
+			},
+			Target: v2beta2.MetricTarget{
+				Type:         v2beta2.AverageValueMetricType,
+				AverageValue: quantityPtr(metric.Pods.TargetAverageValue),
+			},
+		}
+	case metric.Object != nil:
+		converted.Object = &v2beta2.ObjectMetricSource{
+			DescribedObject: v2beta2.CrossVersionObjectReference(metric.Object.Target),
+			Metric: v2beta2.MetricIdentifier{
+				Name:     metric.Object.MetricName,
+				Selector: metric.Object.Selector,
+			},
+			Target: v2beta2.MetricTarget{
+				Type:  v2beta2.ValueMetricType,
+				Value: quantityPtr(metric.Object.TargetValue),
+			},
+		}
+	}
+	return converted
+}
+
+func quantityPtr(quantity resource.Quantity) *resource.Quantity {
+	return &quantity
+}
@@ -0,0 +1,307 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/api/autoscaling/v2beta1"
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func sortedMetrics(t *testing.T, metrics []v2beta2.MetricSpec) []string {
+	result := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		data, err := json.Marshal(metric)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		result = append(result, string(data))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestAnnotationsRoundTrip(t *testing.T) {
+
+	tests := []map[string]string{
+		{
+			"hpa.autoscaling.banzaicloud.io/minReplicas":                     "1",
+			"hpa.autoscaling.banzaicloud.io/maxReplicas":                     "3",
+			"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":    "80",
+			"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":       "1Gi",
+			"memory.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "60",
+		},
+		{
+			"hpa.autoscaling.banzaicloud.io/minReplicas":                            "2",
+			"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "10",
+			"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(rate(http_requests_total[1m]))",
+			"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+			"prometheus.queueLength.hpa.autoscaling.banzaicloud.io/query":           "sum(queue_length)",
+			"prometheus.queueLength.hpa.autoscaling.banzaicloud.io/targetValue":     "500m",
+			"cpu.hpa.autoscaling.banzaicloud.io/targetAverageValue":                 "500m",
+		},
+	}
+
+	for _, annotations := range tests {
+		hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		actual, errs := defaultAnnotationKeys.annotationsFromHorizontalPodAutoscaler(hpa)
+		if len(errs) > 0 {
+			t.Errorf("Unexpected errors: %v", errs)
+		}
+		if !reflect.DeepEqual(annotations, actual) {
+			t.Errorf("Annotations expected: %v actual: %v", annotations, actual)
+		}
+	}
+}
+
+func TestHorizontalPodAutoscalerRoundTrip(t *testing.T) {
+
+	minReplicas := int32(2)
+	utilization := int32(70)
+	averageValue := resource.MustParse("512Mi")
+	value := resource.MustParse("30")
+	expected := v2beta2.HorizontalPodAutoscalerSpec{
+		MinReplicas: &minReplicas,
+		MaxReplicas: 5,
+		Metrics: []v2beta2.MetricSpec{
+			{
+				Type: v2beta2.ResourceMetricSourceType,
+				Resource: &v2beta2.ResourceMetricSource{
+					Name:   v1.ResourceCPU,
+					Target: v2beta2.MetricTarget{Type: v2beta2.UtilizationMetricType, AverageUtilization: &utilization},
+				},
+			},
+			{
+				Type: v2beta2.ResourceMetricSourceType,
+				Resource: &v2beta2.ResourceMetricSource{
+					Name:   v1.ResourceMemory,
+					Target: v2beta2.MetricTarget{Type: v2beta2.AverageValueMetricType, AverageValue: &averageValue},
+				},
+			},
+			{
+				Type: v2beta2.ExternalMetricSourceType,
+				External: &v2beta2.ExternalMetricSource{
+					Metric: v2beta2.MetricIdentifier{
+						Name:     "prometheus-query",
+						Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"query-name": "lag"}},
+					},
+					Target: v2beta2.MetricTarget{Type: v2beta2.ValueMetricType, Value: &value},
+				},
+			},
+		},
+	}
+	meta := metav1.ObjectMeta{
+		Name: "test",
+		Annotations: map[string]string{
+			"metric-config.external.prometheus-query.prometheus/lag": "sum(kafka_consumergroup_lag)",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		hpa      runtime.Object
+		expected v2beta2.HorizontalPodAutoscalerSpec
+	}{
+		{
+			name:     "v2beta2",
+			hpa:      &v2beta2.HorizontalPodAutoscaler{ObjectMeta: meta, Spec: expected},
+			expected: expected,
+		},
+		{
+			name: "v2beta1",
+			hpa: &v2beta1.HorizontalPodAutoscaler{
+				ObjectMeta: meta,
+				Spec: v2beta1.HorizontalPodAutoscalerSpec{
+					MinReplicas: &minReplicas,
+					MaxReplicas: 5,
+					Metrics: []v2beta1.MetricSpec{
+						{
+							Type:     v2beta1.ResourceMetricSourceType,
+							Resource: &v2beta1.ResourceMetricSource{Name: v1.ResourceCPU, TargetAverageUtilization: &utilization},
+						},
+						{
+							Type:     v2beta1.ResourceMetricSourceType,
+							Resource: &v2beta1.ResourceMetricSource{Name: v1.ResourceMemory, TargetAverageValue: &averageValue},
+						},
+						{
+							Type: v2beta1.ExternalMetricSourceType,
+							External: &v2beta1.ExternalMetricSource{
+								MetricName:     "prometheus-query",
+								MetricSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"query-name": "lag"}},
+								TargetValue:    &value,
+							},
+						},
+					},
+				},
+			},
+			expected: expected,
+		},
+		{
+			name: "v1",
+			hpa: &autoscalingv1.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+					MinReplicas:                    &minReplicas,
+					MaxReplicas:                    5,
+					TargetCPUUtilizationPercentage: &utilization,
+				},
+			},
+			expected: v2beta2.HorizontalPodAutoscalerSpec{
+				MinReplicas: &minReplicas,
+				MaxReplicas: 5,
+				Metrics:     expected.Metrics[:1],
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			annotations, errs := defaultAnnotationKeys.annotationsFromHorizontalPodAutoscaler(test.hpa)
+			if len(errs) > 0 {
+				t.Fatalf("Unexpected errors: %v", errs)
+			}
+			hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *hpa.Spec.MinReplicas != *test.expected.MinReplicas || hpa.Spec.MaxReplicas != test.expected.MaxReplicas {
+				t.Errorf("Replicas expected: %v-%v actual: %v-%v", *test.expected.MinReplicas, test.expected.MaxReplicas,
+					*hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas)
+			}
+			if expected, actual := sortedMetrics(t, test.expected.Metrics), sortedMetrics(t, hpa.Spec.Metrics); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("Metrics expected: %v actual: %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestHorizontalPodAutoscalerRoundTripUtilizationAbovePercentage(t *testing.T) {
+
+	utilization := int32(70)
+	above := int32(150)
+	tests := []struct {
+		name string
+		hpa  runtime.Object
+	}{
+		{
+			name: "v2beta2",
+			hpa: &v2beta2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec: v2beta2.HorizontalPodAutoscalerSpec{
+					MaxReplicas: 5,
+					Metrics: []v2beta2.MetricSpec{
+						{
+							Type: v2beta2.ResourceMetricSourceType,
+							Resource: &v2beta2.ResourceMetricSource{
+								Name:   v1.ResourceCPU,
+								Target: v2beta2.MetricTarget{Type: v2beta2.UtilizationMetricType, AverageUtilization: &above},
+							},
+						},
+						{
+							Type: v2beta2.ResourceMetricSourceType,
+							Resource: &v2beta2.ResourceMetricSource{
+								Name:   v1.ResourceMemory,
+								Target: v2beta2.MetricTarget{Type: v2beta2.UtilizationMetricType, AverageUtilization: &utilization},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "v1",
+			hpa: &autoscalingv1.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+					MaxReplicas:                    5,
+					TargetCPUUtilizationPercentage: &above,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			annotations, errs := defaultAnnotationKeys.annotationsFromHorizontalPodAutoscaler(test.hpa)
+			expected := "metric 0: cpu target utilization 150 is out of the [1,100] range of the annotations"
+			if len(errs) != 1 || errs[0].Error() != expected {
+				t.Errorf("Error expected: %v actual: %v", expected, errs)
+			}
+			if _, ok := annotations["cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization"]; ok {
+				t.Errorf("Utilization above 100 expected to be left out: %v", annotations)
+			}
+			// the annotations which are emitted generate their metrics
+			hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+			if test.name == "v1" {
+				if err == nil {
+					t.Errorf("No metrics expected to be configured, actual: %v", hpa.Spec.Metrics)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Resource.Name != v1.ResourceMemory {
+				t.Errorf("Memory metric expected, actual: %v", hpa.Spec.Metrics)
+			}
+		})
+	}
+}
+
+func TestAnnotationsFromHorizontalPodAutoscalerReportsUnsupportedMetrics(t *testing.T) {
+
+	value := resource.MustParse("10")
+	hpa := &v2beta2.HorizontalPodAutoscaler{
+		Spec: v2beta2.HorizontalPodAutoscalerSpec{
+			MaxReplicas: 3,
+			Metrics: []v2beta2.MetricSpec{
+				{
+					Type: v2beta2.PodsMetricSourceType,
+					Pods: &v2beta2.PodsMetricSource{
+						Metric: v2beta2.MetricIdentifier{
+							Name:     "requests",
+							Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"path": "/"}},
+						},
+						Target: v2beta2.MetricTarget{Type: v2beta2.AverageValueMetricType, AverageValue: &value},
+					},
+				},
+				{
+					Type: v2beta2.ExternalMetricSourceType,
+					External: &v2beta2.ExternalMetricSource{
+						Metric: v2beta2.MetricIdentifier{Name: "sqs-queue-length"},
+						Target: v2beta2.MetricTarget{Type: v2beta2.AverageValueMetricType, AverageValue: &value},
+					},
+				},
+				{
+					Type: v2beta2.ResourceMetricSourceType,
+					Resource: &v2beta2.ResourceMetricSource{
+						Name:   v1.ResourceCPU,
+						Target: v2beta2.MetricTarget{Type: v2beta2.ValueMetricType, Value: &value},
+					},
+				},
+			},
+		},
+	}
+
+	annotations, errs := defaultAnnotationKeys.annotationsFromHorizontalPodAutoscaler(hpa)
+	if len(errs) != 3 {
+		t.Errorf("Errors expected: %v actual: %v", 3, errs)
+	}
+	if annotations["hpa.autoscaling.banzaicloud.io/minReplicas"] != "1" {
+		t.Errorf("Default minReplicas expected: %v actual: %v", "1", annotations["hpa.autoscaling.banzaicloud.io/minReplicas"])
+	}
+	if len(annotations) != 2 {
+		t.Errorf("Only replica annotations expected: %v", annotations)
+	}
+}
@@ -2,39 +2,177 @@ package stub
 
 import (
 	"context"
-	"github.com/sirupsen/logrus"
+	stderrors "errors"
+	"fmt"
 	"k8s.io/api/autoscaling/v2beta2"
-	"k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"regexp"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 )
 
-const hpaAnnotationPrefix = "hpa.autoscaling.banzaicloud.io"
-
 const cpuAnnotationPrefix = "cpu"
 const memoryAnnotationPrefix = "memory"
 const prometheusAnnotationPrefix = "prometheus"
 
 const targetAverageUtilization = "targetAverageUtilization"
 const targetAverageValue = "targetAverageValue"
+const targetValue = "targetValue"
 const annotationDomainSeparator = "/"
 const annotationSubDomainSeparator = "."
 
-const annotationRegExpString = "[a-zA-Z\\.]*hpa\\.autoscaling\\.banzaicloud\\.io\\/[a-zA-Z\\.]+"
+// kube-metrics-adapter reads the queries from the HPA annotations and serves them as external metrics
+const prometheusQueryMetricConfigAnnotation = "metric-config.external.prometheus-query.prometheus/"
+const prometheusQueryMetricName = "prometheus-query"
+const prometheusQueryNameLabel = "query-name"
 
-func NewHandler(client client.Client) *HPAHandler {
-	r, _ := regexp.Compile(annotationRegExpString)
-	return &HPAHandler{
-		annotationRegExp: r,
-		client:           client,
+// Options configure the annotations a handler reads and the HPAs it considers its own
+type Options struct {
+	// AnnotationPrefix is the domain of the autoscale annotations, DefaultAnnotationPrefix if empty
+	AnnotationPrefix string
+	// InstanceID is put into a label of the HPAs created by the handler. Operator instances with
+	// different IDs leave each other's HPAs alone, an empty ID only manages HPAs without the label.
+	// Instances running side by side need different IDs, even if their prefixes differ: otherwise
+	// one deletes the HPAs of the other, as it finds no autoscale annotations on the workloads.
+	InstanceID string
+	// RewriteDeprecatedAnnotations replaces the deprecated keys on the workloads by the keys of the
+	// current schema. The pod template is left alone, changing it would roll out the pods.
+	RewriteDeprecatedAnnotations bool
+	// Backend is the autoscaler backend of the workloads which don't select one by annotation,
+	// BackendHPA if empty
+	Backend string
+	// KEDAPrometheusAddress is the Prometheus server queried by the prometheus triggers of the
+	// KEDA ScaledObjects. The prometheus metrics are skipped by the KEDA backend if it's empty.
+	KEDAPrometheusAddress string
+	// MetricsAdapter serves the prometheus metrics of the HPAs, MetricsAdapterKube if empty
+	MetricsAdapter string
+	// PrometheusAdapterConfigMap is the namespace/name of the prometheus-adapter ConfigMap the
+	// rules are written into, required with MetricsAdapterPrometheus
+	PrometheusAdapterConfigMap string
+	// MetricPresets are added to the built-in metric presets by name, replacing the built-in
+	// preset of the same name
+	MetricPresets map[string]MetricPreset
+	// DryRun computes the changes of the handler without persisting them: they are logged, reported
+	// as events and metrics, and sent to the API server as server-side dry-run requests
+	DryRun bool
+}
+
+// Validate checks the annotation prefix, the instance ID, the backend, the metric presets and the metrics adapter
+func (o Options) Validate() error {
+	if _, err := o.annotationKeys(); err != nil {
+		return err
+	}
+	if _, err := o.backend(); err != nil {
+		return err
+	}
+	if _, _, err := o.metricPresets(); err != nil {
+		return err
+	}
+	_, err := o.prometheusAdapterConfigMap()
+	return err
+}
+
+// prometheusAdapterConfigMap returns the prometheus-adapter ConfigMap, nil unless the metrics
+// adapter is prometheus-adapter
+func (o Options) prometheusAdapterConfigMap() (*types.NamespacedName, error) {
+	switch o.MetricsAdapter {
+	case "", MetricsAdapterKube:
+		return nil, nil
+	case MetricsAdapterPrometheus:
+		return parseConfigMapName(o.PrometheusAdapterConfigMap)
+	}
+	return nil, fmt.Errorf("metrics adapter %q is invalid, it should be %s or %s", o.MetricsAdapter, MetricsAdapterKube, MetricsAdapterPrometheus)
+}
+
+func (o Options) backend() (string, error) {
+	switch o.Backend {
+	case "":
+		return BackendHPA, nil
+	case BackendHPA, BackendKEDA:
+		return o.Backend, nil
+	}
+	return "", fmt.Errorf("autoscaler backend %q is invalid, it should be %s or %s", o.Backend, BackendHPA, BackendKEDA)
+}
+
+func (o Options) annotationKeys() (*annotationKeys, error) {
+	prefix := o.AnnotationPrefix
+	if prefix == "" {
+		prefix = DefaultAnnotationPrefix
+	}
+	return newAnnotationKeys(prefix, o.InstanceID)
+}
+
+// NewHandler returns a handler which reports conflicting annotations through recorder, it may be nil.
+func NewHandler(client client.Client, recorder record.EventRecorder, options Options) (*HPAHandler, error) {
+	keys, err := options.annotationKeys()
+	if err != nil {
+		return nil, err
+	}
+	defaultBackend, err := options.backend()
+	if err != nil {
+		return nil, err
+	}
+	prometheusAdapterConfigMap, err := options.prometheusAdapterConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	presetTemplates, presets, err := options.metricPresets()
+	if err != nil {
+		return nil, err
+	}
+	var prometheusAdapterPrefix string
+	if prometheusAdapterConfigMap != nil {
+		prometheusAdapterPrefix = prometheusAdapterMetricNamePrefix(options.InstanceID)
 	}
+	if options.DryRun && client != nil {
+		client = dryRunClient{Client: client}
+	}
+	backends := map[string]autoscalerBackend{
+		BackendHPA:  hpaBackend{prometheusAdapterPrefix: prometheusAdapterPrefix},
+		BackendKEDA: kedaBackend{prometheusAddress: options.KEDAPrometheusAddress},
+	}
+	return &HPAHandler{
+		keys:                       keys,
+		instanceID:                 options.InstanceID,
+		rewriteDeprecated:          options.RewriteDeprecatedAnnotations,
+		backends:                   backends,
+		defaultBackend:             backends[defaultBackend],
+		prometheusAdapterConfigMap: prometheusAdapterConfigMap,
+		prometheusAdapterPrefix:    prometheusAdapterPrefix,
+		presets:                    presets,
+		presetTemplates:            presetTemplates,
+		dryRun:                     options.DryRun,
+		reconciles:                 newReconcileTracker(),
+		reload:                     &sync.RWMutex{},
+		recorder:                   recorder,
+		client:                     client,
+	}, nil
 }
 
 type HPAHandler struct {
-	annotationRegExp *regexp.Regexp
-	client           client.Client
+	keys              *annotationKeys
+	instanceID        string
+	rewriteDeprecated bool
+	backends          map[string]autoscalerBackend
+	defaultBackend    autoscalerBackend
+	// prometheusAdapterConfigMap is set if the prometheus metrics are served by prometheus-adapter
+	prometheusAdapterConfigMap *types.NamespacedName
+	prometheusAdapterPrefix    string
+	presets                    map[string]MetricPreset
+	presetTemplates            map[string]*template.Template
+	dryRun                     bool
+	// silent handlers report nothing while generating the HPAs, see quiet
+	silent     bool
+	reconciles *reconcileTracker
+	// reload guards the fields replaced by Reload, see snapshot
+	reload   *sync.RWMutex
+	client   client.Client
+	recorder record.EventRecorder
 }
 
 func (h *HPAHandler) HandleReplicaSet(
@@ -42,80 +180,220 @@ func (h *HPAHandler) HandleReplicaSet(
 	UID types.UID,
 	name string, namespace string,
 	kind string, apiVersion string,
-	annotations map[string]string, podAnnotations map[string]string) error {
-
-	logrus.Infof("handle  : %v", name)
-	hpaAnnotationsFound := false
-	hpaAnnotations := h.filterAutoscaleAnnotations(annotations)
-	if len(hpaAnnotations) > 0 {
-		hpaAnnotationsFound = true
-		logrus.Infof("Autoscale annotations found on %v", kind)
-	} else {
-		hpaAnnotations = h.filterAutoscaleAnnotations(podAnnotations)
-		if len(hpaAnnotations) > 0 {
-			hpaAnnotationsFound = true
-			logrus.Infof("Autoscale annotations found on Pod")
-		} else {
-			hpaAnnotationsFound = false
-			logrus.Infof("Autoscale annotations not found")
+	annotations map[string]string, podAnnotations map[string]string,
+	selector *metav1.LabelSelector) error {
+
+	h = h.snapshot()
+	log := LoggerFromContext(ctx)
+	log.V(1).Info("handle workload")
+	desired, shadow, deprecations, invalidErr := h.desiredHorizontalPodAutoscaler(ctx, UID, name, namespace, kind, apiVersion, annotations, podAnnotations, selector)
+
+	status, err := h.handleAutoscalers(ctx, name, namespace, kind, annotations, desired, invalidErr)
+	if statusErr := h.updateStatus(ctx, h.keys.status, name, namespace, kind, apiVersion, annotations, status); statusErr != nil && err == nil {
+		err = statusErr
+	}
+
+	shadowStatus, shadowErr := h.handleShadowAutoscaler(ctx, name, namespace, kind, annotations, shadow)
+	if shadowErr != nil && err == nil {
+		err = shadowErr
+	}
+	if statusErr := h.updateStatus(ctx, h.keys.shadowStatus, name, namespace, kind, apiVersion, annotations, shadowStatus); statusErr != nil && err == nil {
+		err = statusErr
+	}
+
+	vpaStatus, vpaErr := h.handleVerticalPodAutoscaler(ctx, UID, name, namespace, kind, apiVersion, annotations, podAnnotations, desired)
+	if vpaErr != nil && err == nil {
+		err = vpaErr
+	}
+	if statusErr := h.updateStatus(ctx, h.keys.vpaStatus, name, namespace, kind, apiVersion, annotations, vpaStatus); statusErr != nil && err == nil {
+		err = statusErr
+	}
+
+	pdbStatus, pdbErr := h.handlePodDisruptionBudget(ctx, UID, name, namespace, kind, apiVersion, annotations, podAnnotations, selector, desired)
+	if pdbErr != nil && err == nil {
+		err = pdbErr
+	}
+	if statusErr := h.updateStatus(ctx, h.keys.pdbStatus, name, namespace, kind, apiVersion, annotations, pdbStatus); statusErr != nil && err == nil {
+		err = statusErr
+	}
+
+	if h.rewriteDeprecated && len(deprecations) > 0 {
+		rewriteErr := h.rewriteDeprecatedAnnotations(ctx, UID, name, namespace, kind, apiVersion, annotations, deprecations)
+		if rewriteErr != nil && err == nil {
+			err = rewriteErr
 		}
 	}
+	autoscaled := len(h.filterAutoscaleAnnotations(annotations)) > 0 || len(h.filterAutoscaleAnnotations(podAnnotations)) > 0
+	h.reconciles.record(kind, namespace, name, autoscaled, err)
+	return err
+}
 
-	hpa := v2beta2.HorizontalPodAutoscaler{}
-	exists := true
-	namespacedName := client.ObjectKey{
-		Name:      name,
-		Namespace: namespace,
+// DesiredHorizontalPodAutoscaler generates the HPA of a workload from its autoscale annotations, without
+// talking to the API server. The annotations on the workload and on its pod template are merged as
+// selected by the merge strategy annotation of the workload, conflicting keys and deprecated keys are
+// reported as events. The queries are expanded as templates with the workload's name, namespace, kind
+// and pod selector, which may be nil. Both return values are nil if the workload has no autoscale annotations. The
+// error is an *InvalidAnnotationsError; if it's returned along with an HPA, the listed metrics were skipped.
+// The shadow metrics are left out of the HPA, the invalid ones are listed in the error too.
+func (h *HPAHandler) DesiredHorizontalPodAutoscaler(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, podAnnotations map[string]string,
+	selector *metav1.LabelSelector) (*v2beta2.HorizontalPodAutoscaler, error) {
+
+	h = h.snapshot()
+	hpa, shadow, _, err := h.desiredHorizontalPodAutoscaler(ctx, UID, name, namespace, kind, apiVersion, annotations, podAnnotations, selector)
+	if shadow != nil && shadow.invalidErr != nil {
+		errs := shadow.invalidErr.(*InvalidAnnotationsError).Errors
+		if invalidErr, ok := err.(*InvalidAnnotationsError); ok {
+			errs = append(invalidErr.Errors, errs...)
+		}
+		err = &InvalidAnnotationsError{Errors: errs}
 	}
-	if err := h.client.Get(ctx, namespacedName, &hpa); err != nil {
-		logrus.Infof("HorizontalPodAutoscaler doesn't exist %s", err.Error())
-		exists = false
+	return hpa, err
+}
+
+// desiredHorizontalPodAutoscaler is DesiredHorizontalPodAutoscaler, also returning the shadow HPA,
+// nil if the workload has no shadow metrics, and the deprecated keys found on the workload itself
+func (h *HPAHandler) desiredHorizontalPodAutoscaler(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, podAnnotations map[string]string,
+	selector *metav1.LabelSelector) (*v2beta2.HorizontalPodAutoscaler, *shadowAutoscaler, []deprecation, error) {
+
+	log := LoggerFromContext(ctx)
+	workloadAnnotations := h.filterAutoscaleAnnotations(annotations)
+	podTemplateAnnotations := h.filterAutoscaleAnnotations(podAnnotations)
+	if len(workloadAnnotations) == 0 && len(podTemplateAnnotations) == 0 {
+		log.V(1).Info("autoscale annotations not found")
+		return nil, nil, nil, nil
 	}
+	ref := &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name, Namespace: namespace, UID: UID}
 
-	if exists {
-		if !isCreatedByHpaController(&hpa, name, kind) {
-			logrus.Infof("HorizontalPodAutoscaler is not created by us")
-			return nil
+	schemaVersion := annotations[h.keys.schemaVersion]
+	workloadAnnotations, deprecations, schemaErrs := h.keys.translateDeprecatedAnnotations(schemaVersion, workloadAnnotations)
+	podTemplateAnnotations, podDeprecations, podSchemaErrs := h.keys.translateDeprecatedAnnotations(schemaVersion, podTemplateAnnotations)
+	if workloadAnnotations == nil || podTemplateAnnotations == nil {
+		// the schema version is invalid
+		return nil, nil, nil, &InvalidAnnotationsError{Errors: schemaErrs}
+	}
+	schemaErrs = append(schemaErrs, podSchemaErrs...)
+	h.reportDeprecations(ctx, ref, kind, deprecations)
+	h.reportDeprecations(ctx, ref, "pod template", podDeprecations)
+
+	strategy := annotations[h.keys.mergeStrategy]
+	log.V(1).Info("autoscale annotations found", "workload", len(workloadAnnotations),
+		"podTemplate", len(podTemplateAnnotations), "merge", strategy, "schema", schemaVersion)
+	hpaAnnotations, conflicts, err := h.keys.mergeAutoscaleAnnotations(strategy, workloadAnnotations, podTemplateAnnotations)
+	if err != nil {
+		return nil, nil, deprecations, &InvalidAnnotationsError{Errors: append(schemaErrs, err)}
+	}
+	h.reportConflicts(ctx, ref, strategy, conflicts)
+	data := newQueryTemplateData(name, namespace, kind, selector)
+	var shadowAnnotations map[string]string
+	if _, ok := hpaAnnotations[h.keys.field(specField)]; !ok {
+		// the spec annotation can't be combined with presets and shadow metrics, their keys are reported by applySpec
+		var presetErrs, shadowErrs []error
+		hpaAnnotations, presetErrs = h.expandPresets(hpaAnnotations, data)
+		hpaAnnotations, shadowAnnotations, shadowErrs = h.keys.splitShadowMetrics(hpaAnnotations)
+		schemaErrs = append(append(schemaErrs, presetErrs...), shadowErrs...)
+	}
+	hpa, err := h.keys.createHorizontalPodAutoscaler(ctx, UID, name, namespace, kind, apiVersion, hpaAnnotations, selector)
+	shadow := h.keys.createShadowHorizontalPodAutoscaler(hpa, shadowAnnotations, data)
+	if hpa != nil && h.instanceID != "" {
+		hpa.Labels = map[string]string{h.keys.instance: h.instanceID}
+	}
+	h.reportQueryWarnings(ctx, ref, hpa)
+	if len(schemaErrs) > 0 {
+		// the keys removed from the declared schema, the invalid presets and shadow flags are skipped like invalid metrics
+		if invalidErr, ok := err.(*InvalidAnnotationsError); ok {
+			schemaErrs = append(schemaErrs, invalidErr.Errors...)
 		}
+		return hpa, shadow, deprecations, &InvalidAnnotationsError{Errors: schemaErrs}
+	}
+	return hpa, shadow, deprecations, err
+}
 
-		if hpaAnnotationsFound {
-			logrus.Infof("HorizontalPodAutoscaler found, will be updated")
-			hpa := createHorizontalPodAutoscaler(UID, name, namespace, kind, apiVersion, hpaAnnotations)
-			if hpa == nil {
-				return nil
-			}
-			err := h.client.Update(ctx, hpa)
-			if err != nil && !errors.IsAlreadyExists(err) {
-				logrus.Errorf("Failed to update HPA: %v", err)
-				return err
-			}
-		} else {
-			logrus.Infof("HorizontalPodAutoscaler found, will be deleted")
-
-			err := h.client.Delete(ctx, &hpa)
-			if err != nil {
-				logrus.Errorf("Failed to delete HPA : %v", err)
-				return err
-			}
+// reportConflicts logs the keys of the workload or of its pod template ignored by strategy, and
+// reports them as an event
+func (h *HPAHandler) reportConflicts(ctx context.Context, ref *corev1.ObjectReference, strategy string, conflicts []string) {
+	if len(conflicts) == 0 || h.silent {
+		return
+	}
+	if strategy == "" || strategy == mergeNone {
+		LoggerFromContext(ctx).Info("ignored pod template autoscale annotations", "keys", conflicts)
+		if h.recorder != nil {
+			h.recorder.Eventf(ref, corev1.EventTypeWarning, "AnnotationConflict",
+				"Autoscale annotations are set on the %s and its pod template, the pod template values are ignored "+
+					"unless %s selects %s or %s: %s", ref.Kind, h.keys.mergeStrategy, mergeWorkload, mergePodTemplate,
+				strings.Join(conflicts, ", "))
 		}
+		return
+	}
+	used := ref.Kind
+	if strategy == mergePodTemplate {
+		used = "pod template"
+	}
+	LoggerFromContext(ctx).Info("conflicting autoscale annotations", "keys", conflicts, "used", used)
+	if h.recorder != nil {
+		h.recorder.Eventf(ref, corev1.EventTypeWarning, "AnnotationConflict",
+			"Autoscale annotations are set to different values on the %s and its pod template, the %s values are used: %s",
+			ref.Kind, used, strings.Join(conflicts, ", "))
+	}
+}
 
-	} else if hpaAnnotationsFound {
-		logrus.Infof("HorizontalPodAutoscaler doesn't exist will be created")
-		hpa := createHorizontalPodAutoscaler(UID, name, namespace, kind, apiVersion, hpaAnnotations)
-		if hpa == nil {
-			return nil
+// reportQueryWarnings logs the prometheus queries of hpa which may return more than one series,
+// and reports them as an event. The metrics adapters fail on such queries as soon as they do.
+func (h *HPAHandler) reportQueryWarnings(ctx context.Context, ref *corev1.ObjectReference, hpa *v2beta2.HorizontalPodAutoscaler) {
+	if hpa == nil || h.silent {
+		return
+	}
+	var queryNames []string
+	for key, query := range hpa.Annotations {
+		if !strings.HasPrefix(key, prometheusQueryMetricConfigAnnotation) {
+			continue
 		}
-		err := h.client.Create(ctx, hpa)
-		if err != nil && !errors.IsAlreadyExists(err) {
-			logrus.Errorf("Failed to create HPA : %v", err)
-			return err
+		if single, err := validatePromQL(query); err == nil && !single {
+			queryNames = append(queryNames, strings.TrimPrefix(key, prometheusQueryMetricConfigAnnotation))
 		}
 	}
-	return nil
+	if len(queryNames) == 0 {
+		return
+	}
+	sort.Strings(queryNames)
+	LoggerFromContext(ctx).Info("prometheus queries without top level aggregation", "metrics", queryNames)
+	if h.recorder != nil {
+		h.recorder.Eventf(ref, corev1.EventTypeWarning, "QueryNotAggregated",
+			"The queries of the custom metrics may return more than one series, they should be aggregated, e.g. by sum(...): %s",
+			strings.Join(queryNames, ", "))
+	}
 }
 
-func isCreatedByHpaController(hpa *v2beta2.HorizontalPodAutoscaler, name string, kind string) bool {
-	for _, ref := range hpa.OwnerReferences {
+// reportDeprecations logs the deprecated keys found on the workload or on its pod template, as
+// selected by source, and reports them as an event and in the deprecated annotations metric
+func (h *HPAHandler) reportDeprecations(ctx context.Context, ref *corev1.ObjectReference, source string, deprecations []deprecation) {
+	if len(deprecations) == 0 || h.silent {
+		return
+	}
+	keys := make([]string, 0, len(deprecations))
+	for _, deprecated := range deprecations {
+		deprecatedAnnotationsTotal.WithLabelValues(deprecated.name).Inc()
+		keys = append(keys, deprecated.String())
+	}
+	LoggerFromContext(ctx).Info("deprecated autoscale annotations", "keys", keys, "on", source)
+	if h.recorder != nil {
+		h.recorder.Eventf(ref, corev1.EventTypeWarning, "DeprecatedAnnotation",
+			"Deprecated autoscale annotations are used on the %s: %s", source, strings.Join(keys, ", "))
+	}
+}
+
+// isCreatedByHpaController checks whether the HPA or VPA obj is owned by the workload
+func isCreatedByHpaController(obj metav1.Object, name string, kind string) bool {
+	for _, ref := range obj.GetOwnerReferences() {
 		if ref.Name == name && ref.Kind == kind {
 			return true
 		}
@@ -126,50 +404,94 @@ func isCreatedByHpaController(hpa *v2beta2.HorizontalPodAutoscaler, name string,
 func (h *HPAHandler) filterAutoscaleAnnotations(annotations map[string]string) map[string]string {
 	autoscaleAnnotations := make(map[string]string)
 	for key, value := range annotations {
-		if h.annotationRegExp.MatchString(key) {
+		if h.keys.regExp.MatchString(key) && !h.keys.isPDBAnnotation(key) {
 			autoscaleAnnotations[key] = value
 		}
 	}
 	return autoscaleAnnotations
 }
 
-func createHorizontalPodAutoscaler(UID types.UID, name string, namespace string, kind string, apiVersion string, annotations map[string]string) *v2beta2.HorizontalPodAutoscaler {
+func (k *annotationKeys) createHorizontalPodAutoscaler(ctx context.Context, UID types.UID, name string, namespace string, kind string, apiVersion string,
+	annotations map[string]string, selector *metav1.LabelSelector) (*v2beta2.HorizontalPodAutoscaler, error) {
+
+	log := LoggerFromContext(ctx)
+	hpa := newHorizontalPodAutoscaler(UID, name, namespace, kind, apiVersion)
+	data := newQueryTemplateData(name, namespace, kind, selector)
 
-	minReplicas, err := extractAnnotationIntValue(annotations, hpaAnnotationPrefix+annotationDomainSeparator+"minReplicas", name)
+	if spec, ok := annotations[k.field(specField)]; ok {
+		if errs := k.applySpec(hpa, spec, annotations, data); len(errs) > 0 {
+			return nil, &InvalidAnnotationsError{Errors: errs}
+		}
+		log.V(1).Info("spec parsed", "count", len(hpa.Spec.Metrics))
+		return hpa, nil
+	}
+
+	var errs []error
+
+	minReplicas, err := extractAnnotationIntValue(annotations, k.field("minReplicas"), name)
 	if err != nil {
-		logrus.Errorf("Invalid annotation: %v", err.Error())
-		return nil
+		errs = append(errs, err)
 	}
 
-	maxReplicas, err := extractAnnotationIntValue(annotations, hpaAnnotationPrefix+annotationDomainSeparator+"maxReplicas", name)
+	maxReplicas, err := extractAnnotationIntValue(annotations, k.field("maxReplicas"), name)
 	if err != nil {
-		logrus.Errorf("Invalid annotation: %v", err.Error())
-		return nil
+		errs = append(errs, err)
 	}
+	if len(errs) == 0 && minReplicas > maxReplicas {
+		errs = append(errs, stderrors.New("minReplicas should not be greater than maxReplicas for deployment "+name))
+	}
+	replicasValid := len(errs) == 0
+	hpa.Spec.MinReplicas = &minReplicas
+	hpa.Spec.MaxReplicas = maxReplicas
+
+	metrics, metricErrs := k.parseMetrics(hpa, annotations, data)
+	log.V(1).Info("metrics parsed", "count", len(metrics), "invalid", len(metricErrs))
+	errs = append(errs, metricErrs...)
+	if len(metrics) == 0 {
+		errs = append(errs, stderrors.New("no valid metrics configured for "+name))
+	}
+	if !replicasValid || len(metrics) == 0 {
+		return nil, &InvalidAnnotationsError{Errors: errs}
+	}
+
+	hpa.Spec.Metrics = metrics
+
+	if len(errs) > 0 {
+		return hpa, &InvalidAnnotationsError{Errors: errs}
+	}
+	return hpa, nil
+}
+
+// newOwnerReferences returns the owner references of the objects created for a workload, which is
+// their controller and blocks their deletion
+func newOwnerReferences(UID types.UID, name string, kind string, apiVersion string) []metav1.OwnerReference {
 
 	blockOwnerDeletion := true
 	isController := true
 
-	ref := metav1.OwnerReference{
-		APIVersion:         apiVersion,
-		Kind:               kind,
-		Name:               name,
-		UID:                UID,
-		BlockOwnerDeletion: &blockOwnerDeletion,
-		Controller:         &isController,
+	return []metav1.OwnerReference{
+		{
+			APIVersion:         apiVersion,
+			Kind:               kind,
+			Name:               name,
+			UID:                UID,
+			BlockOwnerDeletion: &blockOwnerDeletion,
+			Controller:         &isController,
+		},
 	}
+}
 
-	hpa := &v2beta2.HorizontalPodAutoscaler{
+// newHorizontalPodAutoscaler returns an HPA scaling the workload, owned by it, without replicas and metrics
+func newHorizontalPodAutoscaler(UID types.UID, name string, namespace string, kind string, apiVersion string) *v2beta2.HorizontalPodAutoscaler {
+	return &v2beta2.HorizontalPodAutoscaler{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "HorizontalPodAutoscaler",
 			APIVersion: "autoscaling/v2beta2",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-			OwnerReferences: []metav1.OwnerReference{
-				ref,
-			},
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: newOwnerReferences(UID, name, kind, apiVersion),
 		},
 		Spec: v2beta2.HorizontalPodAutoscalerSpec{
 			ScaleTargetRef: v2beta2.CrossVersionObjectReference{
@@ -177,19 +499,19 @@ func createHorizontalPodAutoscaler(UID types.UID, name string, namespace string,
 				Kind:       kind,
 				Name:       name,
 			},
-			MinReplicas: &minReplicas,
-			MaxReplicas: maxReplicas,
 		},
 	}
+}
 
-	metrics := parseMetrics(hpa, annotations, name)
-	logrus.Info("number of metrics: ", len(metrics))
-	if len(metrics) == 0 {
-		logrus.Error("No metrics configured")
-		return nil
-	}
-
-	hpa.Spec.Metrics = metrics
+// InvalidAnnotationsError lists the autoscale annotations of a workload which couldn't be turned into an HPA.
+type InvalidAnnotationsError struct {
+	Errors []error
+}
 
-	return hpa
+func (e *InvalidAnnotationsError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
 }
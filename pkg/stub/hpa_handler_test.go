@@ -1,11 +1,18 @@
 package stub
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/google/uuid"
-	"k8s.io/api/autoscaling/v2beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/autoscaling/v2beta2"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"testing"
 )
 
@@ -14,7 +21,7 @@ func TestCreateHPAWithResourceMetrics(t *testing.T) {
 	annotations := map[string]string{
 		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
 		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
-		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80%",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
 		"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "1024Mi",
 	}
 
@@ -23,27 +30,68 @@ func TestCreateHPAWithResourceMetrics(t *testing.T) {
 		t.Error("Error can not generate UUID!")
 		return
 	}
-	hpa := createHorizontalPodAutoscaler(types.UID(uuid.String()), "test", "default",
-		"Deployment", "apps/v1", annotations)
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), types.UID(uuid.String()), "test", "default",
+		"Deployment", "apps/v1", annotations, nil)
 
-	if hpa == nil {
-		t.Error("Error hpa is not created!")
+	if err != nil {
+		t.Errorf("Error hpa is not created: %v", err)
 		return
 	}
 
-	if len(hpa.Spec.Metrics) == 0 {
-		t.Error("Error no metrics found!")
+	if len(hpa.Spec.Metrics) != 2 {
+		t.Errorf("Error metrics expected: %v actual: %v", 2, len(hpa.Spec.Metrics))
 		return
 	}
 
+	expectedTargetTypes := map[v1.ResourceName]v2beta2.MetricTargetType{
+		v1.ResourceCPU:    v2beta2.UtilizationMetricType,
+		v1.ResourceMemory: v2beta2.AverageValueMetricType,
+	}
 	for _, metric := range hpa.Spec.Metrics {
 		if metric.Type != v2beta2.ResourceMetricSourceType {
-			t.Errorf("Metric type expected: %v actual: %v", v2beta1.ResourceMetricSourceType, metric.Type)
+			t.Errorf("Metric type expected: %v actual: %v", v2beta2.ResourceMetricSourceType, metric.Type)
+			continue
+		}
+		expected, ok := expectedTargetTypes[metric.Resource.Name]
+		if !ok {
+			t.Errorf("Unexpected metric name: %v", metric.Resource.Name)
+			continue
 		}
-		if metric.Resource.Name != v1.ResourceMemory {
-			t.Errorf("Metric name expected: %v actual: %v", v1.ResourceMemory, metric.Resource.Name)
+		delete(expectedTargetTypes, metric.Resource.Name)
+		if metric.Resource.Target.Type != expected {
+			t.Errorf("Metric %v target type expected: %v actual: %v", metric.Resource.Name, expected, metric.Resource.Target.Type)
 		}
 	}
+	if len(expectedTargetTypes) > 0 {
+		t.Errorf("Metrics missing: %v", expectedTargetTypes)
+	}
+
+}
+
+func TestCreateHPASkipsInvalidMetrics(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80%",
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "1024Mi",
+	}
+
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default",
+		"Deployment", "apps/v1", annotations, nil)
+
+	if hpa == nil {
+		t.Errorf("Error hpa is not created: %v", err)
+		return
+	}
+
+	if err == nil {
+		t.Error("Error invalid cpu annotation is not reported!")
+	}
+
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Resource.Name != v1.ResourceMemory {
+		t.Errorf("Metrics expected: %v actual: %v", v1.ResourceMemory, hpa.Spec.Metrics)
+	}
 
 }
 
@@ -52,7 +100,7 @@ func TestCreateHPAWithExternalPrometheusMetrics(t *testing.T) {
 	annotations := map[string]string{
 		"hpa.autoscaling.banzaicloud.io/minReplicas":                                "1",
 		"hpa.autoscaling.banzaicloud.io/maxReplicas":                                "3",
-		"prometheus.customMetric.hpa.autoscaling.banzaicloud.io/query":              "{prometheusQuery}",
+		"prometheus.customMetric.hpa.autoscaling.banzaicloud.io/query":              "sum(container_memory_usage_bytes{pod=~\"^test.*\"})",
 		"prometheus.customMetric.hpa.autoscaling.banzaicloud.io/targetAverageValue": "1024Mi",
 	}
 
@@ -61,14 +109,18 @@ func TestCreateHPAWithExternalPrometheusMetrics(t *testing.T) {
 		t.Error("Error can not generate UUID!")
 		return
 	}
-	hpa := createHorizontalPodAutoscaler(types.UID(uuid.String()), "test", "default",
-		"Deployment", "apps/v1", annotations)
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), types.UID(uuid.String()), "test", "default",
+		"Deployment", "apps/v1", annotations, nil)
 
 	if hpa == nil {
-		t.Error("Error hpa is not created!")
+		t.Errorf("Error hpa is not created: %v", err)
 		return
 	}
 
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
 	if len(hpa.Spec.Metrics) == 0 {
 		t.Error("Error no metrics found!")
 		return
@@ -80,7 +132,7 @@ func TestCreateHPAWithExternalPrometheusMetrics(t *testing.T) {
 
 	for _, metric := range hpa.Spec.Metrics {
 		if metric.Type != v2beta2.ExternalMetricSourceType {
-			t.Errorf("Metric type expected: %v actual: %v", v2beta1.PodsMetricSourceType, metric.Type)
+			t.Errorf("Metric type expected: %v actual: %v", v2beta2.ExternalMetricSourceType, metric.Type)
 		}
 		if metric.External == nil {
 			t.Errorf("External metric missing")
@@ -91,3 +143,109 @@ func TestCreateHPAWithExternalPrometheusMetrics(t *testing.T) {
 	}
 
 }
+
+func TestHandleReplicaSetOperatorInstances(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+	}
+	isController := true
+	owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "test", UID: "uid", Controller: &isController}
+
+	tests := []struct {
+		name             string
+		options          Options
+		hpaLabels        map[string]string
+		expectedPhase    string
+		expectedMax      int32
+		expectedInstance string
+	}{
+		{
+			name:          "HPA without instance label is managed by the default instance",
+			options:       Options{},
+			expectedPhase: phaseActive,
+			expectedMax:   3,
+		},
+		{
+			name:          "HPA of another instance is left alone",
+			options:       Options{},
+			hpaLabels:     map[string]string{"autoscaling.banzaicloud.io/instance": "canary"},
+			expectedPhase: phaseConflict,
+			expectedMax:   10,
+		},
+		{
+			name:             "HPA of the instance is updated",
+			options:          Options{InstanceID: "canary"},
+			hpaLabels:        map[string]string{"autoscaling.banzaicloud.io/instance": "canary"},
+			expectedPhase:    phaseActive,
+			expectedMax:      3,
+			expectedInstance: "canary",
+		},
+		{
+			name:          "annotations of another prefix are ignored",
+			options:       Options{AnnotationPrefix: "hpa.example.com", InstanceID: "canary"},
+			expectedPhase: "",
+			expectedMax:   10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: annotations},
+			}
+			minReplicas := int32(1)
+			hpa := &v2beta2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "test",
+					Namespace:       "default",
+					Labels:          test.hpaLabels,
+					OwnerReferences: []metav1.OwnerReference{owner},
+				},
+				Spec: v2beta2.HorizontalPodAutoscalerSpec{MinReplicas: &minReplicas, MaxReplicas: 10},
+			}
+			c := fake.NewFakeClientWithScheme(scheme, deployment, hpa)
+			handler, err := NewHandler(c, nil, test.options)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			actualDeployment := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actualDeployment); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var status workloadStatus
+			if value, ok := actualDeployment.Annotations[handler.keys.status]; ok {
+				if err := json.Unmarshal([]byte(value), &status); err != nil {
+					t.Fatalf("Status annotation is invalid: %v", err)
+				}
+			}
+			if status.Phase != test.expectedPhase {
+				t.Errorf("Phase expected: %v actual: %v", test.expectedPhase, status.Phase)
+			}
+
+			actualHPA := &v2beta2.HorizontalPodAutoscaler{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actualHPA); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actualHPA.Spec.MaxReplicas != test.expectedMax {
+				t.Errorf("maxReplicas expected: %v actual: %v", test.expectedMax, actualHPA.Spec.MaxReplicas)
+			}
+			if test.expectedInstance != "" && actualHPA.Labels["autoscaling.banzaicloud.io/instance"] != test.expectedInstance {
+				t.Errorf("Instance label expected: %v actual: %v", test.expectedInstance, actualHPA.Labels)
+			}
+		})
+	}
+}
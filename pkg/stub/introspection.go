@@ -0,0 +1,222 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// kedaHPAPrefix prefixes the name of the HPAs KEDA creates from the ScaledObjects
+const kedaHPAPrefix = "keda-hpa-"
+
+// redactedValue replaces the credentials of the collectors in the introspection API, which is
+// served without authentication
+const redactedValue = "<redacted>"
+
+// WorkloadState is the autoscaling state of a workload, as served by the introspection API
+type WorkloadState struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	// Phase is the phase of the status annotation, empty until the workload is reconciled
+	Phase  string         `json:"phase,omitempty"`
+	Config WorkloadConfig `json:"config"`
+	// HPA is generated from the autoscale annotations, it's nil if they are invalid
+	HPA *v2beta2.HorizontalPodAutoscaler `json:"hpa,omitempty"`
+	// CurrentReplicas and DesiredReplicas are read from the status of the live HPA
+	CurrentReplicas *int32 `json:"currentReplicas,omitempty"`
+	DesiredReplicas *int32 `json:"desiredReplicas,omitempty"`
+	// LastReconcile is only known by the operator instance which reconciled the workload
+	LastReconcile *metav1.Time `json:"lastReconcile,omitempty"`
+	// LastError is the error of the last reconcile, or the error of the status annotation
+	LastError string `json:"lastError,omitempty"`
+	// Drift lists the fields of the live autoscaler which differ from the generated one
+	Drift []string `json:"drift,omitempty"`
+}
+
+// WorkloadConfig is the autoscaling configuration read from the annotations of a workload
+type WorkloadConfig struct {
+	Backend                string            `json:"backend,omitempty"`
+	Annotations            map[string]string `json:"annotations,omitempty"`
+	PodTemplateAnnotations map[string]string `json:"podTemplateAnnotations,omitempty"`
+	// Errors lists the invalid annotations, the metrics they declare are skipped
+	Errors []string `json:"errors,omitempty"`
+}
+
+// quiet returns a copy of the handler which generates the HPAs without reporting the conflicting,
+// deprecated or invalid annotations, it's used to introspect the workloads
+func (h *HPAHandler) quiet() *HPAHandler {
+	quiet := *h
+	quiet.silent = true
+	quiet.recorder = nil
+	return &quiet
+}
+
+// WorkloadState returns the autoscaling state of a workload, read from its annotations and from the
+// live autoscaler, without writing anything. It returns nil if the workload has neither autoscale
+// annotations nor a status annotation.
+func (h *HPAHandler) WorkloadState(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, podAnnotations map[string]string,
+	selector *metav1.LabelSelector) (*WorkloadState, error) {
+
+	h = h.snapshot()
+	workloadAnnotations := h.filterAutoscaleAnnotations(annotations)
+	podTemplateAnnotations := h.filterAutoscaleAnnotations(podAnnotations)
+	statusAnnotation, statusFound := annotations[h.keys.status]
+	if len(workloadAnnotations) == 0 && len(podTemplateAnnotations) == 0 && !statusFound {
+		return nil, nil
+	}
+	state := &WorkloadState{
+		Namespace: namespace,
+		Name:      name,
+		Kind:      kind,
+		Config: WorkloadConfig{
+			Annotations:            h.keys.redactSensitiveFields(workloadAnnotations),
+			PodTemplateAnnotations: h.keys.redactSensitiveFields(podTemplateAnnotations),
+		},
+	}
+	if statusFound {
+		var status workloadStatus
+		if err := json.Unmarshal([]byte(statusAnnotation), &status); err == nil {
+			state.Phase = status.Phase
+			state.LastError = status.Error
+		}
+	}
+	if result, ok := h.reconciles.get(kind, namespace, name); ok {
+		state.LastReconcile = &metav1.Time{Time: result.time}
+		if result.err != nil {
+			state.LastError = result.err.Error()
+		}
+	}
+
+	backend, err := h.backend(annotations)
+	if err != nil {
+		state.Config.Errors = []string{err.Error()}
+		return state, nil
+	}
+	state.Config.Backend = BackendHPA
+	if _, ok := backend.(kedaBackend); ok {
+		state.Config.Backend = BackendKEDA
+	}
+	hpa, invalidErr := h.quiet().DesiredHorizontalPodAutoscaler(ctx, UID, name, namespace, kind, apiVersion, annotations, podAnnotations, selector)
+	if invalidErr != nil {
+		if invalid, ok := invalidErr.(*InvalidAnnotationsError); ok {
+			for _, err := range invalid.Errors {
+				state.Config.Errors = append(state.Config.Errors, err.Error())
+			}
+		} else {
+			state.Config.Errors = []string{invalidErr.Error()}
+		}
+	}
+	state.HPA = hpa
+	if err := h.readLiveAutoscaler(ctx, backend, name, namespace, state); err != nil {
+		return nil, err
+	}
+	state.redactSensitiveHPAAnnotations()
+	return state, nil
+}
+
+// redactSensitiveFields returns a copy of the autoscale annotations with the values of the
+// sensitive collector fields replaced by redactedValue
+func (k *annotationKeys) redactSensitiveFields(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return annotations
+	}
+	redacted := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		redacted[key] = value
+		parts := strings.Split(key, annotationDomainSeparator)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], annotationSubDomainSeparator+k.prefix) {
+			continue
+		}
+		// <collector>.<metricName>.<prefix>/<field>
+		names := strings.SplitN(strings.TrimSuffix(parts[0], annotationSubDomainSeparator+k.prefix), annotationSubDomainSeparator, 2)
+		collector, ok := collectors[names[0]]
+		if len(names) != 2 || !ok {
+			continue
+		}
+		fields, _ := collector.sensitiveFields()
+		for _, field := range fields {
+			if parts[1] == field {
+				redacted[key] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// redactSensitiveHPAAnnotations replaces the values of the HPA annotations the sensitive collector
+// fields are copied to by redactedValue, in the generated HPA and in the drift from the live one
+func (s *WorkloadState) redactSensitiveHPAAnnotations() {
+	var sensitive []string
+	for _, name := range collectorNames() {
+		_, hpaAnnotations := collectors[name].sensitiveFields()
+		sensitive = append(sensitive, hpaAnnotations...)
+	}
+	if s.HPA != nil {
+		s.HPA = s.HPA.DeepCopy()
+		for _, key := range sensitive {
+			if _, ok := s.HPA.Annotations[key]; ok {
+				s.HPA.Annotations[key] = redactedValue
+			}
+		}
+	}
+	for i, change := range s.Drift {
+		for _, key := range sensitive {
+			if path := "metadata.annotations." + key; strings.HasPrefix(change, path+": ") {
+				s.Drift[i] = path + ": " + redactedValue
+			}
+		}
+	}
+}
+
+// readLiveAutoscaler sets the replicas of state from the live HPA of the workload, and its drift
+// from the difference of the live autoscaler of backend and the generated one
+func (h *HPAHandler) readLiveAutoscaler(ctx context.Context, backend autoscalerBackend, name string, namespace string, state *WorkloadState) error {
+	hpaName := name
+	if _, ok := backend.(kedaBackend); ok {
+		hpaName = kedaHPAPrefix + name
+	}
+	liveHPA := &v2beta2.HorizontalPodAutoscaler{}
+	if err := h.client.Get(ctx, client.ObjectKey{Name: hpaName, Namespace: namespace}, liveHPA); err == nil {
+		state.CurrentReplicas = &liveHPA.Status.CurrentReplicas
+		state.DesiredReplicas = &liveHPA.Status.DesiredReplicas
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	if state.HPA == nil {
+		return nil
+	}
+	desired, _ := backend.fromHorizontalPodAutoscaler(state.HPA.DeepCopy())
+	if desired == nil {
+		return nil
+	}
+	objectName := backend.objectName(name)
+	current := backend.newObject()
+	if err := h.client.Get(ctx, client.ObjectKey{Name: objectName, Namespace: namespace}, current); err != nil {
+		if !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+			return err
+		}
+		state.Drift = []string{fmt.Sprintf("%s %s doesn't exist", backend.kind(), objectName)}
+		return nil
+	}
+	changes, err := objectChanges(current, desired)
+	if err != nil {
+		return err
+	}
+	state.Drift = changes
+	return nil
+}
@@ -0,0 +1,93 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestWorkloadStateRedactsSensitiveFields(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                   "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                   "3",
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/query":       `from(bucket: "requests")`,
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/address":     "http://influxdb:8086",
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/token":       "new-secret",
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/org":         "acme",
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+		"prometheus.token.hpa.autoscaling.banzaicloud.io/query":        "sum(tokens)",
+		"prometheus.token.hpa.autoscaling.banzaicloud.io/targetValue":  "10",
+	}
+	podAnnotations := map[string]string{
+		"influxdb.requests.hpa.autoscaling.banzaicloud.io/token": "pod-secret",
+	}
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	handler, err := NewHandler(nil, nil, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	live, err := handler.DesiredHorizontalPodAutoscaler(context.Background(), "uid", "test", "default",
+		"Deployment", "apps/v1", annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	live.Annotations[influxDBMetricConfigAnnotation+"token"] = "old-secret"
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: annotations},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployment, live)
+	handler, err = NewHandler(c, nil, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	state, err := handler.WorkloadState(context.Background(), deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", annotations, podAnnotations, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, secret := range []string{"new-secret", "old-secret", "pod-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Token %s expected to be redacted: %s", secret, data)
+		}
+	}
+	if value := state.Config.Annotations["influxdb.requests.hpa.autoscaling.banzaicloud.io/token"]; value != redactedValue {
+		t.Errorf("Workload token expected: %v actual: %v", redactedValue, value)
+	}
+	if value := state.Config.PodTemplateAnnotations["influxdb.requests.hpa.autoscaling.banzaicloud.io/token"]; value != redactedValue {
+		t.Errorf("Pod template token expected: %v actual: %v", redactedValue, value)
+	}
+	if value := state.HPA.Annotations[influxDBMetricConfigAnnotation+"token"]; value != redactedValue {
+		t.Errorf("HPA token expected: %v actual: %v", redactedValue, value)
+	}
+	expectedDrift := "metadata.annotations." + influxDBMetricConfigAnnotation + "token: " + redactedValue
+	if len(state.Drift) != 1 || state.Drift[0] != expectedDrift {
+		t.Errorf("Drift expected: %v actual: %v", expectedDrift, state.Drift)
+	}
+
+	// the other fields are served as they are
+	if value := state.Config.Annotations["influxdb.requests.hpa.autoscaling.banzaicloud.io/org"]; value != "acme" {
+		t.Errorf("Org expected: %v actual: %v", "acme", value)
+	}
+	if value := state.Config.Annotations["prometheus.token.hpa.autoscaling.banzaicloud.io/query"]; value != "sum(tokens)" {
+		t.Errorf("Query of the token metric expected: %v actual: %v", "sum(tokens)", value)
+	}
+	if value := annotations["influxdb.requests.hpa.autoscaling.banzaicloud.io/token"]; value != "new-secret" {
+		t.Errorf("Workload annotations expected to be left alone, token: %v", value)
+	}
+}
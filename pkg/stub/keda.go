@@ -0,0 +1,149 @@
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// scaledObjectGroupVersionKind is the kind of the generated KEDA ScaledObjects. Like the VPAs, they
+// are written as unstructured objects, the operator runs on clusters without the KEDA CRDs.
+var scaledObjectGroupVersionKind = schema.GroupVersionKind{Group: "keda.sh", Version: "v1alpha1", Kind: "ScaledObject"}
+
+// The KEDA trigger types the metrics are mapped to
+const (
+	kedaCPUTrigger        = "cpu"
+	kedaMemoryTrigger     = "memory"
+	kedaPrometheusTrigger = "prometheus"
+)
+
+type scaledObjectSpec struct {
+	ScaleTargetRef  v2beta2.CrossVersionObjectReference `json:"scaleTargetRef"`
+	MinReplicaCount *int32                              `json:"minReplicaCount,omitempty"`
+	MaxReplicaCount int32                               `json:"maxReplicaCount"`
+	Triggers        []scaledObjectTrigger               `json:"triggers"`
+}
+
+type scaledObjectTrigger struct {
+	Type       string                   `json:"type"`
+	MetricType v2beta2.MetricTargetType `json:"metricType,omitempty"`
+	Metadata   map[string]string        `json:"metadata"`
+}
+
+// kedaBackend writes a KEDA ScaledObject in place of the HPA, KEDA creates the HPA from it. The cpu
+// and memory metrics are mapped to the cpu and memory triggers, the prometheus metrics to prometheus
+// triggers querying prometheusAddress. Other metrics are skipped.
+type kedaBackend struct {
+	prometheusAddress string
+}
+
+func (kedaBackend) kind() string {
+	return scaledObjectGroupVersionKind.Kind
+}
+
+func (kedaBackend) objectName(workloadName string) string {
+	return workloadName
+}
+
+func (kedaBackend) newObject() runtime.Object {
+	scaledObject := &unstructured.Unstructured{}
+	scaledObject.SetGroupVersionKind(scaledObjectGroupVersionKind)
+	return scaledObject
+}
+
+func (b kedaBackend) fromHorizontalPodAutoscaler(hpa *v2beta2.HorizontalPodAutoscaler) (runtime.Object, []error) {
+	spec := scaledObjectSpec{
+		ScaleTargetRef:  hpa.Spec.ScaleTargetRef,
+		MinReplicaCount: hpa.Spec.MinReplicas,
+		MaxReplicaCount: hpa.Spec.MaxReplicas,
+	}
+	var errs []error
+	for _, metric := range hpa.Spec.Metrics {
+		trigger, err := b.trigger(hpa, metric)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		spec.Triggers = append(spec.Triggers, *trigger)
+	}
+	if len(spec.Triggers) == 0 {
+		return nil, append(errs, fmt.Errorf("no metrics supported by KEDA configured for %s", hpa.Name))
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	unstructuredSpec := make(map[string]interface{})
+	if err := json.Unmarshal(data, &unstructuredSpec); err != nil {
+		return nil, append(errs, err)
+	}
+	scaledObject := &unstructured.Unstructured{Object: map[string]interface{}{"spec": unstructuredSpec}}
+	scaledObject.SetGroupVersionKind(scaledObjectGroupVersionKind)
+	scaledObject.SetName(hpa.Name)
+	scaledObject.SetNamespace(hpa.Namespace)
+	scaledObject.SetLabels(hpa.Labels)
+	scaledObject.SetOwnerReferences(hpa.OwnerReferences)
+	return scaledObject, errs
+}
+
+// trigger maps metric of hpa to a KEDA trigger
+func (b kedaBackend) trigger(hpa *v2beta2.HorizontalPodAutoscaler, metric v2beta2.MetricSpec) (*scaledObjectTrigger, error) {
+	name, target := metricNameAndTarget(metric)
+	switch {
+	case metric.Resource != nil && (metric.Resource.Name == corev1.ResourceCPU || metric.Resource.Name == corev1.ResourceMemory):
+		trigger := &scaledObjectTrigger{Type: kedaCPUTrigger, MetricType: target.Type}
+		if metric.Resource.Name == corev1.ResourceMemory {
+			trigger.Type = kedaMemoryTrigger
+		}
+		switch {
+		case target.AverageUtilization != nil:
+			trigger.Metadata = map[string]string{"value": strconv.Itoa(int(*target.AverageUtilization))}
+		case target.AverageValue != nil:
+			trigger.Metadata = map[string]string{"value": target.AverageValue.String()}
+		default:
+			return nil, fmt.Errorf("%s metric target %s is not supported by KEDA", name, target.Type)
+		}
+		return trigger, nil
+
+	case metric.External != nil && metric.External.Metric.Name == prometheusQueryMetricName && metric.External.Metric.Selector != nil:
+		queryName := metric.External.Metric.Selector.MatchLabels[prometheusQueryNameLabel]
+		query, ok := hpa.Annotations[prometheusQueryMetricConfigAnnotation+queryName]
+		if !ok {
+			return nil, fmt.Errorf("query is missing for custom metric: %s", queryName)
+		}
+		if b.prometheusAddress == "" {
+			return nil, fmt.Errorf("prometheus metric %s is not supported by KEDA: the Prometheus server address is not configured", queryName)
+		}
+		var threshold resource.Quantity
+		switch {
+		case target.Value != nil:
+			threshold = target.Value.DeepCopy()
+		case target.AverageValue != nil:
+			threshold = target.AverageValue.DeepCopy()
+		default:
+			return nil, fmt.Errorf("prometheus metric %s target %s is not supported by KEDA", queryName, target.Type)
+		}
+		return &scaledObjectTrigger{
+			Type:       kedaPrometheusTrigger,
+			MetricType: target.Type,
+			Metadata: map[string]string{
+				"serverAddress": b.prometheusAddress,
+				"query":         query,
+				"threshold":     threshold.AsDec().String(),
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("%s metric %s is not supported by KEDA", metric.Type, name)
+}
+
+func (kedaBackend) statusName(status *workloadStatus) *string {
+	return &status.ScaledObject
+}
@@ -0,0 +1,273 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestScaledObjectFromHorizontalPodAutoscaler(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		prometheusAddress string
+		annotations       map[string]string
+		expectedSpec      string
+		expectedErr       []string
+	}{
+		{
+			name: "resource metrics",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+				"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "1Gi",
+			},
+			expectedSpec: `{"maxReplicaCount":3,"minReplicaCount":1,` +
+				`"scaleTargetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"triggers":[` +
+				`{"metadata":{"value":"80"},"metricType":"Utilization","type":"cpu"},` +
+				`{"metadata":{"value":"1Gi"},"metricType":"AverageValue","type":"memory"}]}`,
+		},
+		{
+			name:              "prometheus metrics",
+			prometheusAddress: "http://prometheus:9090",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(rate(requests[1m]))",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "500m",
+				"prometheus.queue.hpa.autoscaling.banzaicloud.io/query":                 "sum(queue)",
+				"prometheus.queue.hpa.autoscaling.banzaicloud.io/targetValue":           "100",
+			},
+			expectedSpec: `{"maxReplicaCount":3,"minReplicaCount":1,` +
+				`"scaleTargetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"triggers":[` +
+				`{"metadata":{"query":"sum(queue)","serverAddress":"http://prometheus:9090","threshold":"100"},"metricType":"Value","type":"prometheus"},` +
+				`{"metadata":{"query":"sum(rate(requests[1m]))","serverAddress":"http://prometheus:9090","threshold":"0.500"},"metricType":"AverageValue","type":"prometheus"}]}`,
+		},
+		{
+			name: "unsupported metrics are skipped",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                          "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                          "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":         "80",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/jsonKey":            "$.requests",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/port":               "9090",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+				"prometheus.queue.hpa.autoscaling.banzaicloud.io/query":               "sum(queue)",
+				"prometheus.queue.hpa.autoscaling.banzaicloud.io/targetValue":         "100",
+			},
+			expectedSpec: `{"maxReplicaCount":3,"minReplicaCount":1,` +
+				`"scaleTargetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"triggers":[` +
+				`{"metadata":{"value":"80"},"metricType":"Utilization","type":"cpu"}]}`,
+			expectedErr: []string{
+				"Pods metric requests is not supported by KEDA",
+				"prometheus metric queue is not supported by KEDA: the Prometheus server address is not configured",
+			},
+		},
+		{
+			name: "no supported metrics",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                          "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                          "3",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/jsonKey":            "$.requests",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/port":               "9090",
+				"jsonpath.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+			},
+			expectedErr: []string{
+				"Pods metric requests is not supported by KEDA",
+				"no metrics supported by KEDA configured for test",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "uid", "test", "default", "Deployment", "apps/v1", test.annotations, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			obj, errs := kedaBackend{prometheusAddress: test.prometheusAddress}.fromHorizontalPodAutoscaler(hpa)
+			if len(errs) != len(test.expectedErr) {
+				t.Errorf("Errors expected: %v actual: %v", test.expectedErr, errs)
+			}
+			for i := 0; i < len(errs) && i < len(test.expectedErr); i++ {
+				if !strings.Contains(errs[i].Error(), test.expectedErr[i]) {
+					t.Errorf("Error expected: %v actual: %v", test.expectedErr[i], errs[i])
+				}
+			}
+			if test.expectedSpec == "" {
+				if obj != nil {
+					t.Errorf("ScaledObject should not be generated: %v", obj)
+				}
+				return
+			}
+			scaledObject := obj.(*unstructured.Unstructured)
+			if scaledObject.GetAPIVersion() != "keda.sh/v1alpha1" || scaledObject.GetKind() != "ScaledObject" {
+				t.Errorf("ScaledObject kind expected: %v actual: %v", scaledObjectGroupVersionKind, scaledObject.GroupVersionKind())
+			}
+			if owners := scaledObject.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != "uid" {
+				t.Errorf("ScaledObject should be owned by the workload: %v", owners)
+			}
+			spec, _ := json.Marshal(scaledObject.Object["spec"])
+			if string(spec) != test.expectedSpec {
+				t.Errorf("ScaledObject spec expected: %s actual: %s", test.expectedSpec, spec)
+			}
+		})
+	}
+}
+
+// noKEDAClient fails like a client of a cluster without the KEDA CRDs
+type noKEDAClient struct {
+	client.Client
+}
+
+func (c noKEDAClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if u, ok := obj.(*unstructured.Unstructured); ok && u.GroupVersionKind() == scaledObjectGroupVersionKind {
+		return &meta.NoKindMatchError{GroupKind: scaledObjectGroupVersionKind.GroupKind(), SearchedVersions: []string{scaledObjectGroupVersionKind.Version}}
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestHandleReplicaSetBackends(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+	}
+	withBackend := func(backend string) map[string]string {
+		result := map[string]string{"autoscaling.banzaicloud.io/autoscaler-backend": backend}
+		for key, value := range annotations {
+			result[key] = value
+		}
+		return result
+	}
+
+	tests := []struct {
+		name           string
+		options        Options
+		kedaInstalled  bool
+		annotations    map[string]string
+		expectedStatus workloadStatus
+	}{
+		{
+			name:           "HPA by default",
+			kedaInstalled:  true,
+			annotations:    annotations,
+			expectedStatus: workloadStatus{Phase: phaseActive, HPA: "test"},
+		},
+		{
+			name:           "KEDA globally",
+			options:        Options{Backend: BackendKEDA},
+			kedaInstalled:  true,
+			annotations:    annotations,
+			expectedStatus: workloadStatus{Phase: phaseActive, ScaledObject: "test"},
+		},
+		{
+			name:           "KEDA per workload",
+			kedaInstalled:  true,
+			annotations:    withBackend(BackendKEDA),
+			expectedStatus: workloadStatus{Phase: phaseActive, ScaledObject: "test"},
+		},
+		{
+			name:           "HPA per workload",
+			options:        Options{Backend: BackendKEDA},
+			kedaInstalled:  true,
+			annotations:    withBackend(BackendHPA),
+			expectedStatus: workloadStatus{Phase: phaseActive, HPA: "test"},
+		},
+		{
+			name:        "invalid backend",
+			annotations: withBackend("VPA"),
+			expectedStatus: workloadStatus{Phase: phaseInvalid,
+				Error: "autoscaling.banzaicloud.io/autoscaler-backend value is invalid: VPA, it should be HPA or KEDA"},
+		},
+		{
+			name:           "KEDA API is not installed",
+			annotations:    withBackend(BackendKEDA),
+			expectedStatus: workloadStatus{Phase: phaseError, Error: "ScaledObject API is not installed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: test.annotations},
+			}
+			var c client.Client = fake.NewFakeClientWithScheme(scheme, deployment)
+			if !test.kedaInstalled {
+				c = noKEDAClient{Client: c}
+			}
+			handler, err := NewHandler(c, nil, test.options)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			actual := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var status workloadStatus
+			if err := json.Unmarshal([]byte(actual.Annotations[handler.keys.status]), &status); err != nil {
+				t.Fatalf("Status annotation is invalid: %v", err)
+			}
+			if status != test.expectedStatus {
+				t.Errorf("Status expected: %+v actual: %+v", test.expectedStatus, status)
+			}
+
+			hpaErr := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, &v2beta2.HorizontalPodAutoscaler{})
+			if created := hpaErr == nil; created != (status.HPA != "") {
+				t.Errorf("HPA created expected: %v actual: %v", status.HPA != "", hpaErr)
+			}
+			if !test.kedaInstalled {
+				return
+			}
+			scaledObject := kedaBackend{}.newObject()
+			scaledObjectErr := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, scaledObject)
+			if created := scaledObjectErr == nil; created != (status.ScaledObject != "") {
+				t.Errorf("ScaledObject created expected: %v actual: %v", status.ScaledObject != "", scaledObjectErr)
+			}
+			if status.Phase != phaseActive {
+				return
+			}
+
+			// switching backends deletes the object of the previous backend
+			switched := BackendKEDA
+			if status.ScaledObject != "" {
+				switched = BackendHPA
+			}
+			actual.Annotations["autoscaling.banzaicloud.io/autoscaler-backend"] = switched
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", actual.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			hpaErr = c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, &v2beta2.HorizontalPodAutoscaler{})
+			scaledObjectErr = c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, kedaBackend{}.newObject())
+			if (hpaErr == nil) != (switched == BackendHPA) || (scaledObjectErr == nil) != (switched == BackendKEDA) {
+				t.Errorf("Only the %v object expected, HPA: %v ScaledObject: %v", switched, hpaErr, scaledObjectErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package stub
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type loggerContextKey struct{}
+
+// NewContextWithLogger returns a copy of ctx which carries log. HPAHandler picks it up
+// so every line logged while handling a workload shares the same key/value pairs.
+func NewContextWithLogger(ctx context.Context, log logr.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, log)
+}
+
+// LoggerFromContext returns the logger stored in ctx by NewContextWithLogger,
+// falling back to the global controller-runtime logger.
+func LoggerFromContext(ctx context.Context) logr.Logger {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerContextKey{}).(logr.Logger); ok {
+			return log
+		}
+	}
+	return logf.Log.WithName("hpa-handler")
+}
@@ -0,0 +1,62 @@
+package stub
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The merge strategies of the annotationKeys.mergeStrategy annotation, selecting how the autoscale
+// annotations of a workload and of its pod template are combined
+const (
+	// mergeWorkload merges the annotations, the workload wins on conflicting keys
+	mergeWorkload = "Workload"
+	// mergePodTemplate merges the annotations, the pod template wins on conflicting keys
+	mergePodTemplate = "PodTemplate"
+	// mergeNone uses the workload annotations if there is any, the pod template annotations otherwise.
+	// It's the default, the annotations were never merged before the strategies were added.
+	mergeNone = "None"
+)
+
+// mergeAutoscaleAnnotations combines the autoscale annotations of a workload and of its pod template
+// according to strategy. It returns the pod template keys which are ignored, sorted: the keys set on
+// both to different values, and with the None strategy every pod template key missing from the
+// workload annotations too.
+func (k *annotationKeys) mergeAutoscaleAnnotations(strategy string, annotations map[string]string, podAnnotations map[string]string) (map[string]string, []string, error) {
+
+	var preferred, other map[string]string
+	switch strategy {
+	case mergeWorkload:
+		preferred, other = annotations, podAnnotations
+	case mergePodTemplate:
+		preferred, other = podAnnotations, annotations
+	case "", mergeNone:
+		if len(annotations) == 0 {
+			return podAnnotations, nil, nil
+		}
+		var ignored []string
+		for key, value := range podAnnotations {
+			if workloadValue, ok := annotations[key]; !ok || workloadValue != value {
+				ignored = append(ignored, key)
+			}
+		}
+		sort.Strings(ignored)
+		return annotations, ignored, nil
+	default:
+		return nil, nil, fmt.Errorf("%s value is invalid: %s, it should be one of %s, %s, %s",
+			k.mergeStrategy, strategy, mergeWorkload, mergePodTemplate, mergeNone)
+	}
+
+	merged := make(map[string]string, len(preferred)+len(other))
+	var conflicts []string
+	for key, value := range other {
+		merged[key] = value
+	}
+	for key, value := range preferred {
+		if otherValue, ok := other[key]; ok && otherValue != value {
+			conflicts = append(conflicts, key)
+		}
+		merged[key] = value
+	}
+	sort.Strings(conflicts)
+	return merged, conflicts, nil
+}
@@ -0,0 +1,168 @@
+package stub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestMergeAutoscaleAnnotations(t *testing.T) {
+
+	workload := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas": "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas": "4",
+	}
+	podTemplate := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "8",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+	}
+
+	tests := []struct {
+		strategy          string
+		annotations       map[string]string
+		podAnnotations    map[string]string
+		expected          map[string]string
+		expectedConflicts []string
+		expectedErr       bool
+	}{
+		{
+			strategy:       "",
+			annotations:    workload,
+			podAnnotations: podTemplate,
+			expected:       workload,
+			expectedConflicts: []string{
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas",
+			},
+		},
+		{
+			strategy:       mergeWorkload,
+			annotations:    workload,
+			podAnnotations: podTemplate,
+			expected: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "4",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+			},
+			expectedConflicts: []string{"hpa.autoscaling.banzaicloud.io/maxReplicas"},
+		},
+		{
+			strategy:          mergePodTemplate,
+			annotations:       workload,
+			podAnnotations:    podTemplate,
+			expected:          podTemplate,
+			expectedConflicts: []string{"hpa.autoscaling.banzaicloud.io/maxReplicas"},
+		},
+		{
+			strategy:       mergeNone,
+			annotations:    workload,
+			podAnnotations: podTemplate,
+			expected:       workload,
+			expectedConflicts: []string{
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas",
+			},
+		},
+		{
+			strategy:       mergeNone,
+			annotations:    workload,
+			podAnnotations: map[string]string{"hpa.autoscaling.banzaicloud.io/minReplicas": "1"},
+			expected:       workload,
+		},
+		{
+			strategy:       mergeNone,
+			annotations:    map[string]string{},
+			podAnnotations: podTemplate,
+			expected:       podTemplate,
+		},
+		{
+			strategy:       "Both",
+			annotations:    workload,
+			podAnnotations: podTemplate,
+			expectedErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			actual, conflicts, err := defaultAnnotationKeys.mergeAutoscaleAnnotations(test.strategy, test.annotations, test.podAnnotations)
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("Error expected: %v actual: %v", test.expectedErr, err)
+			}
+			if test.expectedErr {
+				return
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Annotations expected: %v actual: %v", test.expected, actual)
+			}
+			if !reflect.DeepEqual(conflicts, test.expectedConflicts) {
+				t.Errorf("Conflicts expected: %v actual: %v", test.expectedConflicts, conflicts)
+			}
+		})
+	}
+}
+
+func TestHandleReplicaSetReportsIgnoredPodTemplateAnnotations(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+			},
+		},
+	}
+	podAnnotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                     "6",
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployment)
+	recorder := record.NewFakeRecorder(10)
+	handler, err := NewHandler(c, recorder, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", deployment.Annotations, podAnnotations, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	hpa := &v2beta2.HorizontalPodAutoscaler{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, hpa); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hpa.Spec.MaxReplicas != 3 || len(hpa.Spec.Metrics) != 1 {
+		t.Errorf("Only the Deployment annotations expected to be used, actual: %v", hpa.Spec)
+	}
+
+	expected := "Warning AnnotationConflict Autoscale annotations are set on the Deployment and its pod template, " +
+		"the pod template values are ignored unless autoscaling.banzaicloud.io/annotation-merge selects Workload or PodTemplate: " +
+		"hpa.autoscaling.banzaicloud.io/maxReplicas, memory.hpa.autoscaling.banzaicloud.io/targetAverageUtilization"
+	select {
+	case event := <-recorder.Events:
+		if event != expected {
+			t.Errorf("Event expected: %v actual: %v", expected, event)
+		}
+	default:
+		t.Errorf("Event expected: %v", expected)
+	}
+}
@@ -2,12 +2,11 @@ package stub
 
 import (
 	stderrors "errors"
-	"fmt"
 	"k8s.io/api/autoscaling/v2beta2"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -29,160 +28,159 @@ func extractAnnotationIntValue(annotations map[string]string, annotationName str
 	return value, nil
 }
 
-func createResourceMetric(resourceName v1.ResourceName, annotationName string, valueFormat string, annotationValue string, deploymentName string) *v2beta2.MetricSpec {
+func createResourceMetric(resourceName v1.ResourceName, annotationName string, valueFormat string, annotationValue string) (*v2beta2.MetricSpec, error) {
 	if len(annotationValue) == 0 {
-		logrus.Errorf("Invalid resource metric annotation: %v value for deployment %v is missing", annotationName, deploymentName)
-		return nil
+		return nil, stderrors.New(annotationName + " value is missing")
 	}
 	if len(valueFormat) == 0 {
-		logrus.Errorf("Invalid resource metric annotation: %v value format for deployment %v is missing", annotationName, deploymentName)
-		return nil
+		return nil, stderrors.New(annotationName + " value format is missing")
 	}
 
 	switch valueFormat {
 	case targetAverageUtilization:
 		int64Value, err := strconv.ParseInt(annotationValue, 10, 32)
 		if err != nil {
-			logrus.Errorf("Invalid resource metric annotation: %v value for deployment %v is invalid: %v", annotationName, deploymentName, err.Error())
-			return nil
+			return nil, stderrors.New(annotationName + " value is invalid: " + err.Error())
 		}
 		targetValue := int32(int64Value)
 		if targetValue <= 0 || targetValue > 100 {
-			logrus.Errorf("Invalid resource metric annotation: %v value for deployment %v should be a percentage value between [1,99]", annotationName, deploymentName)
-			return nil
+			return nil, stderrors.New(annotationName + " value should be a percentage value between [1,100]")
 		}
 
-		if targetValue > 0 {
-			return &v2beta2.MetricSpec{
-				Type: v2beta2.ResourceMetricSourceType,
-				Resource: &v2beta2.ResourceMetricSource{
-					Name: resourceName,
-					Target: v2beta2.MetricTarget{
-						Type:               v2beta2.UtilizationMetricType,
-						AverageUtilization: &targetValue,
-					},
+		return &v2beta2.MetricSpec{
+			Type: v2beta2.ResourceMetricSourceType,
+			Resource: &v2beta2.ResourceMetricSource{
+				Name: resourceName,
+				Target: v2beta2.MetricTarget{
+					Type:               v2beta2.UtilizationMetricType,
+					AverageUtilization: &targetValue,
 				},
-			}
-		}
+			},
+		}, nil
 
 	case targetAverageValue:
 		targetValue, err := resource.ParseQuantity(annotationValue)
 		if err != nil {
-			logrus.Errorf("Invalid resource metric annotation: %v value for deployment %v is invalid: %v", annotationName, deploymentName, err.Error())
-			return nil
-		} else {
-			return &v2beta2.MetricSpec{
-				Type: v2beta2.ResourceMetricSourceType,
-				Resource: &v2beta2.ResourceMetricSource{
-					Name: resourceName,
-					Target: v2beta2.MetricTarget{
-						Type:         v2beta2.AverageValueMetricType,
-						AverageValue: &targetValue,
-					},
-				},
-			}
+			return nil, stderrors.New(annotationName + " value is invalid: " + err.Error())
 		}
-	default:
-		logrus.Warnf("Invalid resource metric valueFormat: %v for deployment %v", valueFormat, deploymentName)
+		if targetValue.Sign() <= 0 {
+			return nil, stderrors.New(annotationName + " value should be positive")
+		}
+		return &v2beta2.MetricSpec{
+			Type: v2beta2.ResourceMetricSourceType,
+			Resource: &v2beta2.ResourceMetricSource{
+				Name: resourceName,
+				Target: v2beta2.MetricTarget{
+					Type:         v2beta2.AverageValueMetricType,
+					AverageValue: &targetValue,
+				},
+			},
+		}, nil
 	}
 
-	return nil
+	return nil, stderrors.New(annotationName + " value format is invalid: " + valueFormat)
 }
 
-func createExternalPrometheusMetrics(hpa *v2beta2.HorizontalPodAutoscaler, metricName string, annotations map[string]string, deploymentName string) *v2beta2.MetricSpec {
+// parseMetrics returns the metrics configured by the annotations, sorted by sortMetrics, along with
+// the errors of the annotations which were skipped. The annotations are processed in the order of
+// their keys, so the errors don't depend on map iteration order either.
+func (k *annotationKeys) parseMetrics(hpa *v2beta2.HorizontalPodAutoscaler, annotations map[string]string, data *queryTemplateData) ([]v2beta2.MetricSpec, []error) {
 
-	logrus.Infof("setup custom prometheus metric: %v", metricName)
+	metrics := make([]v2beta2.MetricSpec, 0, 4)
+	var errs []error
+	customMetricsMap := make(map[string]bool)
 
-	queryKey := fmt.Sprintf("prometheus.%v.%v/query", metricName, hpaAnnotationPrefix)
-	query, ok := annotations[queryKey]
-	if !ok {
-		logrus.Errorf("query is missing for custom metric: %s, deployment %v", metricName, deploymentName)
-		return nil
+	metricKeys := make([]string, 0, len(annotations))
+	for metricKey := range annotations {
+		metricKeys = append(metricKeys, metricKey)
 	}
-	if len(hpa.Annotations) == 0 {
-		hpa.Annotations = make(map[string]string)
-	}
-	hpa.Annotations[fmt.Sprintf("metric-config.external.prometheus-query.prometheus/%s", metricName)] = query
-
-	metricSpec := &v2beta2.MetricSpec{
-		Type: v2beta2.ExternalMetricSourceType,
-		External: &v2beta2.ExternalMetricSource{
-			Metric: v2beta2.MetricIdentifier{
-				Name: "prometheus-query",
-				Selector: &metav1.LabelSelector{
-					MatchLabels: map[string]string{
-						"query-name": metricName,
-					},
-				},
-			},
-		},
-	}
-
-	targetValueKey := fmt.Sprintf("prometheus.%v.%v/targetValue", metricName, hpaAnnotationPrefix)
-	targetAverageValueKey := fmt.Sprintf("prometheus.%v.%v/targetAverageValue", metricName, hpaAnnotationPrefix)
+	sort.Strings(metricKeys)
 
-	if valueStr, ok := annotations[targetValueKey]; ok {
-		targetValue, err := resource.ParseQuantity(valueStr)
-		if err != nil {
-			logrus.Errorf("targetValue is invalid in custom metric: %s, deployment: %s (%s)", metricName, deploymentName, err.Error())
-			return nil
+	for _, metricKey := range metricKeys {
+		metricValue := annotations[metricKey]
+		keys := strings.Split(metricKey, annotationDomainSeparator)
+		if len(keys) != 2 {
+			errs = append(errs, stderrors.New("metric annotation is invalid: "+metricKey))
+			continue
 		}
-		metricSpec.External.Target = v2beta2.MetricTarget{
-			Type:  v2beta2.ValueMetricType,
-			Value: &targetValue,
+		domain := keys[0]
+		var metric *v2beta2.MetricSpec
+		var err error
+		switch {
+		case domain == k.prefix:
+			// minReplicas and maxReplicas
+		case domain == k.subDomain(cpuAnnotationPrefix):
+			metric, err = createResourceMetric(v1.ResourceCPU, metricKey, keys[1], metricValue)
+		case domain == k.subDomain(memoryAnnotationPrefix):
+			metric, err = createResourceMetric(v1.ResourceMemory, metricKey, keys[1], metricValue)
+		case strings.HasSuffix(domain, annotationSubDomainSeparator+k.prefix) &&
+			strings.Contains(strings.TrimSuffix(domain, annotationSubDomainSeparator+k.prefix), annotationSubDomainSeparator):
+			// <collector>.<metricName>.<prefix>/<field>, the fields of a metric are parsed together
+			if customMetricsMap[domain] {
+				continue
+			}
+			customMetricsMap[domain] = true
+			names := strings.SplitN(strings.TrimSuffix(domain, annotationSubDomainSeparator+k.prefix), annotationSubDomainSeparator, 2)
+			metric, err = parseCollectorMetric(hpa, names[0], names[1], domain, annotations, data)
+		default:
+			err = stderrors.New("metric annotation is invalid: " + metricKey)
 		}
-	} else if valueStr, ok = annotations[targetAverageValueKey]; ok {
-		targetValue, err := resource.ParseQuantity(valueStr)
 		if err != nil {
-			logrus.Errorf("targetAverageValue is invalid in custom metric: %s, deployment: %s (%s)", metricName, deploymentName, err.Error())
-			return nil
+			errs = append(errs, err)
 		}
-		metricSpec.External.Target = v2beta2.MetricTarget{
-			Type:         v2beta2.AverageValueMetricType,
-			AverageValue: &targetValue,
+		if metric != nil {
+			metrics = append(metrics, *metric)
 		}
-	} else {
-		logrus.Errorf("either targetValue or targetAverageValue is required for custom metric: %s, deployment: %v", metricName, deploymentName)
-		return nil
 	}
 
-	return metricSpec
+	sortMetrics(metrics)
+	return metrics, errs
 }
 
-func parseMetrics(hpa *v2beta2.HorizontalPodAutoscaler, annotations map[string]string, deploymentName string) []v2beta2.MetricSpec {
-
-	metrics := make([]v2beta2.MetricSpec, 0, 4)
-	customMetricsMap := make(map[string]*v2beta2.MetricSpec)
+// metricTypeOrder follows the declaration order of the metric source types in the API
+var metricTypeOrder = map[v2beta2.MetricSourceType]int{
+	v2beta2.ObjectMetricSourceType:   0,
+	v2beta2.PodsMetricSourceType:     1,
+	v2beta2.ResourceMetricSourceType: 2,
+	v2beta2.ExternalMetricSourceType: 3,
+}
 
-	for metricKey, metricValue := range annotations {
-		keys := strings.Split(metricKey, annotationDomainSeparator)
-		if len(keys) != 2 {
-			logrus.Errorf("Metric annotation for deployment %v is invalid: %v", deploymentName, metricKey)
-			return metrics
-		}
-		metricSubDomains := strings.Split(keys[0], annotationSubDomainSeparator)
-		if len(metricSubDomains) < 2 {
-			logrus.Errorf("Metric annotation for deployment %v is invalid: %v", deploymentName, metricKey)
-			return metrics
+// sortMetrics orders the metrics by type, then name, then target type, so the generated HPA is
+// the same on every reconcile and doesn't trigger spurious updates.
+func sortMetrics(metrics []v2beta2.MetricSpec) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		if metricTypeOrder[a.Type] != metricTypeOrder[b.Type] {
+			return metricTypeOrder[a.Type] < metricTypeOrder[b.Type]
 		}
-		var metric *v2beta2.MetricSpec
-		switch metricSubDomains[0] {
-		case cpuAnnotationPrefix:
-			metric = createResourceMetric(v1.ResourceCPU, metricKey, keys[1], metricValue, deploymentName)
-		case memoryAnnotationPrefix:
-			metric = createResourceMetric(v1.ResourceMemory, metricKey, keys[1], metricValue, deploymentName)
-		case prometheusAnnotationPrefix:
-			metricName := metricSubDomains[1]
-			if _, ok := customMetricsMap[metricName]; !ok {
-				metric = createExternalPrometheusMetrics(hpa, metricName, annotations, deploymentName)
-				customMetricsMap[metricName] = metric
-			}
-		}
-		if metric != nil {
-			metrics = append(metrics, *metric)
+		nameA, targetA := metricNameAndTarget(a)
+		nameB, targetB := metricNameAndTarget(b)
+		if nameA != nameB {
+			return nameA < nameB
 		}
+		return targetA.Type < targetB.Type
+	})
+}
 
+// metricNameAndTarget returns the name identifying a metric within its type, including the
+// selector of the metric, e.g. the query name of a prometheus query
+func metricNameAndTarget(metric v2beta2.MetricSpec) (string, v2beta2.MetricTarget) {
+	identifierName := func(identifier v2beta2.MetricIdentifier) string {
+		if identifier.Selector == nil {
+			return identifier.Name
+		}
+		return identifier.Name + "{" + metav1.FormatLabelSelector(identifier.Selector) + "}"
 	}
-
-	return metrics
+	switch {
+	case metric.Object != nil:
+		return metric.Object.DescribedObject.Kind + "/" + metric.Object.DescribedObject.Name + "/" +
+			identifierName(metric.Object.Metric), metric.Object.Target
+	case metric.Pods != nil:
+		return identifierName(metric.Pods.Metric), metric.Pods.Target
+	case metric.Resource != nil:
+		return string(metric.Resource.Name), metric.Resource.Target
+	case metric.External != nil:
+		return identifierName(metric.External.Metric), metric.External.Target
+	}
+	return "", v2beta2.MetricTarget{}
 }
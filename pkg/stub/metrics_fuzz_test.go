@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package stub
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParseMetrics checks the parser properties on annotations given as key=value lines, run it with
+//
+//	go test ./pkg/stub -run '^$' -fuzz FuzzParseMetrics
+func FuzzParseMetrics(f *testing.F) {
+	f.Add("hpa.autoscaling.banzaicloud.io/minReplicas=1\n" +
+		"hpa.autoscaling.banzaicloud.io/maxReplicas=3\n" +
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization=80\n" +
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue=1Gi")
+	f.Add("hpa.autoscaling.banzaicloud.io/minReplicas=2\n" +
+		"hpa.autoscaling.banzaicloud.io/maxReplicas=10\n" +
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query=sum(rate(http_requests_total[1m]))\n" +
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue=100\n" +
+		"prometheus.lag.hpa.autoscaling.banzaicloud.io/query=sum(kafka_consumergroup_lag)\n" +
+		"prometheus.lag.hpa.autoscaling.banzaicloud.io/targetValue=500m")
+	f.Add("hpa.autoscaling.banzaicloud.io/minReplicas=5\n" +
+		"hpa.autoscaling.banzaicloud.io/maxReplicas=1\n" +
+		"x/cpu.hpa.autoscaling.banzaicloud.io/targetAverageValue=-1")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		annotations := make(map[string]string)
+		for _, line := range strings.Split(input, "\n") {
+			keyValue := strings.SplitN(line, "=", 2)
+			if len(keyValue) == 2 {
+				annotations[keyValue[0]] = keyValue[1]
+			}
+		}
+		checkParserProperties(t, annotations)
+	})
+}
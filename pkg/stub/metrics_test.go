@@ -0,0 +1,262 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// the building blocks of the random annotations, valid ones are picked more often than junk
+var (
+	propertyDomains = []string{
+		"hpa.autoscaling.banzaicloud.io",
+		"cpu.hpa.autoscaling.banzaicloud.io",
+		"memory.hpa.autoscaling.banzaicloud.io",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io",
+		"prometheus.lag.hpa.autoscaling.banzaicloud.io",
+		"prometheus..hpa.autoscaling.banzaicloud.io",
+		"prometheus.hpa.autoscaling.banzaicloud.io",
+		"prometheus.a.b.hpa.autoscaling.banzaicloud.io",
+		"cpu.memory.hpa.autoscaling.banzaicloud.io",
+		"gpu.hpa.autoscaling.banzaicloud.io",
+		"x/cpu.hpa.autoscaling.banzaicloud.io",
+	}
+	propertyFields = []string{
+		"minReplicas", "maxReplicas", "query",
+		targetAverageUtilization, targetAverageValue, targetValue,
+		"", "unknown", "query/",
+	}
+	propertyValues = []string{
+		"1", "2", "3", "10", "50", "100", "101", "0", "-1", "500m", "1Gi", "1.5", "0.0001",
+		"sum(rate(http_requests_total[1m]))", "", "abc", "80%", "1e3", "2147483648",
+	}
+)
+
+func randomAnnotations(r *rand.Rand) map[string]string {
+	annotations := make(map[string]string)
+	for i := r.Intn(8); i >= 0; i-- {
+		key := propertyDomains[r.Intn(len(propertyDomains))] + annotationDomainSeparator +
+			propertyFields[r.Intn(len(propertyFields))]
+		annotations[key] = propertyValues[r.Intn(len(propertyValues))]
+	}
+	return annotations
+}
+
+// parseResult is the marshaled output of the parser, it's compared to check determinism
+func parseResult(annotations map[string]string) string {
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+	data, _ := json.Marshal(hpa)
+	if err != nil {
+		return fmt.Sprintf("%s\n%v", data, err)
+	}
+	return string(data)
+}
+
+// metricSortKey returns the key of the annotations a metric is configured by
+func metricSortKey(metric v2beta2.MetricSpec) string {
+	switch {
+	case metric.Resource != nil:
+		return string(metric.Resource.Name)
+	case metric.External != nil && metric.External.Metric.Selector != nil:
+		return prometheusAnnotationPrefix + annotationSubDomainSeparator + metric.External.Metric.Selector.MatchLabels[prometheusQueryNameLabel]
+	}
+	return ""
+}
+
+// validateHorizontalPodAutoscaler checks the fields the API server validates
+func validateHorizontalPodAutoscaler(hpa *v2beta2.HorizontalPodAutoscaler) error {
+	spec := hpa.Spec
+	if spec.MinReplicas == nil || *spec.MinReplicas < 1 || spec.MaxReplicas < *spec.MinReplicas {
+		return fmt.Errorf("replicas are invalid: %v %v", spec.MinReplicas, spec.MaxReplicas)
+	}
+	if len(spec.Metrics) == 0 {
+		return fmt.Errorf("metrics are missing")
+	}
+	for key := range hpa.Annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("annotation %s is invalid: %v", key, errs)
+		}
+	}
+	for _, metric := range spec.Metrics {
+		var target v2beta2.MetricTarget
+		switch metric.Type {
+		case v2beta2.ResourceMetricSourceType:
+			if metric.Resource == nil || metric.External != nil {
+				return fmt.Errorf("resource metric is invalid: %v", metric)
+			}
+			if metric.Resource.Name != v1.ResourceCPU && metric.Resource.Name != v1.ResourceMemory {
+				return fmt.Errorf("resource is invalid: %v", metric.Resource.Name)
+			}
+			target = metric.Resource.Target
+		case v2beta2.ExternalMetricSourceType:
+			if metric.External == nil || metric.Resource != nil || metric.External.Metric.Selector == nil {
+				return fmt.Errorf("external metric is invalid: %v", metric)
+			}
+			for _, value := range metric.External.Metric.Selector.MatchLabels {
+				if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+					return fmt.Errorf("label value %s is invalid: %v", value, errs)
+				}
+			}
+			target = metric.External.Target
+		default:
+			return fmt.Errorf("metric type is invalid: %v", metric.Type)
+		}
+		switch target.Type {
+		case v2beta2.UtilizationMetricType:
+			if target.AverageUtilization == nil || *target.AverageUtilization < 1 || *target.AverageUtilization > 100 {
+				return fmt.Errorf("utilization is invalid: %v", target.AverageUtilization)
+			}
+		case v2beta2.AverageValueMetricType:
+			if target.AverageValue == nil || target.AverageValue.Sign() <= 0 {
+				return fmt.Errorf("average value is invalid: %v", target.AverageValue)
+			}
+		case v2beta2.ValueMetricType:
+			if target.Value == nil || target.Value.Sign() <= 0 {
+				return fmt.Errorf("value is invalid: %v", target.Value)
+			}
+		default:
+			return fmt.Errorf("target type is invalid: %v", target.Type)
+		}
+	}
+	return nil
+}
+
+// checkParserProperties parses annotations and checks the properties that hold for any input
+func checkParserProperties(t *testing.T, annotations map[string]string) {
+	t.Helper()
+
+	// the same annotations, inserted in a different order, give the same result
+	expected := parseResult(annotations)
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	for i := 0; i < 3; i++ {
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		shuffled := make(map[string]string, len(keys))
+		for _, key := range keys {
+			shuffled[key] = annotations[key]
+		}
+		if actual := parseResult(shuffled); actual != expected {
+			t.Fatalf("Result of %v isn't deterministic, expected: %v actual: %v", annotations, expected, actual)
+		}
+	}
+
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+	if hpa == nil {
+		if err == nil {
+			t.Fatalf("Error is missing for %v", annotations)
+		}
+		return
+	}
+
+	sorted := sort.SliceIsSorted(hpa.Spec.Metrics, func(i, j int) bool {
+		return metricSortKey(hpa.Spec.Metrics[i]) < metricSortKey(hpa.Spec.Metrics[j])
+	})
+	if !sorted {
+		t.Errorf("Metrics of %v aren't sorted: %v", annotations, hpa.Spec.Metrics)
+	}
+
+	if err := validateHorizontalPodAutoscaler(hpa); err != nil {
+		t.Fatalf("HPA generated from %v is invalid: %v", annotations, err)
+	}
+
+	// the HPA generated from the accepted annotations is the same
+	accepted, errs := defaultAnnotationKeys.annotationsFromHorizontalPodAutoscaler(hpa)
+	if len(errs) > 0 {
+		t.Fatalf("HPA generated from %v can't be converted to annotations: %v", annotations, errs)
+	}
+	roundTrip, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", accepted, nil)
+	if err != nil {
+		t.Fatalf("Annotations %v accepted from %v are invalid: %v", accepted, annotations, err)
+	}
+	expectedHPA, _ := json.Marshal(hpa)
+	actualHPA, _ := json.Marshal(roundTrip)
+	if string(expectedHPA) != string(actualHPA) {
+		t.Errorf("HPA generated from %v expected: %s actual: %s", annotations, expectedHPA, actualHPA)
+	}
+}
+
+func TestParseMetricsProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		checkParserProperties(t, randomAnnotations(r))
+	}
+}
+
+func TestParseMetricsInvalidKeyDoesNotStopParsing(t *testing.T) {
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+		"a/b.hpa.autoscaling.banzaicloud.io/targetAverageValue":       "1",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+		"gpu.hpa.autoscaling.banzaicloud.io/targetAverageValue":       "1",
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "1Gi",
+	}
+
+	metrics, errs := defaultAnnotationKeys.parseMetrics(&v2beta2.HorizontalPodAutoscaler{}, annotations, newQueryTemplateData("test", "default", "Deployment", nil))
+	if len(metrics) != 2 {
+		t.Errorf("Metrics expected: %v actual: %v", 2, len(metrics))
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "a/b.hpa") || !strings.Contains(errs[1].Error(), "gpu.hpa") {
+		t.Errorf("Errors expected: %v actual: %v", "a/b and gpu annotations", errs)
+	}
+}
+
+func TestCreateHPAIsDeterministic(t *testing.T) {
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "5",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(rate(http_requests_total[1m]))",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+		"prometheus.lag.hpa.autoscaling.banzaicloud.io/query":                   "sum(kafka_consumergroup_lag)",
+		"prometheus.lag.hpa.autoscaling.banzaicloud.io/targetValue":             "1k",
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":        "60",
+		"memory.hpa.autoscaling.banzaicloud.io/targetAverageValue":              "1Gi",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":           "80",
+	}
+
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		actual, err := json.Marshal(hpa)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected == nil {
+			expected = actual
+			continue
+		}
+		if string(actual) != string(expected) {
+			t.Fatalf("HPA expected: %s actual: %s", expected, actual)
+		}
+	}
+
+	hpa, _ := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+	expectedOrder := []string{
+		"cpu Utilization",
+		"memory AverageValue",
+		"memory Utilization",
+		"prometheus-query{query-name=lag} Value",
+		"prometheus-query{query-name=requests} AverageValue",
+	}
+	actualOrder := make([]string, 0, len(hpa.Spec.Metrics))
+	for _, metric := range hpa.Spec.Metrics {
+		name, target := metricNameAndTarget(metric)
+		actualOrder = append(actualOrder, fmt.Sprintf("%s %s", name, target.Type))
+	}
+	if strings.Join(actualOrder, ", ") != strings.Join(expectedOrder, ", ") {
+		t.Errorf("Metrics expected: %v actual: %v", expectedOrder, actualOrder)
+	}
+}
@@ -0,0 +1,134 @@
+package stub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ownedKind is a kind of object the operator generates for a workload, owned by the workload and
+// named after it
+type ownedKind interface {
+	// kind is the kind of the generated objects
+	kind() string
+	// objectName returns the name of the object generated for the workload named workloadName
+	objectName(workloadName string) string
+	// newObject returns an empty object of the kind, to read the current one into
+	newObject() runtime.Object
+	// statusName returns the field of status holding the name of the generated object
+	statusName(status *workloadStatus) *string
+}
+
+// syncOwnedObject keeps the object of the workload in sync with desired, generated from its
+// annotations along with invalidErr. The object is created or updated if annotationsFound, unless
+// desired is nil, and deleted otherwise. Objects not owned by the workload, or owned by another
+// operator instance, are left alone. The returned status is nil if annotationsFound is false.
+func (h *HPAHandler) syncOwnedObject(
+	ctx context.Context,
+	object ownedKind,
+	name string, namespace string, kind string,
+	desired runtime.Object, annotationsFound bool, invalidErr error) (*workloadStatus, error) {
+
+	log := LoggerFromContext(ctx)
+	objectName := object.objectName(name)
+	newStatus := func(phase string, withName bool, err error) *workloadStatus {
+		status := &workloadStatus{Phase: phase}
+		if withName {
+			*object.statusName(status) = objectName
+		}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		return status
+	}
+
+	h.clearDryRun(object.kind(), objectName, namespace)
+	current := object.newObject()
+	exists := true
+	namespacedName := client.ObjectKey{
+		Name:      objectName,
+		Namespace: namespace,
+	}
+	if err := h.client.Get(ctx, namespacedName, current); err != nil {
+		if meta.IsNoMatchError(err) {
+			log.Info(object.kind() + " API is not installed")
+			if !annotationsFound {
+				return nil, nil
+			}
+			return newStatus(phaseError, false, fmt.Errorf("%s API is not installed", object.kind())), nil
+		}
+		log.V(1).Info(object.kind()+" doesn't exist", "reason", err.Error())
+		exists = false
+	}
+
+	if exists {
+		currentMeta, err := meta.Accessor(current)
+		if err != nil {
+			return nil, err
+		}
+		if !isCreatedByHpaController(currentMeta, name, kind) {
+			log.Info(object.kind() + " is not created by us")
+			if !annotationsFound {
+				return nil, nil
+			}
+			return newStatus(phaseConflict, false, fmt.Errorf("%s %s exists and is not owned by this %s", object.kind(), objectName, kind)), nil
+		}
+		if instanceID := currentMeta.GetLabels()[h.keys.instance]; instanceID != h.instanceID {
+			log.Info(object.kind()+" is managed by another operator instance", "instance", instanceID)
+			if !annotationsFound {
+				return nil, nil
+			}
+			return newStatus(phaseConflict, false, fmt.Errorf("%s %s is managed by the operator instance %s", object.kind(), objectName, strconv.Quote(instanceID))), nil
+		}
+
+		if annotationsFound {
+			if desired == nil {
+				return newStatus(phaseInvalid, true, invalidErr), nil
+			}
+			log.Info(object.kind() + " found, will be updated")
+			desiredMeta, err := meta.Accessor(desired)
+			if err != nil {
+				return nil, err
+			}
+			desiredMeta.SetResourceVersion(currentMeta.GetResourceVersion())
+			h.reportDryRun(ctx, object.kind(), objectName, namespace, current, desired)
+			err = h.client.Update(ctx, desired)
+			if err != nil && !errors.IsAlreadyExists(err) {
+				log.Error(err, "failed to update "+object.kind())
+				return newStatus(phaseError, true, err), err
+			}
+		} else {
+			log.Info(object.kind() + " found, will be deleted")
+			h.reportDryRun(ctx, object.kind(), objectName, namespace, current, nil)
+
+			err := h.client.Delete(ctx, current)
+			if err != nil {
+				log.Error(err, "failed to delete "+object.kind())
+				return nil, err
+			}
+			return nil, nil
+		}
+
+	} else if annotationsFound {
+		if desired == nil {
+			return newStatus(phaseInvalid, false, invalidErr), nil
+		}
+		log.Info(object.kind() + " doesn't exist, will be created")
+		h.reportDryRun(ctx, object.kind(), objectName, namespace, nil, desired)
+		err := h.client.Create(ctx, desired)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			log.Error(err, "failed to create "+object.kind())
+			return newStatus(phaseError, false, err), err
+		}
+	} else {
+		return nil, nil
+	}
+
+	// invalidErr lists the skipped metrics, if any
+	return newStatus(phaseActive, true, invalidErr), nil
+}
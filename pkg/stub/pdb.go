@@ -0,0 +1,209 @@
+package stub
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const pdbAnnotationPrefix = "pdb"
+
+// The fields of the PDB annotations, e.g. pdb.hpa.autoscaling.banzaicloud.io/minAvailable
+const (
+	pdbMinAvailable   = "minAvailable"
+	pdbMaxUnavailable = "maxUnavailable"
+)
+
+// pdbFromMinReplicas as the minAvailable value sets it to the minReplicas of the HPA
+const pdbFromMinReplicas = "minReplicas"
+
+var pdbPercentRegExp = regexp.MustCompile(`^[0-9]+%$`)
+
+// pdbKind is the kind of the generated PodDisruptionBudgets
+type pdbKind struct{}
+
+func (pdbKind) kind() string {
+	return "PodDisruptionBudget"
+}
+
+func (pdbKind) objectName(workloadName string) string {
+	return workloadName
+}
+
+func (pdbKind) newObject() runtime.Object {
+	return &policyv1beta1.PodDisruptionBudget{}
+}
+
+func (pdbKind) statusName(status *workloadStatus) *string {
+	return &status.PDB
+}
+
+// isPDBAnnotation returns whether key is a PDB annotation. They are in the pdb sub domain of the
+// prefix, so they match the autoscale annotation regexp, but they are not turned into metrics.
+func (k *annotationKeys) isPDBAnnotation(key string) bool {
+	return strings.SplitN(key, annotationDomainSeparator, 2)[0] == k.subDomain(pdbAnnotationPrefix)
+}
+
+func (h *HPAHandler) filterPDBAnnotations(annotations map[string]string) map[string]string {
+	pdbAnnotations := make(map[string]string)
+	for key, value := range annotations {
+		if h.keys.isPDBAnnotation(key) {
+			pdbAnnotations[key] = value
+		}
+	}
+	return pdbAnnotations
+}
+
+// createPodDisruptionBudget generates the PDB of a workload from its PDB annotations, selecting
+// the pods of the workload by selector. hpa is the HPA generated for the workload, minAvailable is
+// derived from its minReplicas if set to pdbFromMinReplicas. Any invalid annotation rejects the PDB.
+func (k *annotationKeys) createPodDisruptionBudget(
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, selector *metav1.LabelSelector,
+	hpa *v2beta2.HorizontalPodAutoscaler) (*policyv1beta1.PodDisruptionBudget, error) {
+
+	minAvailableKey := k.subDomain(pdbAnnotationPrefix) + annotationDomainSeparator + pdbMinAvailable
+	maxUnavailableKey := k.subDomain(pdbAnnotationPrefix) + annotationDomainSeparator + pdbMaxUnavailable
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	spec := policyv1beta1.PodDisruptionBudgetSpec{Selector: selector}
+	for _, key := range keys {
+		value := annotations[key]
+		switch key {
+		case minAvailableKey:
+			if value == pdbFromMinReplicas {
+				if hpa == nil || hpa.Spec.MinReplicas == nil {
+					errs = append(errs, fmt.Errorf("%s value is invalid: %s requires valid autoscale annotations", key, value))
+					continue
+				}
+				minAvailable := intstr.FromInt(int(*hpa.Spec.MinReplicas))
+				spec.MinAvailable = &minAvailable
+				continue
+			}
+			minAvailable, err := parsePDBValue(key, value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			spec.MinAvailable = minAvailable
+		case maxUnavailableKey:
+			maxUnavailable, err := parsePDBValue(key, value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			spec.MaxUnavailable = maxUnavailable
+		default:
+			errs = append(errs, fmt.Errorf("PDB annotation is invalid: %s", key))
+		}
+	}
+	_, minAvailableSet := annotations[minAvailableKey]
+	_, maxUnavailableSet := annotations[maxUnavailableKey]
+	if minAvailableSet && maxUnavailableSet {
+		errs = append(errs, fmt.Errorf("%s can't be combined with %s", minAvailableKey, maxUnavailableKey))
+	} else if !minAvailableSet && !maxUnavailableSet {
+		errs = append(errs, fmt.Errorf("either %s or %s is required", minAvailableKey, maxUnavailableKey))
+	}
+	if selector == nil {
+		errs = append(errs, fmt.Errorf("%s %s has no pod selector", kind, name))
+	}
+	if len(errs) > 0 {
+		return nil, &InvalidAnnotationsError{Errors: errs}
+	}
+
+	return &policyv1beta1.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PodDisruptionBudget",
+			APIVersion: policyv1beta1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: newOwnerReferences(UID, name, kind, apiVersion),
+		},
+		Spec: spec,
+	}, nil
+}
+
+// parsePDBValue parses a number of pods, e.g. 2, or a percentage of the pods, e.g. 50%
+func parsePDBValue(key string, value string) (*intstr.IntOrString, error) {
+	if pdbPercentRegExp.MatchString(value) {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent > 100 {
+			return nil, fmt.Errorf("%s value is invalid: %s, the percentage should not be greater than 100%%", key, value)
+		}
+		result := intstr.FromString(value)
+		return &result, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("%s value is invalid: %s, it should be a number of pods or a percentage", key, value)
+	}
+	result := intstr.FromInt(count)
+	return &result, nil
+}
+
+// handlePodDisruptionBudget keeps the PDB in sync with the PDB annotations, hpa is the HPA generated
+// for the workload, if any. The returned status is nil if the workload has no PDB. Like the VPA, the
+// PDB is only looked up to be deleted if the status shows it was generated before.
+func (h *HPAHandler) handlePodDisruptionBudget(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, podAnnotations map[string]string,
+	selector *metav1.LabelSelector,
+	hpa *v2beta2.HorizontalPodAutoscaler) (*workloadStatus, error) {
+
+	log := LoggerFromContext(ctx)
+	workloadAnnotations := h.filterPDBAnnotations(annotations)
+	podTemplateAnnotations := h.filterPDBAnnotations(podAnnotations)
+	pdbAnnotationsFound := len(workloadAnnotations) > 0 || len(podTemplateAnnotations) > 0
+	if _, ok := annotations[h.keys.pdbStatus]; !ok && !pdbAnnotationsFound {
+		return nil, nil
+	}
+
+	var desired runtime.Object
+	var invalidErr error
+	if pdbAnnotationsFound {
+		strategy := annotations[h.keys.mergeStrategy]
+		pdbAnnotations, conflicts, err := h.keys.mergeAutoscaleAnnotations(strategy, workloadAnnotations, podTemplateAnnotations)
+		if err != nil {
+			invalidErr = &InvalidAnnotationsError{Errors: []error{err}}
+		} else {
+			ref := &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name, Namespace: namespace, UID: UID}
+			h.reportConflicts(ctx, ref, strategy, conflicts)
+			var pdb *policyv1beta1.PodDisruptionBudget
+			pdb, invalidErr = h.keys.createPodDisruptionBudget(UID, name, namespace, kind, apiVersion, pdbAnnotations, selector, hpa)
+			if invalidErr == nil {
+				if h.instanceID != "" {
+					pdb.Labels = map[string]string{h.keys.instance: h.instanceID}
+				}
+				desired = pdb
+			}
+		}
+		if invalidErr != nil {
+			log.Error(invalidErr, "invalid PDB annotations")
+		}
+	}
+	return h.syncOwnedObject(ctx, pdbKind{}, name, namespace, kind, desired, pdbAnnotationsFound, invalidErr)
+}
@@ -0,0 +1,217 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCreatePodDisruptionBudget(t *testing.T) {
+
+	minReplicas := int32(3)
+	hpa := &v2beta2.HorizontalPodAutoscaler{Spec: v2beta2.HorizontalPodAutoscalerSpec{MinReplicas: &minReplicas}}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}
+
+	tests := []struct {
+		name                   string
+		annotations            map[string]string
+		hpa                    *v2beta2.HorizontalPodAutoscaler
+		selector               *metav1.LabelSelector
+		expectedMinAvailable   string
+		expectedMaxUnavailable string
+		expectedErr            []string
+	}{
+		{
+			name: "minAvailable",
+			annotations: map[string]string{
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable": "2",
+			},
+			selector:             selector,
+			expectedMinAvailable: "2",
+		},
+		{
+			name: "maxUnavailable percentage",
+			annotations: map[string]string{
+				"pdb.hpa.autoscaling.banzaicloud.io/maxUnavailable": "25%",
+			},
+			selector:               selector,
+			expectedMaxUnavailable: "25%",
+		},
+		{
+			name: "derived from minReplicas",
+			annotations: map[string]string{
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable": "minReplicas",
+			},
+			hpa:                  hpa,
+			selector:             selector,
+			expectedMinAvailable: "3",
+		},
+		{
+			name: "minReplicas without HPA",
+			annotations: map[string]string{
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable": "minReplicas",
+			},
+			selector:    selector,
+			expectedErr: []string{"pdb.hpa.autoscaling.banzaicloud.io/minAvailable value is invalid: minReplicas requires valid autoscale annotations"},
+		},
+		{
+			name: "invalid annotations",
+			annotations: map[string]string{
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable":   "-1",
+				"pdb.hpa.autoscaling.banzaicloud.io/maxUnavailable": "120%",
+				"pdb.hpa.autoscaling.banzaicloud.io/min":            "1",
+			},
+			expectedErr: []string{
+				"pdb.hpa.autoscaling.banzaicloud.io/maxUnavailable value is invalid: 120%, the percentage should not be greater than 100%",
+				"PDB annotation is invalid: pdb.hpa.autoscaling.banzaicloud.io/min",
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable value is invalid: -1, it should be a number of pods or a percentage",
+				"pdb.hpa.autoscaling.banzaicloud.io/minAvailable can't be combined with pdb.hpa.autoscaling.banzaicloud.io/maxUnavailable",
+				"Deployment test has no pod selector",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pdb, err := defaultAnnotationKeys.createPodDisruptionBudget("uid", "test", "default", "Deployment", "apps/v1", test.annotations, test.selector, test.hpa)
+			if len(test.expectedErr) > 0 {
+				if pdb != nil {
+					t.Errorf("PDB should not be generated from invalid annotations: %v", pdb)
+				}
+				if err == nil {
+					t.Fatalf("Error expected: %v", test.expectedErr)
+				}
+				errs := err.(*InvalidAnnotationsError).Errors
+				if len(errs) != len(test.expectedErr) {
+					t.Errorf("Errors expected: %v actual: %v", len(test.expectedErr), errs)
+				}
+				for i := 0; i < len(errs) && i < len(test.expectedErr); i++ {
+					if !strings.Contains(errs[i].Error(), test.expectedErr[i]) {
+						t.Errorf("Error expected: %v actual: %v", test.expectedErr[i], errs[i])
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if owners := pdb.OwnerReferences; len(owners) != 1 || owners[0].UID != "uid" {
+				t.Errorf("PDB should be owned by the workload: %v", owners)
+			}
+			if pdb.Spec.Selector != test.selector {
+				t.Errorf("PDB selector expected: %v actual: %v", test.selector, pdb.Spec.Selector)
+			}
+			var minAvailable, maxUnavailable string
+			if pdb.Spec.MinAvailable != nil {
+				minAvailable = pdb.Spec.MinAvailable.String()
+			}
+			if pdb.Spec.MaxUnavailable != nil {
+				maxUnavailable = pdb.Spec.MaxUnavailable.String()
+			}
+			if minAvailable != test.expectedMinAvailable || maxUnavailable != test.expectedMaxUnavailable {
+				t.Errorf("PDB minAvailable, maxUnavailable expected: %v, %v actual: %v, %v",
+					test.expectedMinAvailable, test.expectedMaxUnavailable, minAvailable, maxUnavailable)
+			}
+		})
+	}
+}
+
+func TestHandleReplicaSetPodDisruptionBudget(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "2",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "5",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+		"pdb.hpa.autoscaling.banzaicloud.io/minAvailable":             "minReplicas",
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: annotations},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, statefulSet)
+	handler, err := NewHandler(c, nil, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	key := client.ObjectKey{Name: "test", Namespace: "default"}
+	err = handler.HandleReplicaSet(ctx, statefulSet.UID, statefulSet.Name, statefulSet.Namespace,
+		"StatefulSet", "apps/v1", statefulSet.Annotations, nil, selector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pdb := &policyv1beta1.PodDisruptionBudget{}
+	if err := c.Get(ctx, key, pdb); err != nil {
+		t.Fatalf("PDB should be created: %v", err)
+	}
+	if pdb.Spec.MinAvailable == nil || pdb.Spec.MinAvailable.IntValue() != 2 {
+		t.Errorf("PDB minAvailable expected: %v actual: %v", 2, pdb.Spec.MinAvailable)
+	}
+	// the PDB annotations are not parsed as metrics
+	if err := c.Get(ctx, key, &v2beta2.HorizontalPodAutoscaler{}); err != nil {
+		t.Errorf("HPA should be created: %v", err)
+	}
+
+	actual := &appsv1.StatefulSet{}
+	if err := c.Get(ctx, key, actual); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var status workloadStatus
+	if err := json.Unmarshal([]byte(actual.Annotations[handler.keys.pdbStatus]), &status); err != nil {
+		t.Fatalf("PDB status annotation is invalid: %v", err)
+	}
+	if expected := (workloadStatus{Phase: phaseActive, PDB: "test"}); status != expected {
+		t.Errorf("PDB status expected: %+v actual: %+v", expected, status)
+	}
+
+	// the PDB is updated along with its annotations
+	actual.Annotations["pdb.hpa.autoscaling.banzaicloud.io/minAvailable"] = "50%"
+	err = handler.HandleReplicaSet(ctx, statefulSet.UID, statefulSet.Name, statefulSet.Namespace,
+		"StatefulSet", "apps/v1", actual.Annotations, nil, selector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, key, pdb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pdb.Spec.MinAvailable == nil || pdb.Spec.MinAvailable.String() != "50%" {
+		t.Errorf("PDB minAvailable expected: %v actual: %v", "50%", pdb.Spec.MinAvailable)
+	}
+
+	// and deleted along with them
+	actual = &appsv1.StatefulSet{}
+	if err := c.Get(ctx, key, actual); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(actual.Annotations, "pdb.hpa.autoscaling.banzaicloud.io/minAvailable")
+	err = handler.HandleReplicaSet(ctx, statefulSet.UID, statefulSet.Name, statefulSet.Namespace,
+		"StatefulSet", "apps/v1", actual.Annotations, nil, selector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, key, pdb); err == nil {
+		t.Errorf("PDB should be deleted: %v", pdb)
+	}
+	actual = &appsv1.StatefulSet{}
+	if err := c.Get(ctx, key, actual); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if value, ok := actual.Annotations[handler.keys.pdbStatus]; ok {
+		t.Errorf("PDB status annotation should be removed: %v", value)
+	}
+}
@@ -0,0 +1,204 @@
+package stub
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// presetAnnotationPrefix is the sub-domain of the preset annotations, e.g.
+// preset.http-rps.hpa.autoscaling.banzaicloud.io/targetAverageValue
+const presetAnnotationPrefix = "preset"
+
+// presetNameRegExp matches the preset names, they are turned into the letters only metric names
+var presetNameRegExp = regexp.MustCompile("^[a-z]+(-[a-z]+)*$")
+
+// presetParamRegExp matches the param names, they are the fields of annotation keys
+var presetParamRegExp = regexp.MustCompile("^[a-zA-Z]+$")
+
+// MetricPreset is a prometheus metric configured by its name, its target and its params, e.g.
+//
+//	preset.kafka-lag.hpa.autoscaling.banzaicloud.io/consumerGroup: "orders"
+//	preset.kafka-lag.hpa.autoscaling.banzaicloud.io/targetAverageValue: "1000"
+type MetricPreset struct {
+	// Description tells what the preset measures and which params it reads
+	Description string `json:"description,omitempty"`
+	// Query is the template of the prometheus query. Besides the variables of the query templates,
+	// the fields of the preset annotations other than the targets are available as .Params.
+	Query string `json:"query"`
+	// Required are the params the preset annotations have to set
+	Required []string `json:"required,omitempty"`
+}
+
+// builtinMetricPresets are available unless a preset of the same name is configured
+var builtinMetricPresets = map[string]MetricPreset{
+	"http-rps": {
+		Description: "Requests per second served by the nginx ingress controller for the Ingress named by the ingress param, the workload name by default",
+		Query:       `sum(rate(nginx_ingress_controller_requests{namespace="{{.Namespace}}",ingress="{{or .Params.ingress .Name}}"}[1m]))`,
+	},
+	"kafka-lag": {
+		Description: "Lag of the Kafka consumer group named by the consumerGroup param, optionally restricted to the topic param, as exported by kafka_exporter",
+		Query:       `sum(kafka_consumergroup_lag{consumergroup="{{.Params.consumerGroup}}"{{with .Params.topic}},topic="{{.}}"{{end}}})`,
+		Required:    []string{"consumerGroup"},
+	},
+	"http-latency": {
+		Description: "Quantile of the request latency of the pods of the workload, set by the quantile param, 0.95 by default, read from the histogram named by the histogram param, http_request_duration_seconds by default",
+		Query:       `histogram_quantile({{or .Params.quantile "0.95"}}, sum by (le) (rate({{or .Params.histogram "http_request_duration_seconds"}}_bucket{namespace="{{.Namespace}}",{{.Selector}}}[5m])))`,
+	},
+}
+
+// LoadMetricPresets reads a YAML document of presets by name from file
+func LoadMetricPresets(file string) (map[string]MetricPreset, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	presets := make(map[string]MetricPreset)
+	if err := yaml.UnmarshalStrict(data, &presets); err != nil {
+		return nil, fmt.Errorf("metric presets %s are invalid: %v", file, err)
+	}
+	return presets, nil
+}
+
+// metricPresets returns the built-in presets, replaced and extended by the configured ones
+func (o Options) metricPresets() (map[string]*template.Template, map[string]MetricPreset, error) {
+	presets := make(map[string]MetricPreset, len(builtinMetricPresets)+len(o.MetricPresets))
+	for name, preset := range builtinMetricPresets {
+		presets[name] = preset
+	}
+	for name, preset := range o.MetricPresets {
+		presets[name] = preset
+	}
+	templates := make(map[string]*template.Template, len(presets))
+	for name, preset := range presets {
+		if !presetNameRegExp.MatchString(name) {
+			return nil, nil, fmt.Errorf("metric preset name %q is invalid, it should contain lower case letters separated by dashes", name)
+		}
+		if preset.Query == "" {
+			return nil, nil, fmt.Errorf("metric preset %s: query is missing", name)
+		}
+		for _, param := range preset.Required {
+			if !presetParamRegExp.MatchString(param) {
+				return nil, nil, fmt.Errorf("metric preset %s: param name %q should contain letters only", name, param)
+			}
+		}
+		t, err := template.New(name).Option("missingkey=zero").Parse(preset.Query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("metric preset %s: query is invalid: %v", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, presets, nil
+}
+
+// presetMetricName returns the name of the prometheus metric of a preset, e.g. presetHttpRps for http-rps
+func presetMetricName(presetName string) string {
+	name := presetAnnotationPrefix
+	for _, word := range strings.Split(presetName, "-") {
+		name += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return name
+}
+
+// presetTemplateData is the data the preset queries are executed with
+type presetTemplateData struct {
+	*queryTemplateData
+	// Params are the fields of the preset annotations other than the targets
+	Params map[string]string
+}
+
+// expandPresets replaces the preset annotations by the annotations of the prometheus metrics of the
+// presets, named by presetMetricName. The query of a preset is expanded with data and the params of
+// its annotations. The annotations of unknown or invalid presets are dropped and reported.
+func (h *HPAHandler) expandPresets(annotations map[string]string, data *queryTemplateData) (map[string]string, []error) {
+	domainPrefix := presetAnnotationPrefix + annotationSubDomainSeparator
+	domainSuffix := annotationSubDomainSeparator + h.keys.prefix
+	expanded := make(map[string]string, len(annotations))
+	fields := make(map[string]map[string]string)
+	for key, value := range annotations {
+		parts := strings.Split(key, annotationDomainSeparator)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], domainPrefix) || !strings.HasSuffix(parts[0], domainSuffix) {
+			expanded[key] = value
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(parts[0], domainPrefix), domainSuffix)
+		if fields[name] == nil {
+			fields[name] = make(map[string]string)
+		}
+		fields[name][parts[1]] = value
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		t, ok := h.presetTemplates[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("metric preset %s is not defined, it should be one of %s", name, strings.Join(h.presetNames(), ", ")))
+			continue
+		}
+		metricName := presetMetricName(name)
+		if h.hasPrometheusMetric(annotations, metricName) {
+			errs = append(errs, fmt.Errorf("metric preset %s conflicts with the prometheus metric %s", name, metricName))
+			continue
+		}
+		params := make(map[string]string)
+		for field, value := range fields[name] {
+			if field != targetValue && field != targetAverageValue {
+				params[field] = value
+			}
+		}
+		missing := false
+		for _, param := range h.presets[name].Required {
+			if params[param] == "" {
+				errs = append(errs, fmt.Errorf("%s is missing for metric preset: %s", param, name))
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+		var query bytes.Buffer
+		if err := t.Execute(&query, &presetTemplateData{queryTemplateData: data, Params: params}); err != nil {
+			errs = append(errs, fmt.Errorf("query template is invalid in metric preset: %s (%v)", name, err))
+			continue
+		}
+		expanded[h.keys.prometheus(metricName, "query")] = query.String()
+		for _, field := range []string{targetValue, targetAverageValue} {
+			if value, ok := fields[name][field]; ok {
+				expanded[h.keys.prometheus(metricName, field)] = value
+			}
+		}
+	}
+	return expanded, errs
+}
+
+// hasPrometheusMetric returns whether annotations configure the prometheus metric named metricName
+func (h *HPAHandler) hasPrometheusMetric(annotations map[string]string, metricName string) bool {
+	prefix := h.keys.prometheus(metricName, "")
+	for key := range annotations {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// presetNames returns the names of the presets in alphabetical order
+func (h *HPAHandler) presetNames() []string {
+	names := make([]string, 0, len(h.presets))
+	for name := range h.presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,190 @@
+package stub
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpandPresets(t *testing.T) {
+
+	handler, err := NewHandler(nil, nil, Options{MetricPresets: map[string]MetricPreset{
+		"queue-length": {Query: `sum(queue_length{queue="{{.Params.queue}}"})`, Required: []string{"queue"}},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data := newQueryTemplateData("shop", "default", "Deployment", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}})
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]string
+		expectedErr []string
+	}{
+		{
+			name: "http-rps",
+			annotations: map[string]string{
+				"preset.http-rps.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+			},
+			expected: map[string]string{
+				"prometheus.presetHttpRps.hpa.autoscaling.banzaicloud.io/query":              `sum(rate(nginx_ingress_controller_requests{namespace="default",ingress="shop"}[1m]))`,
+				"prometheus.presetHttpRps.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+			},
+		},
+		{
+			name: "kafka-lag with params",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                    "1",
+				"preset.kafka-lag.hpa.autoscaling.banzaicloud.io/consumerGroup": "orders",
+				"preset.kafka-lag.hpa.autoscaling.banzaicloud.io/topic":         "created",
+				"preset.kafka-lag.hpa.autoscaling.banzaicloud.io/targetValue":   "1000",
+			},
+			expected: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                           "1",
+				"prometheus.presetKafkaLag.hpa.autoscaling.banzaicloud.io/query":       `sum(kafka_consumergroup_lag{consumergroup="orders",topic="created"})`,
+				"prometheus.presetKafkaLag.hpa.autoscaling.banzaicloud.io/targetValue": "1000",
+			},
+		},
+		{
+			name: "http-latency",
+			annotations: map[string]string{
+				"preset.http-latency.hpa.autoscaling.banzaicloud.io/quantile":    "0.99",
+				"preset.http-latency.hpa.autoscaling.banzaicloud.io/targetValue": "0.5",
+			},
+			expected: map[string]string{
+				"prometheus.presetHttpLatency.hpa.autoscaling.banzaicloud.io/query": `histogram_quantile(0.99, sum by (le) ` +
+					`(rate(http_request_duration_seconds_bucket{namespace="default",app="shop"}[5m])))`,
+				"prometheus.presetHttpLatency.hpa.autoscaling.banzaicloud.io/targetValue": "0.5",
+			},
+		},
+		{
+			name: "configured preset",
+			annotations: map[string]string{
+				"preset.queue-length.hpa.autoscaling.banzaicloud.io/queue":       "jobs",
+				"preset.queue-length.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+			},
+			expected: map[string]string{
+				"prometheus.presetQueueLength.hpa.autoscaling.banzaicloud.io/query":       `sum(queue_length{queue="jobs"})`,
+				"prometheus.presetQueueLength.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+			},
+		},
+		{
+			name: "invalid presets",
+			annotations: map[string]string{
+				"preset.grpc-rps.hpa.autoscaling.banzaicloud.io/targetValue":          "10",
+				"preset.kafka-lag.hpa.autoscaling.banzaicloud.io/targetValue":         "10",
+				"preset.http-rps.hpa.autoscaling.banzaicloud.io/targetValue":          "10",
+				"prometheus.presetHttpRps.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+			},
+			expected: map[string]string{
+				"prometheus.presetHttpRps.hpa.autoscaling.banzaicloud.io/targetValue": "10",
+			},
+			expectedErr: []string{
+				"metric preset grpc-rps is not defined, it should be one of http-latency, http-rps, kafka-lag, queue-length",
+				"metric preset http-rps conflicts with the prometheus metric presetHttpRps",
+				"consumerGroup is missing for metric preset: kafka-lag",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expanded, errs := handler.expandPresets(test.annotations, data)
+			if !reflect.DeepEqual(expanded, test.expected) {
+				t.Errorf("Annotations expected: %v actual: %v", test.expected, expanded)
+			}
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if !reflect.DeepEqual(messages, test.expectedErr) {
+				t.Errorf("Errors expected: %v actual: %v", test.expectedErr, messages)
+			}
+		})
+	}
+}
+
+func TestMetricPresetsOptions(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		presets     map[string]MetricPreset
+		expectedErr string
+	}{
+		{name: "invalid name", presets: map[string]MetricPreset{"p95": {Query: "sum(up)"}},
+			expectedErr: `metric preset name "p95" is invalid, it should contain lower case letters separated by dashes`},
+		{name: "missing query", presets: map[string]MetricPreset{"up": {}},
+			expectedErr: "metric preset up: query is missing"},
+		{name: "invalid param", presets: map[string]MetricPreset{"up": {Query: "sum(up)", Required: []string{"job-name"}}},
+			expectedErr: `metric preset up: param name "job-name" should contain letters only`},
+		{name: "invalid template", presets: map[string]MetricPreset{"up": {Query: `sum(up{job="{{.Params.job"})`}},
+			expectedErr: "metric preset up: query is invalid: template: up:1: "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Options{MetricPresets: test.presets}.Validate()
+			if err == nil || !strings.HasPrefix(err.Error(), test.expectedErr) {
+				t.Errorf("Error expected: %v actual: %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestMetricPresetAnnotations(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "presets")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "presets.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+http-rps:
+  description: Requests per second of the Service of the workload
+  query: sum(rate(http_requests_total{service="{{.Name}}"}[1m]))
+`), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	presets, err := LoadMetricPresets(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	handler, err := NewHandler(nil, nil, Options{MetricPresets: presets})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// configured presets replace the built-in ones
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                        "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                        "3",
+		"preset.http-rps.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+	}
+	hpa, err := handler.DesiredHorizontalPodAutoscaler(context.Background(), "", "shop", "default", "Deployment", "apps/v1", annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].External == nil {
+		t.Fatalf("External metric expected, actual: %v", hpa.Spec.Metrics)
+	}
+	expected := `sum(rate(http_requests_total{service="shop"}[1m]))`
+	if actual := hpa.Annotations[prometheusQueryMetricConfigAnnotation+"presetHttpRps"]; actual != expected {
+		t.Errorf("Query expected: %v actual: %v", expected, actual)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("http-rps:\n  queries: sum(up)\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := LoadMetricPresets(file); err == nil {
+		t.Errorf("Unknown fields should be reported")
+	}
+}
@@ -0,0 +1,247 @@
+package stub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// The metrics adapters serving the prometheus metrics of the HPAs
+const (
+	// MetricsAdapterKube is kube-metrics-adapter, which reads the queries from the HPA annotations. It's the default.
+	MetricsAdapterKube = "kube-metrics-adapter"
+	// MetricsAdapterPrometheus is prometheus-adapter, which reads the queries from the rules the
+	// operator writes into its ConfigMap
+	MetricsAdapterPrometheus = "prometheus-adapter"
+)
+
+// prometheusAdapterConfigKey is the key of the prometheus-adapter configuration in its ConfigMap
+const prometheusAdapterConfigKey = "config.yaml"
+
+// prometheusAdapterMetricPrefix starts the names of the external metrics the operator exposes
+// through prometheus-adapter, followed by the instance ID and a hash of the query
+const prometheusAdapterMetricPrefix = "hpa_query_"
+
+// prometheusAdapterHashLength is the number of hex digits of the query hash in the metric names
+const prometheusAdapterHashLength = 16
+
+// prometheusAdapterSeriesQuery discovers the series the rules are attached to. prometheus-adapter
+// only exposes the metrics of rules whose series query returns a series, the queries of the
+// annotations are arbitrary, so the rules are attached to the up series every Prometheus has.
+const prometheusAdapterSeriesQuery = "up"
+
+// prometheusAdapterMetricNamePrefix returns the prefix of the metric names of the operator instance
+func prometheusAdapterMetricNamePrefix(instanceID string) string {
+	if instanceID == "" {
+		return prometheusAdapterMetricPrefix
+	}
+	return prometheusAdapterMetricPrefix + instanceID + "_"
+}
+
+// prometheusAdapterMetricName returns the name query is exposed by. Workloads using the same
+// query share the name, and the rule.
+func prometheusAdapterMetricName(prefix string, query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return prefix + hex.EncodeToString(hash[:])[:prometheusAdapterHashLength]
+}
+
+// isPrometheusAdapterMetricName returns whether name was generated with prefix, the prefixes of
+// other instances are longer and are followed by the instance ID, which is not a hash
+func isPrometheusAdapterMetricName(prefix string, name string) bool {
+	if !strings.HasPrefix(name, prefix) || len(name) != len(prefix)+prometheusAdapterHashLength {
+		return false
+	}
+	_, err := hex.DecodeString(strings.TrimPrefix(name, prefix))
+	return err == nil
+}
+
+// pointAtPrometheusAdapter returns a copy of hpa with its prometheus metrics replaced by the
+// external metrics exposed by prometheus-adapter. The queries are kept in the HPA annotations,
+// the rules are generated from them.
+func pointAtPrometheusAdapter(hpa *v2beta2.HorizontalPodAutoscaler, prefix string) *v2beta2.HorizontalPodAutoscaler {
+	result := hpa.DeepCopy()
+	for i := range result.Spec.Metrics {
+		metric := &result.Spec.Metrics[i]
+		if metric.External == nil || metric.External.Metric.Name != prometheusQueryMetricName || metric.External.Metric.Selector == nil {
+			continue
+		}
+		queryName := metric.External.Metric.Selector.MatchLabels[prometheusQueryNameLabel]
+		query, ok := result.Annotations[prometheusQueryMetricConfigAnnotation+queryName]
+		if !ok {
+			continue
+		}
+		metric.External.Metric = v2beta2.MetricIdentifier{Name: prometheusAdapterMetricName(prefix, query)}
+	}
+	sortMetrics(result.Spec.Metrics)
+	return result
+}
+
+// prometheusAdapterQueries returns the queries of the prometheus-adapter metrics of hpa by metric name
+func prometheusAdapterQueries(hpa *v2beta2.HorizontalPodAutoscaler, prefix string) map[string]string {
+	names := make(map[string]bool)
+	for _, metric := range hpa.Spec.Metrics {
+		if metric.External != nil && isPrometheusAdapterMetricName(prefix, metric.External.Metric.Name) {
+			names[metric.External.Metric.Name] = true
+		}
+	}
+	queries := make(map[string]string)
+	for key, query := range hpa.Annotations {
+		if !strings.HasPrefix(key, prometheusQueryMetricConfigAnnotation) {
+			continue
+		}
+		if name := prometheusAdapterMetricName(prefix, query); names[name] {
+			queries[name] = query
+		}
+	}
+	return queries
+}
+
+// SyncPrometheusAdapterRules writes a prometheus-adapter external rule for each query used by the
+// HPAs of the handler into the prometheus-adapter ConfigMap. The rules of queries no HPA uses any
+// more are removed, the rest of the configuration, including the rules of other operator instances,
+// is kept. It does nothing unless the handler runs with prometheus-adapter.
+func (h *HPAHandler) SyncPrometheusAdapterRules(ctx context.Context) error {
+	h = h.snapshot()
+	if h.prometheusAdapterConfigMap == nil {
+		return nil
+	}
+	log := LoggerFromContext(ctx).WithValues("configMap", h.prometheusAdapterConfigMap.String())
+
+	hpas := &v2beta2.HorizontalPodAutoscalerList{}
+	if err := h.client.List(ctx, hpas); err != nil {
+		log.Error(err, "failed to list HorizontalPodAutoscalers")
+		return err
+	}
+	queries := make(map[string]string)
+	for i := range hpas.Items {
+		hpa := &hpas.Items[i]
+		// the shadow HPAs are named after their workload too
+		workloadName := strings.TrimSuffix(hpa.Name, shadowSuffix)
+		owned := isCreatedByHpaController(hpa, hpa.Name, "Deployment") || isCreatedByHpaController(hpa, hpa.Name, "StatefulSet") ||
+			isCreatedByHpaController(hpa, workloadName, "Deployment") || isCreatedByHpaController(hpa, workloadName, "StatefulSet")
+		if !owned || hpa.Labels[h.keys.instance] != h.instanceID {
+			continue
+		}
+		for name, query := range prometheusAdapterQueries(hpa, h.prometheusAdapterPrefix) {
+			queries[name] = query
+		}
+	}
+
+	// the ConfigMap is read as an unstructured object, bypassing the cache: caching it would
+	// watch every ConfigMap of the cluster
+	configMap := &unstructured.Unstructured{}
+	configMap.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	exists := true
+	if err := h.client.Get(ctx, *h.prometheusAdapterConfigMap, configMap); err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(err, "failed to get prometheus-adapter ConfigMap")
+			return err
+		}
+		exists = false
+		configMap.SetName(h.prometheusAdapterConfigMap.Name)
+		configMap.SetNamespace(h.prometheusAdapterConfigMap.Namespace)
+	}
+	current, _, _ := unstructured.NestedString(configMap.Object, "data", prometheusAdapterConfigKey)
+	config, err := h.prometheusAdapterConfig(current, queries)
+	if err != nil {
+		log.Error(err, "invalid prometheus-adapter configuration")
+		return err
+	}
+	if exists && config == current {
+		log.V(1).Info("prometheus-adapter rules are up to date", "rules", len(queries))
+		return nil
+	}
+	if err := unstructured.SetNestedField(configMap.Object, config, "data", prometheusAdapterConfigKey); err != nil {
+		return err
+	}
+
+	if exists {
+		err = h.client.Update(ctx, configMap)
+	} else {
+		err = h.client.Create(ctx, configMap)
+	}
+	if err != nil {
+		log.Error(err, "failed to write prometheus-adapter ConfigMap")
+		return err
+	}
+	log.Info("prometheus-adapter rules updated", "rules", len(queries))
+	return nil
+}
+
+// prometheusAdapterConfig returns the prometheus-adapter configuration current, with the external
+// rules of the handler replaced by the rules of queries. The result is current if the rules are
+// up to date, even if current isn't formatted the way it would be written.
+func (h *HPAHandler) prometheusAdapterConfig(current string, queries map[string]string) (string, error) {
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(current), &config); err != nil {
+		return "", fmt.Errorf("%s can't be parsed: %v", prometheusAdapterConfigKey, err)
+	}
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+
+	var rules []interface{}
+	currentRules, _ := config["externalRules"].([]interface{})
+	for _, rule := range currentRules {
+		name, _, _ := unstructured.NestedString(asObject(rule), "name", "as")
+		if !isPrometheusAdapterMetricName(h.prometheusAdapterPrefix, name) {
+			rules = append(rules, rule)
+		}
+	}
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules = append(rules, map[string]interface{}{
+			"seriesQuery":  prometheusAdapterSeriesQuery,
+			"resources":    map[string]interface{}{"namespaced": false},
+			"name":         map[string]interface{}{"as": name},
+			"metricsQuery": queries[name],
+		})
+	}
+	if len(rules) > 0 {
+		config["externalRules"] = rules
+	} else {
+		delete(config, "externalRules")
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	// the current configuration is kept as is if it's equal to the desired one
+	var reformatted interface{}
+	if err := yaml.Unmarshal([]byte(current), &reformatted); err == nil {
+		if currentData, err := yaml.Marshal(reformatted); err == nil && string(currentData) == string(data) {
+			return current, nil
+		}
+	}
+	return string(data), nil
+}
+
+// asObject returns value as a JSON object, or nil if it's not an object
+func asObject(value interface{}) map[string]interface{} {
+	object, _ := value.(map[string]interface{})
+	return object
+}
+
+// parseConfigMapName parses a namespace/name reference to a ConfigMap
+func parseConfigMapName(value string) (*types.NamespacedName, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("prometheus-adapter ConfigMap %q is invalid, it should be namespace/name", value)
+	}
+	return &types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
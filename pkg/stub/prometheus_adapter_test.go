@@ -0,0 +1,170 @@
+package stub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func TestPrometheusAdapterConfig(t *testing.T) {
+
+	handler := &HPAHandler{prometheusAdapterPrefix: prometheusAdapterMetricNamePrefix("")}
+	requests := prometheusAdapterMetricName(handler.prometheusAdapterPrefix, "sum(requests)")
+	stale := prometheusAdapterMetricName(handler.prometheusAdapterPrefix, "sum(stale)")
+	otherInstance := prometheusAdapterMetricName(prometheusAdapterMetricNamePrefix("other"), "sum(stale)")
+
+	current := `rules:
+- seriesQuery: http_requests_total
+externalRules:
+- seriesQuery: queue_length
+  name:
+    as: queue
+- seriesQuery: up
+  name:
+    as: ` + stale + `
+  metricsQuery: sum(stale)
+- seriesQuery: up
+  name:
+    as: ` + otherInstance + `
+  metricsQuery: sum(stale)
+`
+	config, err := handler.prometheusAdapterConfig(current, map[string]string{requests: "sum(requests)"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var parsed struct {
+		Rules         []map[string]interface{} `json:"rules"`
+		ExternalRules []struct {
+			Name struct {
+				As string `json:"as"`
+			} `json:"name"`
+			MetricsQuery string `json:"metricsQuery"`
+		} `json:"externalRules"`
+	}
+	if err := yaml.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(parsed.Rules) != 1 {
+		t.Errorf("Rules should be kept: %v", parsed.Rules)
+	}
+	var names []string
+	for _, rule := range parsed.ExternalRules {
+		names = append(names, rule.Name.As)
+	}
+	if expected := []string{"queue", otherInstance, requests}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("External rules expected: %v actual: %v", expected, names)
+	}
+
+	// up to date configurations are not rewritten
+	unchanged, err := handler.prometheusAdapterConfig(config, map[string]string{requests: "sum(requests)"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if unchanged != config {
+		t.Errorf("Configuration expected: %v actual: %v", config, unchanged)
+	}
+
+	if _, err := handler.prometheusAdapterConfig("rules: [", nil); err == nil {
+		t.Errorf("Invalid configuration should be reported")
+	}
+}
+
+func TestSyncPrometheusAdapterRules(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	queryAnnotations := func(query string) map[string]string {
+		return map[string]string{
+			"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+			"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+			"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              query,
+			"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+		}
+	}
+	deployments := []*appsv1.Deployment{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default", UID: "a", Annotations: queryAnnotations("sum(requests)")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "default", UID: "b", Annotations: queryAnnotations("sum(requests)")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "other", UID: "c", Annotations: queryAnnotations("sum(queue)")}},
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "adapter", Namespace: "monitoring"},
+		Data:       map[string]string{"config.yaml": "rules: []\n"},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployments[0], deployments[1], deployments[2], configMap)
+	handler, err := NewHandler(c, nil, Options{MetricsAdapter: MetricsAdapterPrometheus, PrometheusAdapterConfigMap: "monitoring/adapter"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, deployment := range deployments {
+		err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+			"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	hpa := &v2beta2.HorizontalPodAutoscaler{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "a", Namespace: "default"}, hpa); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	requests := prometheusAdapterMetricName(prometheusAdapterMetricPrefix, "sum(requests)")
+	queue := prometheusAdapterMetricName(prometheusAdapterMetricPrefix, "sum(queue)")
+	if metric := hpa.Spec.Metrics[0].External.Metric; metric.Name != requests || metric.Selector != nil {
+		t.Errorf("HPA metric expected: %v actual: %v", requests, metric)
+	}
+
+	externalRules := func() []string {
+		if err := handler.SyncPrometheusAdapterRules(ctx); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		actual := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "adapter", Namespace: "monitoring"}, actual); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var config struct {
+			ExternalRules []struct {
+				Name struct {
+					As string `json:"as"`
+				} `json:"name"`
+			} `json:"externalRules"`
+		}
+		if err := yaml.Unmarshal([]byte(actual.Data["config.yaml"]), &config); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var names []string
+		for _, rule := range config.ExternalRules {
+			names = append(names, rule.Name.As)
+		}
+		return names
+	}
+
+	expected := []string{requests, queue}
+	if requests > queue {
+		expected = []string{queue, requests}
+	}
+	if actual := externalRules(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("External rules expected: %v actual: %v", expected, actual)
+	}
+
+	// the rule of a query which isn't used any more is removed
+	err = handler.HandleReplicaSet(ctx, "c", "c", "other", "Deployment", "apps/v1", map[string]string{}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actual := externalRules(); !reflect.DeepEqual(actual, []string{requests}) {
+		t.Errorf("External rules expected: %v actual: %v", []string{requests}, actual)
+	}
+}
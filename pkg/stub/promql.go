@@ -0,0 +1,67 @@
+package stub
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// The prometheus queries are parsed by the PromQL parser of Prometheus, so invalid queries are
+// reported on the workload instead of failing in the metrics adapter.
+
+// promQLLabelPreservingFunctions return a series for each series of their vector argument
+var promQLLabelPreservingFunctions = map[string]bool{
+	"abs": true, "ceil": true, "clamp": true, "clamp_max": true, "clamp_min": true, "exp": true, "floor": true,
+	"ln": true, "log10": true, "log2": true, "round": true, "sgn": true, "sort": true, "sort_desc": true, "sqrt": true,
+	"timestamp": true,
+}
+
+// reducesToSingleSeries returns whether the result of expr has at most one series, e.g. an
+// aggregation without grouping, a scalar or an arithmetic of those
+func reducesToSingleSeries(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		return true
+	case *parser.AggregateExpr:
+		return len(e.Grouping) == 0 && !e.Without
+	case *parser.ParenExpr:
+		return reducesToSingleSeries(e.Expr)
+	case *parser.UnaryExpr:
+		return reducesToSingleSeries(e.Expr)
+	case *parser.BinaryExpr:
+		return reducesToSingleSeries(e.LHS) && reducesToSingleSeries(e.RHS)
+	case *parser.Call:
+		switch name := e.Func.Name; {
+		case name == "scalar" || name == "vector" || name == "time" || name == "pi" || name == "absent":
+			return true
+		case name == "histogram_quantile" && len(e.Args) == 2:
+			// the buckets of a single histogram are aggregated by le
+			buckets := e.Args[1]
+			for paren, ok := buckets.(*parser.ParenExpr); ok; paren, ok = buckets.(*parser.ParenExpr) {
+				buckets = paren.Expr
+			}
+			aggregation, ok := buckets.(*parser.AggregateExpr)
+			return ok && !aggregation.Without && len(aggregation.Grouping) == 1 && aggregation.Grouping[0] == "le"
+		case promQLLabelPreservingFunctions[name]:
+			for _, arg := range e.Args {
+				if _, ok := arg.(*parser.NumberLiteral); !ok {
+					return reducesToSingleSeries(arg)
+				}
+			}
+		}
+	}
+	return false
+}
+
+// validatePromQL parses query, which has to return a scalar or an instant vector, and returns
+// whether it reduces to a single series
+func validatePromQL(query string) (bool, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return false, err
+	}
+	if valueType := expr.Type(); valueType != parser.ValueTypeScalar && valueType != parser.ValueTypeVector {
+		return false, fmt.Errorf("query returns a %s, it should return a scalar or an instant vector", valueType)
+	}
+	return reducesToSingleSeries(expr), nil
+}
@@ -0,0 +1,97 @@
+package stub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestValidatePromQL(t *testing.T) {
+
+	tests := []struct {
+		query          string
+		expectedSingle bool
+		expectedErr    string
+	}{
+		{query: `sum({kubernetes_pod_name=~"^shop.*",__name__=~"http_requests_total"})`, expectedSingle: true},
+		{query: `sum(rate(http_requests_total{job="shop"}[5m])) / sum(rate(http_requests_total[5m] offset 1h))`, expectedSingle: true},
+		{query: `histogram_quantile(0.95, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))`, expectedSingle: true},
+		{query: `SUM(kafka_consumergroup_lag) WITHOUT () * 2`, expectedSingle: false},
+		{query: `max_over_time(sum(rate(requests[1m]))[10m:1m])`, expectedSingle: false},
+		{query: `scalar(sum(up)) + 1e3 - -0x1F ^ 2`, expectedSingle: true},
+		{query: `round(avg(queue_length), 0.5)`, expectedSingle: true},
+		{query: `vector(1) * on() group_left absent(up{job='shop'})`, expectedSingle: true},
+		{query: "sum(\n  rate(requests[1m]) # per second\n)", expectedSingle: true},
+		{query: `rate(http_requests_total[5m])`, expectedSingle: false},
+		{query: `sum by (pod) (up)`, expectedSingle: false},
+		{query: `http_requests_total > bool 10`, expectedSingle: false},
+		{query: `sum(up`, expectedErr: "1:7: parse error: unclosed left parenthesis"},
+		{query: `sum(up{job="shop})`, expectedErr: "1:12: parse error: unterminated quoted string"},
+		{query: `sum(up{job})`, expectedErr: "1:11: parse error: unexpected \"}\" in label matching, expected label matching operator"},
+		{query: `sum(rate(up[5x]))`, expectedErr: "1:13: parse error: bad duration syntax: \"5\""},
+		{query: `sum(rate(sum(up)[5m]))`, expectedErr: "1:17: parse error: ranges only allowed for vector selectors"},
+		{query: `summ(up)`, expectedErr: "1:1: parse error: unknown function with name \"summ\""},
+		{query: `topk(up)`, expectedErr: "1:1: parse error: wrong number of arguments for aggregate expression provided, expected 2, got 1"},
+		{query: `up{job=~"(shop"}`, expectedErr: "1:4: parse error: error parsing regexp: missing closing )"},
+		{query: `up or on() group_left up`, expectedErr: "1:1: parse error: no grouping allowed for \"or\" operation"},
+		{query: `up + bool 1`, expectedErr: "1:4: parse error: bool modifier can only be used on comparison operators"},
+		{query: `{}`, expectedErr: "1:1: parse error: vector selector must contain at least one non-empty matcher"},
+		{query: "sum(up)\n  sum(up)", expectedErr: "2:3: parse error: unexpected <aggr:sum>"},
+		{query: `sum(up) offset 5m`, expectedErr: "1:1: parse error: offset modifier must be preceded by an instant or range selector"},
+		// the modifiers of Prometheus 2.25 and 2.26 are newer than the parser
+		{query: `sum(rate(http_requests_total[5m] @ 1609746000))`, expectedErr: "1:34: parse error: unexpected character: '@'"},
+		{query: `sum(http_requests_total offset -5m)`, expectedErr: "1:32: parse error: unexpected <op:-> in offset, expected duration"},
+		{query: `rate(up[5m])[10m:1m]`, expectedErr: "query returns a matrix, it should return a scalar or an instant vector"},
+		{query: `"shop"`, expectedErr: "query returns a string, it should return a scalar or an instant vector"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			single, err := validatePromQL(test.query)
+			if test.expectedErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.expectedErr) {
+					t.Errorf("Error expected: %v actual: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if single != test.expectedSingle {
+				t.Errorf("Single series expected: %v actual: %v", test.expectedSingle, single)
+			}
+		})
+	}
+}
+
+func TestInvalidPromQLAnnotations(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              `rate(http_requests_total[1m])`,
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/query":               `sum(rate(http_requests_total[1m])`,
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/targetAverageValue":  "10",
+	}
+	recorder := record.NewFakeRecorder(10)
+	handler, err := NewHandler(nil, recorder, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hpa, err := handler.DesiredHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil, nil)
+	if hpa == nil || len(hpa.Spec.Metrics) != 1 {
+		t.Fatalf("HPA with the valid metric expected, actual: %v, %v", hpa, err)
+	}
+	expected := "query is invalid in custom metric: invalid (1:34: parse error: unclosed left parenthesis)"
+	if errs := err.(*InvalidAnnotationsError).Errors; len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("Errors expected: %v actual: %v", expected, errs)
+	}
+	expected = "Warning QueryNotAggregated The queries of the custom metrics may return more than one series, " +
+		"they should be aggregated, e.g. by sum(...): requests"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("Event expected: %v actual: %v", expected, event)
+	}
+}
@@ -0,0 +1,99 @@
+package stub
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// queryTemplateData is the data the query templates are executed with, e.g.
+//
+//	sum(rate(http_requests_total{namespace="{{.Namespace}}",{{.Selector}}}[1m]))
+type queryTemplateData struct {
+	// Name, Namespace and Kind identify the workload
+	Name      string
+	Namespace string
+	Kind      string
+	// Labels are the match labels of the workload's pod selector
+	Labels map[string]string
+	// Selector is the pod selector of the workload as PromQL label matchers, e.g. app="myapp"
+	Selector string
+}
+
+// invalidPrometheusLabelCharacters are replaced by underscores in label names, the way Prometheus
+// service discovery exposes the pod labels
+var invalidPrometheusLabelCharacters = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// newQueryTemplateData returns the template data of a workload, selector may be nil
+func newQueryTemplateData(name string, namespace string, kind string, selector *metav1.LabelSelector) *queryTemplateData {
+	data := &queryTemplateData{Name: name, Namespace: namespace, Kind: kind, Labels: map[string]string{}}
+	if selector == nil {
+		return data
+	}
+	var matchers []string
+	keys := make([]string, 0, len(selector.MatchLabels))
+	for key := range selector.MatchLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data.Labels[key] = selector.MatchLabels[key]
+		matchers = append(matchers, prometheusLabelName(key)+"="+strconv.Quote(selector.MatchLabels[key]))
+	}
+	for _, requirement := range selector.MatchExpressions {
+		values := make([]string, 0, len(requirement.Values))
+		for _, value := range requirement.Values {
+			values = append(values, regexp.QuoteMeta(value))
+		}
+		name := prometheusLabelName(requirement.Key)
+		switch requirement.Operator {
+		case metav1.LabelSelectorOpIn:
+			matchers = append(matchers, name+"=~"+strconv.Quote(strings.Join(values, "|")))
+		case metav1.LabelSelectorOpNotIn:
+			matchers = append(matchers, name+"!~"+strconv.Quote(strings.Join(values, "|")))
+		case metav1.LabelSelectorOpExists:
+			matchers = append(matchers, name+`=~".+"`)
+		case metav1.LabelSelectorOpDoesNotExist:
+			matchers = append(matchers, name+`=""`)
+		}
+	}
+	data.Selector = strings.Join(matchers, ",")
+	return data
+}
+
+// prometheusLabelName returns the Prometheus label name of a Kubernetes label key
+func prometheusLabelName(key string) string {
+	return invalidPrometheusLabelCharacters.ReplaceAllString(key, "_")
+}
+
+// expand executes query as a template. Queries without template actions are returned as they are,
+// unknown fields are errors.
+func (d *queryTemplateData) expand(query string) (string, error) {
+	if !strings.Contains(query, "{{") {
+		return query, nil
+	}
+	t, err := template.New("query").Option("missingkey=error").Parse(query)
+	if err != nil {
+		return "", err
+	}
+	var expanded bytes.Buffer
+	if err := t.Execute(&expanded, d); err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// expandQuery expands the query of a custom metric, the error names the metric
+func (d *queryTemplateData) expandQuery(metricName string, query string) (string, error) {
+	expanded, err := d.expand(query)
+	if err != nil {
+		return "", fmt.Errorf("query template is invalid in custom metric: %s (%v)", metricName, err)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,136 @@
+package stub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestQueryTemplate(t *testing.T) {
+
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{"app.kubernetes.io/name": "shop", "app": "shop"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "api.v1"}},
+			{Key: "canary", Operator: metav1.LabelSelectorOpDoesNotExist},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		selector    *metav1.LabelSelector
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "plain query",
+			query:    `sum({kubernetes_pod_name=~"^shop.*"})`,
+			expected: `sum({kubernetes_pod_name=~"^shop.*"})`,
+		},
+		{
+			name:     "workload",
+			query:    `sum({kubernetes_namespace="{{.Namespace}}",kubernetes_pod_name=~"^{{.Name}}.*"}) # {{.Kind}}`,
+			expected: `sum({kubernetes_namespace="default",kubernetes_pod_name=~"^shop.*"}) # Deployment`,
+		},
+		{
+			name:     "selector",
+			query:    `sum(rate(http_requests_total{ {{.Selector}} }[1m]))`,
+			selector: selector,
+			expected: `sum(rate(http_requests_total{ app="shop",app_kubernetes_io_name="shop",tier=~"web|api\\.v1",canary="" }[1m]))`,
+		},
+		{
+			name:     "labels",
+			query:    `sum(up{app="{{index .Labels "app.kubernetes.io/name"}}"})`,
+			selector: selector,
+			expected: `sum(up{app="shop"})`,
+		},
+		{
+			name:     "no selector",
+			query:    `sum(up{ {{.Selector}} })`,
+			expected: `sum(up{  })`,
+		},
+		{
+			name:        "unknown field",
+			query:       `sum(up{app="{{.App}}"})`,
+			expectedErr: "query template is invalid in custom metric: requests",
+		},
+		{
+			name:        "syntax error",
+			query:       `sum(up{app="{{.Name"})`,
+			expectedErr: "query template is invalid in custom metric: requests",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := newQueryTemplateData("shop", "default", "Deployment", test.selector)
+			actual, err := data.expandQuery("requests", test.query)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Errorf("Error expected: %v actual: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("Query expected: %v actual: %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestQueryTemplateAnnotations(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              `sum(rate(http_requests_total{ {{.Selector}} }[1m]))`,
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/query":               `sum(up{app="{{.App}}"})`,
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/targetAverageValue":  "10",
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}}
+	hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "shop", "default", "Deployment", "apps/v1", annotations, selector)
+	if hpa == nil {
+		t.Fatalf("HPA should be created: %v", err)
+	}
+	// the templating errors are reported per metric
+	errs := err.(*InvalidAnnotationsError).Errors
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "query template is invalid in custom metric: invalid") {
+		t.Errorf("Errors expected: %v actual: %v", "query template is invalid in custom metric: invalid", errs)
+	}
+	if len(hpa.Spec.Metrics) != 1 {
+		t.Errorf("Metrics expected: %v actual: %v", 1, hpa.Spec.Metrics)
+	}
+	expected := `sum(rate(http_requests_total{ app="shop" }[1m]))`
+	if actual := hpa.Annotations[prometheusQueryMetricConfigAnnotation+"requests"]; actual != expected {
+		t.Errorf("Query expected: %v actual: %v", expected, actual)
+	}
+
+	spec := map[string]string{"hpa.autoscaling.banzaicloud.io/spec": `
+version: v1
+maxReplicas: 3
+queries:
+  requests: sum(rate(http_requests_total{namespace="{{.Namespace}}"}[1m]))
+metrics:
+- type: External
+  external:
+    metric:
+      name: prometheus-query
+      selector: {matchLabels: {query-name: requests}}
+    target: {type: AverageValue, averageValue: "10"}
+`}
+	hpa, err = defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "shop", "default", "Deployment", "apps/v1", spec, selector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = `sum(rate(http_requests_total{namespace="default"}[1m]))`
+	if actual := hpa.Annotations[prometheusQueryMetricConfigAnnotation+"requests"]; actual != expected {
+		t.Errorf("Query expected: %v actual: %v", expected, actual)
+	}
+}
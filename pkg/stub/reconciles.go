@@ -0,0 +1,97 @@
+package stub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var lastSuccessfulReconcile = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "hpa_operator_last_successful_reconcile_timestamp_seconds",
+	Help: "Unix time of the last reconcile of a workload which succeeded.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(lastSuccessfulReconcile)
+}
+
+// reconcileResult is the outcome of the last reconcile of a workload
+type reconcileResult struct {
+	time time.Time
+	err  error
+}
+
+// reconcileTracker keeps the outcome of the last reconcile of the workloads, and the time of the
+// last one which succeeded
+type reconcileTracker struct {
+	mu          sync.RWMutex
+	results     map[string]reconcileResult
+	lastSuccess time.Time
+}
+
+func newReconcileTracker() *reconcileTracker {
+	return &reconcileTracker{results: make(map[string]reconcileResult)}
+}
+
+func reconcileKey(kind string, namespace string, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// record keeps the outcome of the reconcile of a workload. The workloads without autoscale
+// annotations aren't kept, unless their cleanup failed.
+func (t *reconcileTracker) record(kind string, namespace string, name string, autoscaled bool, err error) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	key := reconcileKey(kind, namespace, name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if autoscaled || err != nil {
+		t.results[key] = reconcileResult{time: now, err: err}
+	} else {
+		delete(t.results, key)
+	}
+	if err == nil {
+		t.lastSuccess = now
+		lastSuccessfulReconcile.Set(float64(now.Unix()))
+	}
+}
+
+func (t *reconcileTracker) forget(kind string, namespace string, name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.results, reconcileKey(kind, namespace, name))
+}
+
+func (t *reconcileTracker) get(kind string, namespace string, name string) (reconcileResult, bool) {
+	if t == nil {
+		return reconcileResult{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result, ok := t.results[reconcileKey(kind, namespace, name)]
+	return result, ok
+}
+
+// LastSuccessfulReconcile returns the time the handler last handled a workload without error,
+// the zero time if it never did
+func (h *HPAHandler) LastSuccessfulReconcile() time.Time {
+	if h.reconciles == nil {
+		return time.Time{}
+	}
+	h.reconciles.mu.RLock()
+	defer h.reconciles.mu.RUnlock()
+	return h.reconciles.lastSuccess
+}
+
+// ForgetWorkload drops the outcome of the last reconcile of a workload, which was deleted or left
+// the scope of the operator
+func (h *HPAHandler) ForgetWorkload(kind string, namespace string, name string) {
+	h.reconciles.forget(kind, namespace, name)
+}
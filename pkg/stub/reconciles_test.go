@@ -0,0 +1,40 @@
+package stub
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconcileTracker(t *testing.T) {
+
+	tracker := newReconcileTracker()
+	tracker.record("Deployment", "default", "shop", true, nil)
+	if _, ok := tracker.get("Deployment", "default", "shop"); !ok {
+		t.Errorf("The reconcile of an autoscaled workload should be kept")
+	}
+	lastSuccess := tracker.lastSuccess
+
+	tracker.record("Deployment", "default", "shop", false, errors.New("failed to delete HPA"))
+	if result, ok := tracker.get("Deployment", "default", "shop"); !ok || result.err == nil {
+		t.Errorf("The failed cleanup of a workload should be kept, actual: %v", result)
+	}
+	if tracker.lastSuccess != lastSuccess {
+		t.Errorf("A failed reconcile shouldn't change the last successful one")
+	}
+
+	tracker.lastSuccess = time.Time{}
+	tracker.record("Deployment", "default", "shop", false, nil)
+	if _, ok := tracker.get("Deployment", "default", "shop"); ok {
+		t.Errorf("The workloads without autoscale annotations shouldn't be kept")
+	}
+	if tracker.lastSuccess.IsZero() {
+		t.Errorf("The successful cleanup of a workload should be a successful reconcile")
+	}
+
+	tracker.record("StatefulSet", "default", "db", true, nil)
+	tracker.forget("StatefulSet", "default", "db")
+	if len(tracker.results) != 0 {
+		t.Errorf("No reconcile expected, actual: %v", tracker.results)
+	}
+}
@@ -0,0 +1,54 @@
+package stub
+
+import "fmt"
+
+// snapshot returns a copy of the handler which a concurrent Reload leaves alone. The exported
+// methods work on a snapshot, so a workload is handled with the same options from start to end.
+func (h *HPAHandler) snapshot() *HPAHandler {
+	if h.reload == nil {
+		return h
+	}
+	h.reload.RLock()
+	defer h.reload.RUnlock()
+	snapshot := *h
+	return &snapshot
+}
+
+// Reload replaces the options of the handler, the workloads being handled finish with the previous
+// ones. The instance ID and the metrics adapter can't be changed, the manager and its controllers
+// depend on them.
+func (h *HPAHandler) Reload(options Options) error {
+	current := h.snapshot()
+	if options.InstanceID != current.instanceID {
+		return fmt.Errorf("instance ID can't be changed from %q to %q", current.instanceID, options.InstanceID)
+	}
+	configMap, err := options.prometheusAdapterConfigMap()
+	if err != nil {
+		return err
+	}
+	if (configMap == nil) != (current.prometheusAdapterConfigMap == nil) ||
+		configMap != nil && *configMap != *current.prometheusAdapterConfigMap {
+		return fmt.Errorf("metrics adapter can't be changed")
+	}
+
+	client := current.client
+	if dryRun, ok := client.(dryRunClient); ok {
+		client = dryRun.Client
+	}
+	next, err := NewHandler(client, current.recorder, options)
+	if err != nil {
+		return err
+	}
+
+	h.reload.Lock()
+	defer h.reload.Unlock()
+	h.keys = next.keys
+	h.rewriteDeprecated = next.rewriteDeprecated
+	h.backends = next.backends
+	h.defaultBackend = next.defaultBackend
+	h.presets = next.presets
+	h.presetTemplates = next.presetTemplates
+	h.dryRun = next.dryRun
+	h.client = next.client
+	return nil
+}
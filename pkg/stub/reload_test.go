@@ -0,0 +1,54 @@
+package stub
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReload(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	handler, err := NewHandler(fake.NewFakeClientWithScheme(scheme), nil, Options{InstanceID: "canary"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	before := handler.snapshot()
+
+	err = handler.Reload(Options{InstanceID: "canary", AnnotationPrefix: "example.com", DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	after := handler.snapshot()
+	if after.keys.prefix != "example.com" {
+		t.Errorf("Prefix expected: example.com actual: %v", after.keys.prefix)
+	}
+	if _, ok := after.client.(dryRunClient); !ok || !after.dryRun {
+		t.Errorf("The reloaded handler should be in dry-run mode")
+	}
+	if before.keys.prefix == after.keys.prefix || before.dryRun {
+		t.Errorf("Reload shouldn't change a snapshot")
+	}
+
+	err = handler.Reload(Options{InstanceID: "canary"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := handler.snapshot().client.(dryRunClient); ok {
+		t.Errorf("The client shouldn't be wrapped after the dry-run mode is disabled")
+	}
+
+	expected := `instance ID can't be changed from "canary" to ""`
+	if err := handler.Reload(Options{}); err == nil || err.Error() != expected {
+		t.Errorf("Error expected: %v actual: %v", expected, err)
+	}
+	expected = "metrics adapter can't be changed"
+	err = handler.Reload(Options{InstanceID: "canary", MetricsAdapter: "prometheus-adapter",
+		PrometheusAdapterConfigMap: "monitoring/adapter-config"})
+	if err == nil || err.Error() != expected {
+		t.Errorf("Error expected: %v actual: %v", expected, err)
+	}
+}
@@ -0,0 +1,280 @@
+package stub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// shadowField flags a custom metric as a shadow metric, e.g.
+// prometheus.<metricName>.hpa.autoscaling.banzaicloud.io/shadow: "true"
+const shadowField = "shadow"
+
+// shadowSuffix is appended to the workload name to name the shadow HPA and its scale target
+const shadowSuffix = "-shadow"
+
+// shadowTargetImage is the image of the pod template of the shadow scale targets, their pods are never created
+const shadowTargetImage = "k8s.gcr.io/pause:3.1"
+
+// shadowAutoscaler is the shadow HPA generated from the shadow metrics of a workload. The shadow HPA
+// evaluates the metrics, so they show up in its status, without scaling the workload: it scales a
+// paused Deployment, which never creates pods. The HPA controller needs the ready pods of the target
+// to evaluate targetValue metrics, so only targetAverageValue ones can be shadow metrics.
+type shadowAutoscaler struct {
+	// hpa is nil if none of the shadow metrics is valid
+	hpa *v2beta2.HorizontalPodAutoscaler
+	// invalidErr lists the skipped shadow metrics
+	invalidErr error
+}
+
+// shadowHPAKind is the kind of the shadow HPAs
+type shadowHPAKind struct {
+	hpaBackend
+}
+
+func (shadowHPAKind) objectName(workloadName string) string {
+	return workloadName + shadowSuffix
+}
+
+// splitShadowMetrics moves the annotations of the custom metrics flagged by their shadow field out
+// of annotations, into the returned shadow annotations. The metrics with an invalid shadow field are
+// dropped and reported, as are the shadow Pods and targetValue metrics: the shadow scale target has
+// no pods, the HPA controller fails to evaluate them.
+func (k *annotationKeys) splitShadowMetrics(annotations map[string]string) (map[string]string, map[string]string, []error) {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	suffix := annotationSubDomainSeparator + k.prefix
+	// shadowDomains are the domains of the flagged metrics, false if the metric is dropped
+	shadowDomains := make(map[string]bool)
+	for _, key := range keys {
+		parts := strings.Split(key, annotationDomainSeparator)
+		if len(parts) != 2 || parts[1] != shadowField || !strings.HasSuffix(parts[0], suffix) {
+			continue
+		}
+		names := strings.SplitN(strings.TrimSuffix(parts[0], suffix), annotationSubDomainSeparator, 2)
+		if len(names) != 2 {
+			// not a custom metric, the key is reported by parseMetrics
+			continue
+		}
+		shadow, err := strconv.ParseBool(annotations[key])
+		_, valueTarget := annotations[parts[0]+annotationDomainSeparator+targetValue]
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s value is invalid: %s, it should be true or false", key, annotations[key]))
+			shadowDomains[parts[0]] = false
+		case shadow && names[0] == jsonPathAnnotationPrefix:
+			errs = append(errs, fmt.Errorf("%s is not supported by Pods metric: %s", shadowField, names[1]))
+			shadowDomains[parts[0]] = false
+		case shadow && valueTarget:
+			errs = append(errs, fmt.Errorf("%s is not supported by %s metric: %s, use %s", shadowField, targetValue, names[1], targetAverageValue))
+			shadowDomains[parts[0]] = false
+		case shadow:
+			shadowDomains[parts[0]] = true
+		}
+	}
+	if len(shadowDomains) == 0 {
+		return annotations, nil, errs
+	}
+
+	live := make(map[string]string, len(annotations))
+	var shadow map[string]string
+	for key, value := range annotations {
+		isShadow, ok := shadowDomains[strings.SplitN(key, annotationDomainSeparator, 2)[0]]
+		switch {
+		case !ok:
+			live[key] = value
+		case isShadow:
+			if shadow == nil {
+				shadow = make(map[string]string)
+			}
+			shadow[key] = value
+		}
+	}
+	return live, shadow, errs
+}
+
+// createShadowHorizontalPodAutoscaler generates the shadow HPA of the workload of hpa from the
+// annotations of its shadow metrics, with the replicas of hpa. It returns nil if there are no
+// shadow metrics.
+func (k *annotationKeys) createShadowHorizontalPodAutoscaler(hpa *v2beta2.HorizontalPodAutoscaler,
+	annotations map[string]string, data *queryTemplateData) *shadowAutoscaler {
+
+	if len(annotations) == 0 {
+		return nil
+	}
+	if hpa == nil {
+		err := fmt.Errorf("shadow metrics require valid autoscale annotations")
+		return &shadowAutoscaler{invalidErr: &InvalidAnnotationsError{Errors: []error{err}}}
+	}
+	name := hpa.Name + shadowSuffix
+	shadow := &v2beta2.HorizontalPodAutoscaler{
+		TypeMeta: hpa.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       hpa.Namespace,
+			OwnerReferences: hpa.OwnerReferences,
+		},
+		Spec: v2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: v2beta2.CrossVersionObjectReference{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       "Deployment",
+				Name:       name,
+			},
+			MinReplicas: hpa.Spec.MinReplicas,
+			MaxReplicas: hpa.Spec.MaxReplicas,
+		},
+	}
+	metrics, errs := k.parseMetrics(shadow, annotations, data)
+	result := &shadowAutoscaler{}
+	if len(errs) > 0 {
+		result.invalidErr = &InvalidAnnotationsError{Errors: errs}
+	}
+	if len(metrics) > 0 {
+		shadow.Spec.Metrics = metrics
+		result.hpa = shadow
+	}
+	return result
+}
+
+// newShadowTarget returns the scale target of the shadow HPA: a paused Deployment without replica
+// sets, so scaling it never creates pods. Its selector only matches its own pod template.
+func (k *annotationKeys) newShadowTarget(shadow *v2beta2.HorizontalPodAutoscaler, workloadName string, instanceID string) *appsv1.Deployment {
+	labels := map[string]string{k.shadowTarget: workloadName}
+	targetLabels := map[string]string{k.shadowTarget: workloadName}
+	if instanceID != "" {
+		targetLabels[k.instance] = instanceID
+	}
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Deployment",
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            shadow.Spec.ScaleTargetRef.Name,
+			Namespace:       shadow.Namespace,
+			Labels:          targetLabels,
+			OwnerReferences: shadow.OwnerReferences,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: shadow.Spec.MinReplicas,
+			Paused:   true,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "shadow", Image: shadowTargetImage}},
+				},
+			},
+		},
+	}
+}
+
+// IsShadowScaleTarget returns whether labels are the labels of the scale target of a shadow HPA.
+// The targets have no autoscale annotations, they don't need to be reconciled.
+func (h *HPAHandler) IsShadowScaleTarget(labels map[string]string) bool {
+	_, ok := labels[h.snapshot().keys.shadowTarget]
+	return ok
+}
+
+// handleShadowAutoscaler keeps the shadow HPA of the workload, and its scale target, in sync with
+// shadow. The returned status is nil if the workload has no shadow metrics. Like the PDB, the shadow
+// HPA is only looked up to be deleted if the status shows it was generated before.
+func (h *HPAHandler) handleShadowAutoscaler(
+	ctx context.Context,
+	name string, namespace string, kind string,
+	annotations map[string]string,
+	shadow *shadowAutoscaler) (*workloadStatus, error) {
+
+	if _, ok := annotations[h.keys.shadowStatus]; !ok && shadow == nil {
+		return nil, nil
+	}
+	log := LoggerFromContext(ctx).WithValues("shadow", name+shadowSuffix)
+	var desired runtime.Object
+	var target *appsv1.Deployment
+	var invalidErr error
+	if shadow != nil {
+		invalidErr = shadow.invalidErr
+		if invalidErr != nil {
+			log.Error(invalidErr, "invalid shadow metrics")
+		}
+		if shadow.hpa != nil {
+			if h.instanceID != "" {
+				shadow.hpa.Labels = map[string]string{h.keys.instance: h.instanceID}
+			}
+			desired, _ = hpaBackend{prometheusAdapterPrefix: h.prometheusAdapterPrefix}.fromHorizontalPodAutoscaler(shadow.hpa)
+			target = h.keys.newShadowTarget(shadow.hpa, name, h.instanceID)
+		}
+	}
+
+	owned, err := h.syncShadowTarget(ctx, name, namespace, kind, target)
+	if err != nil {
+		return &workloadStatus{Phase: phaseError, Error: err.Error()}, err
+	}
+	if !owned {
+		// the shadow HPA would scale the Deployment of someone else
+		if _, err := h.syncOwnedObject(ctx, shadowHPAKind{}, name, namespace, kind, nil, false, nil); err != nil {
+			return nil, err
+		}
+		err := fmt.Errorf("Deployment %s exists and is not the shadow scale target of this %s", target.Name, kind)
+		return &workloadStatus{Phase: phaseConflict, Error: err.Error()}, nil
+	}
+	return h.syncOwnedObject(ctx, shadowHPAKind{}, name, namespace, kind, desired, shadow != nil, invalidErr)
+}
+
+// syncShadowTarget creates target, the scale target of the shadow HPA, unless it exists, or deletes
+// the current one if target is nil. The target is never updated, its replicas are set by the shadow
+// HPA. It returns false if target is set and a Deployment of the same name isn't a target of the workload.
+func (h *HPAHandler) syncShadowTarget(ctx context.Context, name string, namespace string, kind string,
+	target *appsv1.Deployment) (bool, error) {
+
+	log := LoggerFromContext(ctx)
+	targetName := name + shadowSuffix
+	h.clearDryRun("Deployment", targetName, namespace)
+	current := &appsv1.Deployment{}
+	if err := h.client.Get(ctx, client.ObjectKey{Name: targetName, Namespace: namespace}, current); err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(err, "failed to get shadow scale target")
+			return false, err
+		}
+		if target == nil {
+			return true, nil
+		}
+		log.Info("shadow scale target doesn't exist, will be created")
+		h.reportDryRun(ctx, "Deployment", targetName, namespace, nil, target)
+		if err := h.client.Create(ctx, target); err != nil && !errors.IsAlreadyExists(err) {
+			log.Error(err, "failed to create shadow scale target")
+			return false, err
+		}
+		return true, nil
+	}
+
+	if !isCreatedByHpaController(current, name, kind) || current.Labels[h.keys.shadowTarget] != name ||
+		current.Labels[h.keys.instance] != h.instanceID {
+		return target == nil, nil
+	}
+	if target != nil {
+		return true, nil
+	}
+	log.Info("shadow scale target found, will be deleted")
+	h.reportDryRun(ctx, "Deployment", targetName, namespace, current, nil)
+	if err := h.client.Delete(ctx, current); err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "failed to delete shadow scale target")
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,240 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSplitShadowMetrics(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		annotations    map[string]string
+		expectedLive   map[string]string
+		expectedShadow map[string]string
+		expectedErr    []string
+	}{
+		{
+			name: "shadow prometheus metric",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(requests)",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow":             "true",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/query":               "sum(latency)",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/targetValue":         "1",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/shadow":              "false",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":           "70",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/queue":                         "jobs",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/region":                        "eu-west-1",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/targetAverageValue":            "30",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/shadow":                        "1",
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/unknown":            "x",
+				"prometheus.requestsTotal.hpa.autoscaling.banzaicloud.io/targetValue":   "5",
+			},
+			expectedLive: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                          "3",
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                          "1",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/query":             "sum(latency)",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/targetValue":       "1",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/shadow":            "false",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":         "70",
+				"prometheus.requestsTotal.hpa.autoscaling.banzaicloud.io/targetValue": "5",
+			},
+			expectedShadow: map[string]string{
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(requests)",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow":             "true",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/unknown":            "x",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/queue":                         "jobs",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/region":                        "eu-west-1",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/targetAverageValue":            "30",
+				"sqs.jobs.hpa.autoscaling.banzaicloud.io/shadow":                        "1",
+			},
+		},
+		{
+			name: "invalid shadow metrics",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                          "3",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":            "sum(requests)",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow":           "maybe",
+				"jsonpath.queue.hpa.autoscaling.banzaicloud.io/jsonKey":               "$.queue",
+				"jsonpath.queue.hpa.autoscaling.banzaicloud.io/shadow":                "true",
+				"jsonpath.queue.hpa.autoscaling.banzaicloud.io/targetAverageValue":    "5",
+				"cpu.hpa.autoscaling.banzaicloud.io/shadow":                           "true",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":         "70",
+				"prometheus.requestsTotal.hpa.autoscaling.banzaicloud.io/targetValue": "5",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/query":             "sum(latency)",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/targetValue":       "1",
+				"prometheus.latency.hpa.autoscaling.banzaicloud.io/shadow":            "true",
+			},
+			expectedLive: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                          "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/shadow":                           "true",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":         "70",
+				"prometheus.requestsTotal.hpa.autoscaling.banzaicloud.io/targetValue": "5",
+			},
+			expectedErr: []string{
+				"shadow is not supported by Pods metric: queue",
+				"shadow is not supported by targetValue metric: latency, use targetAverageValue",
+				"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow value is invalid: maybe, it should be true or false",
+			},
+		},
+		{
+			name: "no shadow metrics",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas": "3",
+			},
+			expectedLive: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/maxReplicas": "3",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			live, shadow, errs := defaultAnnotationKeys.splitShadowMetrics(test.annotations)
+			if !reflect.DeepEqual(live, test.expectedLive) {
+				t.Errorf("Live annotations expected: %v actual: %v", test.expectedLive, live)
+			}
+			if !reflect.DeepEqual(shadow, test.expectedShadow) {
+				t.Errorf("Shadow annotations expected: %v actual: %v", test.expectedShadow, shadow)
+			}
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if !reflect.DeepEqual(messages, test.expectedErr) {
+				t.Errorf("Errors expected: %v actual: %v", test.expectedErr, messages)
+			}
+		})
+	}
+}
+
+func TestDesiredShadowHorizontalPodAutoscaler(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "2",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "5",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":           "70",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              `sum(rate(http_requests_total{service="{{.Name}}"}[1m]))`,
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow":             "true",
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/targetAverageValue":  "10",
+		"prometheus.invalid.hpa.autoscaling.banzaicloud.io/shadow":              "true",
+	}
+	handler, err := NewHandler(nil, nil, Options{InstanceID: "canary"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hpa, shadow, _, err := handler.desiredHorizontalPodAutoscaler(context.Background(), "uid", "shop", "default", "Deployment", "apps/v1", annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].Resource == nil {
+		t.Errorf("Metrics expected: cpu actual: %v", hpa.Spec.Metrics)
+	}
+	if len(hpa.Annotations) != 0 {
+		t.Errorf("HPA annotations of the shadow metrics should be left out: %v", hpa.Annotations)
+	}
+	if shadow == nil || shadow.hpa == nil {
+		t.Fatalf("Shadow HPA expected, actual: %v", shadow)
+	}
+	expectedErr := "query is missing for custom metric: invalid"
+	if shadow.invalidErr == nil || shadow.invalidErr.Error() != expectedErr {
+		t.Errorf("Shadow error expected: %v actual: %v", expectedErr, shadow.invalidErr)
+	}
+	expectedTarget := v2beta2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "shop-shadow"}
+	if shadow.hpa.Name != "shop-shadow" || shadow.hpa.Spec.ScaleTargetRef != expectedTarget {
+		t.Errorf("Shadow HPA expected: shop-shadow scaling %v actual: %s scaling %v", expectedTarget, shadow.hpa.Name, shadow.hpa.Spec.ScaleTargetRef)
+	}
+	if *shadow.hpa.Spec.MinReplicas != 2 || shadow.hpa.Spec.MaxReplicas != 5 {
+		t.Errorf("Shadow replicas expected: 2-5 actual: %v-%v", *shadow.hpa.Spec.MinReplicas, shadow.hpa.Spec.MaxReplicas)
+	}
+	if len(shadow.hpa.Spec.Metrics) != 1 || shadow.hpa.Spec.Metrics[0].External == nil {
+		t.Errorf("Shadow metrics expected: requests actual: %v", shadow.hpa.Spec.Metrics)
+	}
+	expectedQuery := `sum(rate(http_requests_total{service="shop"}[1m]))`
+	if query := shadow.hpa.Annotations[prometheusQueryMetricConfigAnnotation+"requests"]; query != expectedQuery {
+		t.Errorf("Shadow query expected: %v actual: %v", expectedQuery, query)
+	}
+	if !reflect.DeepEqual(shadow.hpa.OwnerReferences, hpa.OwnerReferences) {
+		t.Errorf("Shadow owner expected: %v actual: %v", hpa.OwnerReferences, shadow.hpa.OwnerReferences)
+	}
+
+	// the invalid shadow metrics are reported along with the invalid metrics
+	_, err = handler.DesiredHorizontalPodAutoscaler(context.Background(), "uid", "shop", "default", "Deployment", "apps/v1", annotations, nil, nil)
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Error expected: %v actual: %v", expectedErr, err)
+	}
+}
+
+func TestHandleReplicaSetShadowConflict(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "3",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":           "70",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(rate(http_requests_total[1m]))",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "10",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/shadow":             "true",
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: annotations},
+	}
+	// a Deployment of someone else named like the shadow scale target
+	other := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-shadow", Namespace: "default"},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployment, other)
+	handler, err := NewHandler(c, nil, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shadowKey := client.ObjectKey{Name: "test-shadow", Namespace: "default"}
+	if err := c.Get(ctx, shadowKey, &v2beta2.HorizontalPodAutoscaler{}); err == nil {
+		t.Errorf("Shadow HPA should not be created")
+	}
+	if err := c.Get(ctx, shadowKey, other); err != nil || other.Spec.Paused {
+		t.Errorf("Deployment should be left alone: %v %v", err, other)
+	}
+
+	actual := &appsv1.Deployment{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var status workloadStatus
+	if err := json.Unmarshal([]byte(actual.Annotations[handler.keys.shadowStatus]), &status); err != nil {
+		t.Fatalf("Shadow status annotation is invalid: %v", err)
+	}
+	expected := workloadStatus{Phase: phaseConflict,
+		Error: "Deployment test-shadow exists and is not the shadow scale target of this Deployment"}
+	if status != expected {
+		t.Errorf("Shadow status expected: %+v actual: %+v", expected, status)
+	}
+	// the live HPA is created anyway
+	if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, &v2beta2.HorizontalPodAutoscaler{}); err != nil {
+		t.Errorf("HPA should be created: %v", err)
+	}
+}
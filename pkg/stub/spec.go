@@ -0,0 +1,230 @@
+package stub
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// specField is the field of the annotation holding the whole autoscaling spec as a YAML or JSON
+// document, e.g. hpa.autoscaling.banzaicloud.io/spec
+const specField = "spec"
+
+// specVersionV1 is the only version of the spec document so far
+const specVersionV1 = "v1"
+
+// autoscalingSpec is the document of the spec annotation, e.g.
+//
+//	version: v1
+//	minReplicas: 1
+//	maxReplicas: 10
+//	queries:
+//	  requests: sum(rate(http_requests_total[1m]))
+//	metrics:
+//	- type: Resource
+//	  resource:
+//	    name: cpu
+//	    target: {type: Utilization, averageUtilization: 70}
+//	- type: External
+//	  external:
+//	    metric:
+//	      name: prometheus-query
+//	      selector: {matchLabels: {query-name: requests}}
+//	    target: {type: AverageValue, averageValue: "100"}
+//
+// The metrics are autoscaling/v2beta2 metric specs. Queries are served by kube-metrics-adapter as
+// prometheus-query external metrics, selected by their name in the query-name label.
+type autoscalingSpec struct {
+	Version     string               `json:"version"`
+	MinReplicas *int32               `json:"minReplicas,omitempty"`
+	MaxReplicas int32                `json:"maxReplicas"`
+	Queries     map[string]string    `json:"queries,omitempty"`
+	Metrics     []v2beta2.MetricSpec `json:"metrics"`
+}
+
+// applySpec parses the spec annotation value into hpa. Unlike the dotted annotations, the spec is
+// validated strictly: any error rejects the whole document.
+func (k *annotationKeys) applySpec(hpa *v2beta2.HorizontalPodAutoscaler, value string, annotations map[string]string, data *queryTemplateData) []error {
+	specKey := k.field(specField)
+	var errs []error
+	for key := range annotations {
+		if key != specKey {
+			errs = append(errs, fmt.Errorf("%s can't be combined with %s", key, specKey))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	spec := autoscalingSpec{}
+	if err := yaml.UnmarshalStrict([]byte(value), &spec); err != nil {
+		return append(errs, fmt.Errorf("%s is invalid: %v", specKey, err))
+	}
+	if spec.Version != specVersionV1 {
+		return append(errs, fmt.Errorf("%s version %q is not supported, it should be %s", specKey, spec.Version, specVersionV1))
+	}
+
+	minReplicas := int32(1)
+	if spec.MinReplicas != nil {
+		minReplicas = *spec.MinReplicas
+	}
+	if minReplicas <= 0 {
+		errs = append(errs, fmt.Errorf("%s: minReplicas should be positive number", specKey))
+	}
+	if spec.MaxReplicas < minReplicas {
+		errs = append(errs, fmt.Errorf("%s: maxReplicas should be positive number, not less than minReplicas", specKey))
+	}
+	if len(spec.Metrics) == 0 {
+		errs = append(errs, fmt.Errorf("%s: metrics are missing", specKey))
+	}
+
+	usedQueries := make(map[string]bool)
+	for i, metric := range spec.Metrics {
+		if err := validateMetricSpec(metric); err != nil {
+			errs = append(errs, fmt.Errorf("%s: metric %d: %v", specKey, i, err))
+			continue
+		}
+		if metric.External == nil || metric.External.Metric.Name != prometheusQueryMetricName {
+			continue
+		}
+		queryName, err := prometheusQueryName(metric.External)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: metric %d: %v", specKey, i, err))
+			continue
+		}
+		if _, ok := spec.Queries[queryName]; !ok {
+			errs = append(errs, fmt.Errorf("%s: metric %d: query %s is missing from queries", specKey, i, queryName))
+		}
+		usedQueries[queryName] = true
+	}
+	queryNames := make([]string, 0, len(spec.Queries))
+	for queryName := range spec.Queries {
+		queryNames = append(queryNames, queryName)
+	}
+	sort.Strings(queryNames)
+	queries := make(map[string]string, len(spec.Queries))
+	for _, queryName := range queryNames {
+		if !usedQueries[queryName] {
+			errs = append(errs, fmt.Errorf("%s: query %s isn't used by any metric", specKey, queryName))
+		}
+		query, err := data.expandQuery(queryName, spec.Queries[queryName])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", specKey, err))
+			continue
+		}
+		if _, err := validatePromQL(query); err != nil {
+			errs = append(errs, fmt.Errorf("%s: query %s is invalid: %v", specKey, queryName, err))
+		}
+		queries[queryName] = query
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	hpa.Spec.MinReplicas = &minReplicas
+	hpa.Spec.MaxReplicas = spec.MaxReplicas
+	hpa.Spec.Metrics = spec.Metrics
+	sortMetrics(hpa.Spec.Metrics)
+	for _, queryName := range queryNames {
+		if hpa.Annotations == nil {
+			hpa.Annotations = make(map[string]string)
+		}
+		hpa.Annotations[prometheusQueryMetricConfigAnnotation+queryName] = queries[queryName]
+	}
+	return nil
+}
+
+// validateMetricSpec checks the parts of a metric the API server validates, so an invalid spec is
+// reported on the workload rather than failing the create or update of the HPA
+func validateMetricSpec(metric v2beta2.MetricSpec) error {
+	sources := 0
+	for _, set := range []bool{metric.Object != nil, metric.Pods != nil, metric.Resource != nil, metric.External != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one metric source should be set")
+	}
+
+	switch metric.Type {
+	case v2beta2.ObjectMetricSourceType:
+		if metric.Object == nil {
+			return fmt.Errorf("object should be set for %s metrics", metric.Type)
+		}
+		if metric.Object.DescribedObject.Kind == "" || metric.Object.DescribedObject.Name == "" {
+			return fmt.Errorf("describedObject kind and name are required")
+		}
+		if err := validateMetricIdentifier(metric.Object.Metric); err != nil {
+			return err
+		}
+		return validateMetricTarget(metric.Object.Target, v2beta2.ValueMetricType, v2beta2.AverageValueMetricType)
+	case v2beta2.PodsMetricSourceType:
+		if metric.Pods == nil {
+			return fmt.Errorf("pods should be set for %s metrics", metric.Type)
+		}
+		if err := validateMetricIdentifier(metric.Pods.Metric); err != nil {
+			return err
+		}
+		return validateMetricTarget(metric.Pods.Target, v2beta2.AverageValueMetricType)
+	case v2beta2.ResourceMetricSourceType:
+		if metric.Resource == nil {
+			return fmt.Errorf("resource should be set for %s metrics", metric.Type)
+		}
+		if metric.Resource.Name == "" {
+			return fmt.Errorf("resource name is required")
+		}
+		return validateMetricTarget(metric.Resource.Target, v2beta2.UtilizationMetricType, v2beta2.AverageValueMetricType)
+	case v2beta2.ExternalMetricSourceType:
+		if metric.External == nil {
+			return fmt.Errorf("external should be set for %s metrics", metric.Type)
+		}
+		if err := validateMetricIdentifier(metric.External.Metric); err != nil {
+			return err
+		}
+		return validateMetricTarget(metric.External.Target, v2beta2.ValueMetricType, v2beta2.AverageValueMetricType)
+	}
+	return fmt.Errorf("metric type %q is invalid", metric.Type)
+}
+
+func validateMetricIdentifier(identifier v2beta2.MetricIdentifier) error {
+	if identifier.Name == "" {
+		return fmt.Errorf("metric name is required")
+	}
+	if identifier.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(identifier.Selector); err != nil {
+			return fmt.Errorf("metric selector is invalid: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateMetricTarget checks that target is one of the allowed types and only sets its value
+func validateMetricTarget(target v2beta2.MetricTarget, allowed ...v2beta2.MetricTargetType) error {
+	typeAllowed := false
+	for _, targetType := range allowed {
+		typeAllowed = typeAllowed || target.Type == targetType
+	}
+	if !typeAllowed {
+		return fmt.Errorf("target type %q is invalid, it should be one of %v", target.Type, allowed)
+	}
+
+	setValues := 0
+	for _, set := range []bool{target.Value != nil, target.AverageValue != nil, target.AverageUtilization != nil} {
+		if set {
+			setValues++
+		}
+	}
+	switch {
+	case setValues != 1:
+		return fmt.Errorf("exactly one target value should be set")
+	case target.Type == v2beta2.ValueMetricType && (target.Value == nil || target.Value.Sign() <= 0):
+		return fmt.Errorf("target value should be positive")
+	case target.Type == v2beta2.AverageValueMetricType && (target.AverageValue == nil || target.AverageValue.Sign() <= 0):
+		return fmt.Errorf("target averageValue should be positive")
+	case target.Type == v2beta2.UtilizationMetricType && (target.AverageUtilization == nil || *target.AverageUtilization <= 0):
+		return fmt.Errorf("target averageUtilization should be positive")
+	}
+	return nil
+}
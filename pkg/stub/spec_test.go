@@ -0,0 +1,183 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSpecAnnotation(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expectedErr []string
+	}{
+		{
+			name: "yaml",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": `
+version: v1
+minReplicas: 2
+maxReplicas: 10
+queries:
+  requests: sum(rate(http_requests_total[1m]))
+metrics:
+- type: External
+  external:
+    metric:
+      name: prometheus-query
+      selector: {matchLabels: {query-name: requests}}
+    target: {type: AverageValue, averageValue: 100}
+- type: Resource
+  resource:
+    name: cpu
+    target: {type: Utilization, averageUtilization: 80}
+`,
+			},
+		},
+		{
+			name: "json",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": `{"version": "v1", "maxReplicas": 3, "metrics": [
+					{"type": "Pods", "pods": {"metric": {"name": "queue_length", "selector": {"matchExpressions": [
+						{"key": "queue", "operator": "In", "values": ["orders", "payments"]}]}},
+					"target": {"type": "AverageValue", "averageValue": "30"}}}]}`,
+			},
+		},
+		{
+			name: "unknown field",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": "version: v1\nmaxReplicas: 3\nmaxReplica: 4\nmetrics: []",
+			},
+			expectedErr: []string{`unknown field "maxReplica"`},
+		},
+		{
+			name: "missing version",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": "maxReplicas: 3",
+			},
+			expectedErr: []string{`version "" is not supported`},
+		},
+		{
+			name: "combined with annotations",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec":                         "version: v1\nmaxReplicas: 3\nmetrics: [{type: Resource, resource: {name: cpu, target: {type: Utilization, averageUtilization: 80}}}]",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+			},
+			expectedErr: []string{"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization can't be combined with hpa.autoscaling.banzaicloud.io/spec"},
+		},
+		{
+			name: "behavior",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": "version: v1\nmaxReplicas: 3\nmetrics: [{type: Resource, resource: {name: cpu, target: {type: Utilization, averageUtilization: 80}}}]\nbehavior: {scaleDown: {stabilizationWindowSeconds: 60}}",
+			},
+			expectedErr: []string{`unknown field "behavior"`},
+		},
+		{
+			name: "invalid metrics and queries",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/spec": `
+version: v1
+minReplicas: 5
+maxReplicas: 3
+queries:
+  unused: sum(up)
+metrics:
+- type: Resource
+  resource:
+    name: cpu
+    target: {type: Value, value: 1}
+- type: External
+  external:
+    metric:
+      name: prometheus-query
+      selector: {matchLabels: {query-name: missing}}
+    target: {type: Value, value: 1}
+- type: Pods
+  resource:
+    name: cpu
+    target: {type: Utilization, averageUtilization: 80}
+`,
+			},
+			expectedErr: []string{
+				"maxReplicas should be positive number, not less than minReplicas",
+				`metric 0: target type "Value" is invalid`,
+				"metric 1: query missing is missing from queries",
+				"metric 2: pods should be set for Pods metrics",
+				"query unused isn't used by any metric",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", test.annotations, nil)
+			if len(test.expectedErr) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if len(hpa.Spec.Metrics) == 0 || hpa.Spec.MaxReplicas == 0 {
+					t.Errorf("HPA is incomplete: %v", hpa.Spec)
+				}
+				return
+			}
+			if hpa != nil {
+				t.Errorf("HPA should not be generated from an invalid spec: %v", hpa)
+			}
+			if err == nil {
+				t.Fatalf("Error expected: %v", test.expectedErr)
+			}
+			for _, expected := range test.expectedErr {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Error expected: %v actual: %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSpecAnnotationMatchesAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                            "2",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                            "10",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization":           "80",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/query":              "sum(rate(http_requests_total[1m]))",
+		"prometheus.requests.hpa.autoscaling.banzaicloud.io/targetAverageValue": "100",
+	}
+	spec := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/spec": `
+version: v1
+minReplicas: 2
+maxReplicas: 10
+queries:
+  requests: sum(rate(http_requests_total[1m]))
+metrics:
+- type: External
+  external:
+    metric:
+      name: prometheus-query
+      selector: {matchLabels: {query-name: requests}}
+    target: {type: AverageValue, averageValue: "100"}
+- type: Resource
+  resource:
+    name: cpu
+    target: {type: Utilization, averageUtilization: 80}
+`,
+	}
+
+	expected, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", annotations, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	actual, err := defaultAnnotationKeys.createHorizontalPodAutoscaler(context.Background(), "", "test", "default", "Deployment", "apps/v1", spec, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedJSON, _ := json.Marshal(expected)
+	actualJSON, _ := json.Marshal(actual)
+	if string(expectedJSON) != string(actualJSON) {
+		t.Errorf("HPA expected: %s actual: %s", expectedJSON, actualJSON)
+	}
+}
@@ -0,0 +1,92 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// phaseActive means the HPA, or VPA, is in sync with the autoscale annotations
+	phaseActive = "Active"
+	// phaseInvalid means the autoscale annotations can't be turned into an HPA, or VPA
+	phaseInvalid = "Invalid"
+	// phaseConflict means an HPA, or VPA, with the same name exists which isn't owned by the workload
+	phaseConflict = "Conflict"
+	// phaseError means the HPA, or VPA, couldn't be written to the API server
+	phaseError = "Error"
+)
+
+// workloadStatus is the value of the status annotation of a workload. It has no observed
+// generation on purpose: the API server bumps the generation of a Deployment when its annotations
+// change, so writing the generation it was computed for would bump it again and never settle.
+type workloadStatus struct {
+	Phase        string `json:"phase"`
+	HPA          string `json:"hpa,omitempty"`
+	VPA          string `json:"vpa,omitempty"`
+	ScaledObject string `json:"scaledObject,omitempty"`
+	PDB          string `json:"pdb,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// updateStatus patches the status annotation key of the workload, or removes it if status is nil.
+// Nothing is written when the annotation is already up to date, so the patch doesn't
+// trigger another reconcile.
+func (h *HPAHandler) updateStatus(
+	ctx context.Context,
+	key string,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, status *workloadStatus) error {
+
+	current, found := annotations[key]
+
+	var value interface{}
+	if status != nil {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if found && current == string(data) {
+			return nil
+		}
+		value = string(data)
+	} else if !found {
+		return nil
+	}
+
+	log := LoggerFromContext(ctx)
+	if err := h.patchAnnotations(ctx, name, namespace, kind, apiVersion, map[string]interface{}{key: value}); err != nil {
+		log.Error(err, "failed to update status annotation", "annotation", key)
+		return err
+	}
+	log.V(1).Info("status annotation updated", "annotation", key, "status", value)
+	return nil
+}
+
+// patchAnnotations sets the annotations of the workload by a merge patch, nil values remove the annotation
+func (h *HPAHandler) patchAnnotations(
+	ctx context.Context,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]interface{}) error {
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	workload := &unstructured.Unstructured{}
+	workload.SetAPIVersion(apiVersion)
+	workload.SetKind(kind)
+	workload.SetName(name)
+	workload.SetNamespace(namespace)
+	return h.client.Patch(ctx, workload, client.ConstantPatch(types.MergePatchType, patch))
+}
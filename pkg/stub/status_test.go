@@ -0,0 +1,130 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHandleReplicaSetWritesStatus(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		expectedPhase string
+	}{
+		{
+			name: "active",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+			},
+			expectedPhase: phaseActive,
+		},
+		{
+			name: "invalid",
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas": "1",
+			},
+			expectedPhase: phaseInvalid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test",
+					Namespace:   "default",
+					Annotations: test.annotations,
+				},
+			}
+			c := fake.NewFakeClientWithScheme(scheme, deployment)
+			handler, err := NewHandler(c, nil, Options{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			actual := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var status workloadStatus
+			if err := json.Unmarshal([]byte(actual.Annotations[handler.keys.status]), &status); err != nil {
+				t.Fatalf("Status annotation is invalid: %v", err)
+			}
+			if status.Phase != test.expectedPhase {
+				t.Errorf("Phase expected: %v actual: %v", test.expectedPhase, status.Phase)
+			}
+			if test.expectedPhase == phaseInvalid && status.Error == "" {
+				t.Errorf("Error is missing from status")
+			}
+
+			hpa := &v2beta2.HorizontalPodAutoscaler{}
+			err = c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, hpa)
+			if (err == nil) != (test.expectedPhase == phaseActive) {
+				t.Errorf("HPA existence doesn't match phase %v: %v", test.expectedPhase, err)
+			}
+		})
+	}
+}
+
+func TestHandleReplicaSetRewritesOutdatedStatus(t *testing.T) {
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "70",
+				// written by a previous version of the operator
+				"autoscaling.banzaicloud.io/hpa-status": `{"phase":"Active","hpa":"test","observedGeneration":1}`,
+			},
+		},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployment)
+	handler, err := NewHandler(c, nil, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+		"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	actual := &appsv1.Deployment{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `{"phase":"Active","hpa":"test"}`
+	if status := actual.Annotations[handler.keys.status]; status != expected {
+		t.Errorf("Status expected: %v actual: %v", expected, status)
+	}
+}
@@ -0,0 +1,407 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const vpaAnnotationPrefix = "vpa"
+
+// The fields of the VPA annotations. updateMode is set for the whole workload, e.g.
+// vpa.autoscaling.banzaicloud.io/updateMode, the others either for every container or for a single
+// one, e.g. vpa.autoscaling.banzaicloud.io/maxAllowed or app.vpa.autoscaling.banzaicloud.io/maxAllowed.
+const (
+	vpaUpdateMode          = "updateMode"
+	vpaControlledResources = "controlledResources"
+	vpaMinAllowed          = "minAllowed"
+	vpaMaxAllowed          = "maxAllowed"
+)
+
+// The supported VPA update modes, the ones which never evict pods. Off only computes
+// recommendations, Initial applies them when the pods are created.
+const (
+	vpaUpdateModeOff     = "Off"
+	vpaUpdateModeInitial = "Initial"
+)
+
+// vpaAllContainers is the container name of the policy applying to the containers without a policy of their own
+const vpaAllContainers = "*"
+
+// vpaGroupVersionKind is the kind of the generated VPAs. The operator has no Go types for the VPA,
+// it writes unstructured objects which are mapped to the API when they are written, so it runs
+// on clusters without the VPA CRD and picks it up once it's installed.
+var vpaGroupVersionKind = schema.GroupVersionKind{Group: "autoscaling.k8s.io", Version: "v1", Kind: "VerticalPodAutoscaler"}
+
+// vpaResources are the resources a VPA can control, it controls both by default
+var vpaResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+type verticalPodAutoscalerSpec struct {
+	TargetRef      autoscalingv1.CrossVersionObjectReference `json:"targetRef"`
+	UpdatePolicy   vpaUpdatePolicy                           `json:"updatePolicy"`
+	ResourcePolicy *vpaResourcePolicy                        `json:"resourcePolicy,omitempty"`
+}
+
+type vpaUpdatePolicy struct {
+	UpdateMode string `json:"updateMode"`
+}
+
+type vpaResourcePolicy struct {
+	ContainerPolicies []vpaContainerPolicy `json:"containerPolicies"`
+}
+
+type vpaContainerPolicy struct {
+	ContainerName       string                `json:"containerName"`
+	ControlledResources []corev1.ResourceName `json:"controlledResources,omitempty"`
+	MinAllowed          corev1.ResourceList   `json:"minAllowed,omitempty"`
+	MaxAllowed          corev1.ResourceList   `json:"maxAllowed,omitempty"`
+}
+
+// controls returns whether the policy controls resourceName
+func (p *vpaContainerPolicy) controls(resourceName corev1.ResourceName) bool {
+	if len(p.ControlledResources) == 0 {
+		return true
+	}
+	for _, controlled := range p.ControlledResources {
+		if controlled == resourceName {
+			return true
+		}
+	}
+	return false
+}
+
+// isVPAAnnotation returns whether key is a VPA annotation of the workload or of one of its containers
+func (k *annotationKeys) isVPAAnnotation(key string) bool {
+	domain := strings.SplitN(key, annotationDomainSeparator, 2)[0]
+	return domain == k.vpaPrefix || strings.HasSuffix(domain, annotationSubDomainSeparator+k.vpaPrefix)
+}
+
+func (h *HPAHandler) filterVPAAnnotations(annotations map[string]string) map[string]string {
+	vpaAnnotations := make(map[string]string)
+	for key, value := range annotations {
+		if h.keys.isVPAAnnotation(key) {
+			vpaAnnotations[key] = value
+		}
+	}
+	return vpaAnnotations
+}
+
+// createVerticalPodAutoscaler generates the VPA of a workload from its VPA annotations. The VPA is
+// refused in Initial mode if it controls a resource hpa scales on: the requests set by the VPA
+// would shift the utilization the HPA targets. The annotations are validated strictly, any error
+// rejects the whole VPA.
+func (k *annotationKeys) createVerticalPodAutoscaler(UID types.UID, name string, namespace string, kind string, apiVersion string, annotations map[string]string, hpa *v2beta2.HorizontalPodAutoscaler) (*unstructured.Unstructured, error) {
+
+	var errs []error
+	updateMode := vpaUpdateModeOff
+	policies := make(map[string]*vpaContainerPolicy)
+	policy := func(containerName string) *vpaContainerPolicy {
+		if _, ok := policies[containerName]; !ok {
+			policies[containerName] = &vpaContainerPolicy{ContainerName: containerName}
+		}
+		return policies[containerName]
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := annotations[key]
+		domainAndField := strings.SplitN(key, annotationDomainSeparator, 2)
+		if len(domainAndField) != 2 {
+			errs = append(errs, fmt.Errorf("VPA annotation is invalid: %s", key))
+			continue
+		}
+		domain, field := domainAndField[0], domainAndField[1]
+		containerName := vpaAllContainers
+		if domain != k.vpaPrefix {
+			containerName = strings.TrimSuffix(domain, annotationSubDomainSeparator+k.vpaPrefix)
+			if len(validation.IsDNS1123Label(containerName)) > 0 {
+				errs = append(errs, fmt.Errorf("%s: container name %q is invalid", key, containerName))
+				continue
+			}
+		}
+
+		switch field {
+		case vpaUpdateMode:
+			if containerName != vpaAllContainers {
+				errs = append(errs, fmt.Errorf("%s: updateMode can't be set for a single container", key))
+			} else if value != vpaUpdateModeOff && value != vpaUpdateModeInitial {
+				errs = append(errs, fmt.Errorf("%s value is invalid: %s, it should be %s or %s", key, value, vpaUpdateModeOff, vpaUpdateModeInitial))
+			} else {
+				updateMode = value
+			}
+		case vpaControlledResources:
+			controlled, err := parseVPAResourceNames(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s value is invalid: %v", key, err))
+				continue
+			}
+			policy(containerName).ControlledResources = controlled
+		case vpaMinAllowed, vpaMaxAllowed:
+			resources, err := parseVPAResourceList(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s value is invalid: %v", key, err))
+				continue
+			}
+			if field == vpaMinAllowed {
+				policy(containerName).MinAllowed = resources
+			} else {
+				policy(containerName).MaxAllowed = resources
+			}
+		default:
+			errs = append(errs, fmt.Errorf("VPA annotation is invalid: %s", key))
+		}
+	}
+
+	containerNames := make([]string, 0, len(policies))
+	for containerName := range policies {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+	for _, containerName := range containerNames {
+		p := policies[containerName]
+		for _, resourceName := range vpaResources {
+			min, hasMin := p.MinAllowed[resourceName]
+			max, hasMax := p.MaxAllowed[resourceName]
+			if hasMin && hasMax && min.Cmp(max) > 0 {
+				errs = append(errs, fmt.Errorf("VPA of container %s: minAllowed %s should not be greater than maxAllowed", containerName, resourceName))
+			}
+		}
+	}
+
+	if updateMode == vpaUpdateModeInitial && hpa != nil {
+		// the containers without a policy of their own get the default one, controlling every resource
+		allContainers, ok := policies[vpaAllContainers]
+		if !ok {
+			allContainers = &vpaContainerPolicy{ContainerName: vpaAllContainers}
+		}
+		for _, metric := range hpa.Spec.Metrics {
+			if metric.Resource == nil {
+				continue
+			}
+			controlled := allContainers.controls(metric.Resource.Name)
+			for _, p := range policies {
+				controlled = controlled || p.controls(metric.Resource.Name)
+			}
+			if controlled {
+				errs = append(errs, fmt.Errorf("VPA in %s mode can't control %s, the HPA scales on it", updateMode, metric.Resource.Name))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, &InvalidAnnotationsError{Errors: errs}
+	}
+
+	spec := verticalPodAutoscalerSpec{
+		TargetRef:    autoscalingv1.CrossVersionObjectReference{APIVersion: apiVersion, Kind: kind, Name: name},
+		UpdatePolicy: vpaUpdatePolicy{UpdateMode: updateMode},
+	}
+	if len(containerNames) > 0 {
+		spec.ResourcePolicy = &vpaResourcePolicy{}
+		for _, containerName := range containerNames {
+			spec.ResourcePolicy.ContainerPolicies = append(spec.ResourcePolicy.ContainerPolicies, *policies[containerName])
+		}
+	}
+	return newVerticalPodAutoscaler(UID, name, namespace, kind, apiVersion, spec)
+}
+
+// newVerticalPodAutoscaler returns a VPA owned by the workload, the same way as the HPA
+func newVerticalPodAutoscaler(UID types.UID, name string, namespace string, kind string, apiVersion string, spec verticalPodAutoscalerSpec) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	unstructuredSpec := make(map[string]interface{})
+	if err := json.Unmarshal(data, &unstructuredSpec); err != nil {
+		return nil, err
+	}
+
+	vpa := &unstructured.Unstructured{Object: map[string]interface{}{"spec": unstructuredSpec}}
+	vpa.SetGroupVersionKind(vpaGroupVersionKind)
+	vpa.SetName(name)
+	vpa.SetNamespace(namespace)
+	vpa.SetOwnerReferences(newOwnerReferences(UID, name, kind, apiVersion))
+	return vpa, nil
+}
+
+// parseVPAResourceNames parses a comma separated list of resource names, e.g. cpu,memory
+func parseVPAResourceNames(value string) ([]corev1.ResourceName, error) {
+	var resourceNames []corev1.ResourceName
+	seen := make(map[corev1.ResourceName]bool)
+	for _, item := range strings.Split(value, ",") {
+		resourceName := corev1.ResourceName(strings.TrimSpace(item))
+		if resourceName != corev1.ResourceCPU && resourceName != corev1.ResourceMemory {
+			return nil, fmt.Errorf("resource %q should be %s or %s", resourceName, corev1.ResourceCPU, corev1.ResourceMemory)
+		}
+		if seen[resourceName] {
+			return nil, fmt.Errorf("resource %s is listed more than once", resourceName)
+		}
+		seen[resourceName] = true
+		resourceNames = append(resourceNames, resourceName)
+	}
+	return resourceNames, nil
+}
+
+// parseVPAResourceList parses comma separated resource quantities, e.g. cpu=100m,memory=128Mi
+func parseVPAResourceList(value string) (corev1.ResourceList, error) {
+	resources := make(corev1.ResourceList)
+	for _, item := range strings.Split(value, ",") {
+		nameAndQuantity := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(nameAndQuantity) != 2 {
+			return nil, fmt.Errorf("%q should be a resource=quantity pair", item)
+		}
+		resourceNames, err := parseVPAResourceNames(nameAndQuantity[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := resources[resourceNames[0]]; ok {
+			return nil, fmt.Errorf("resource %s is listed more than once", resourceNames[0])
+		}
+		quantity, err := resource.ParseQuantity(nameAndQuantity[1])
+		if err != nil {
+			return nil, fmt.Errorf("quantity of %s is invalid: %v", resourceNames[0], err)
+		}
+		if quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("quantity of %s should be positive", resourceNames[0])
+		}
+		resources[resourceNames[0]] = quantity
+	}
+	return resources, nil
+}
+
+// handleVerticalPodAutoscaler keeps the VPA in sync with the VPA annotations, hpa is the HPA
+// generated for the workload, if any. The returned status is nil if the workload has no VPA.
+// Workloads without VPA annotations and VPA status are skipped without talking to the API server,
+// the VPA is only looked up to be deleted if the status shows it was generated before.
+func (h *HPAHandler) handleVerticalPodAutoscaler(
+	ctx context.Context,
+	UID types.UID,
+	name string, namespace string,
+	kind string, apiVersion string,
+	annotations map[string]string, podAnnotations map[string]string,
+	hpa *v2beta2.HorizontalPodAutoscaler) (*workloadStatus, error) {
+
+	log := LoggerFromContext(ctx)
+	workloadAnnotations := h.filterVPAAnnotations(annotations)
+	podTemplateAnnotations := h.filterVPAAnnotations(podAnnotations)
+	vpaAnnotationsFound := len(workloadAnnotations) > 0 || len(podTemplateAnnotations) > 0
+	if _, ok := annotations[h.keys.vpaStatus]; !ok && !vpaAnnotationsFound {
+		return nil, nil
+	}
+
+	var desired *unstructured.Unstructured
+	var invalidErr error
+	if vpaAnnotationsFound {
+		strategy := annotations[h.keys.mergeStrategy]
+		vpaAnnotations, conflicts, err := h.keys.mergeAutoscaleAnnotations(strategy, workloadAnnotations, podTemplateAnnotations)
+		if err != nil {
+			invalidErr = &InvalidAnnotationsError{Errors: []error{err}}
+		} else {
+			ref := &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name, Namespace: namespace, UID: UID}
+			h.reportConflicts(ctx, ref, strategy, conflicts)
+			desired, invalidErr = h.keys.createVerticalPodAutoscaler(UID, name, namespace, kind, apiVersion, vpaAnnotations, hpa)
+		}
+		if invalidErr != nil {
+			log.Error(invalidErr, "invalid VPA annotations")
+			desired = nil
+		} else if h.instanceID != "" {
+			desired.SetLabels(map[string]string{h.keys.instance: h.instanceID})
+		}
+	}
+
+	h.clearDryRun(vpaGroupVersionKind.Kind, name, namespace)
+	vpa := &unstructured.Unstructured{}
+	vpa.SetGroupVersionKind(vpaGroupVersionKind)
+	err := h.client.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, vpa)
+	exists := err == nil
+	switch {
+	case err == nil:
+	case meta.IsNoMatchError(err):
+		log.Info("VerticalPodAutoscaler API is not installed")
+		if !vpaAnnotationsFound {
+			return nil, nil
+		}
+		return &workloadStatus{Phase: phaseError, Error: "VerticalPodAutoscaler API " + vpaGroupVersionKind.GroupVersion().String() + " is not installed"}, nil
+	case errors.IsNotFound(err):
+		log.V(1).Info("VerticalPodAutoscaler doesn't exist")
+	default:
+		log.Error(err, "failed to get VerticalPodAutoscaler")
+		return &workloadStatus{Phase: phaseError, Error: err.Error()}, err
+	}
+
+	if exists {
+		if !isCreatedByHpaController(vpa, name, kind) {
+			log.Info("VerticalPodAutoscaler is not created by us")
+			if !vpaAnnotationsFound {
+				return nil, nil
+			}
+			return &workloadStatus{
+				Phase: phaseConflict,
+				Error: "VerticalPodAutoscaler " + name + " exists and is not owned by this " + kind,
+			}, nil
+		}
+		if instanceID := vpa.GetLabels()[h.keys.instance]; instanceID != h.instanceID {
+			log.Info("VerticalPodAutoscaler is managed by another operator instance", "instance", instanceID)
+			if !vpaAnnotationsFound {
+				return nil, nil
+			}
+			return &workloadStatus{
+				Phase: phaseConflict,
+				Error: fmt.Sprintf("VerticalPodAutoscaler %s is managed by the operator instance %q", name, instanceID),
+			}, nil
+		}
+
+		if !vpaAnnotationsFound {
+			log.Info("VerticalPodAutoscaler found, will be deleted")
+			h.reportDryRun(ctx, vpaGroupVersionKind.Kind, name, namespace, vpa, nil)
+			if err := h.client.Delete(ctx, vpa); err != nil && !errors.IsNotFound(err) {
+				log.Error(err, "failed to delete VerticalPodAutoscaler")
+				return &workloadStatus{Phase: phaseError, VPA: name, Error: err.Error()}, err
+			}
+			return nil, nil
+		}
+		if desired == nil {
+			return &workloadStatus{Phase: phaseInvalid, VPA: name, Error: invalidErr.Error()}, nil
+		}
+		log.Info("VerticalPodAutoscaler found, will be updated")
+		desired.SetResourceVersion(vpa.GetResourceVersion())
+		h.reportDryRun(ctx, vpaGroupVersionKind.Kind, name, namespace, vpa, desired)
+		if err := h.client.Update(ctx, desired); err != nil {
+			log.Error(err, "failed to update VerticalPodAutoscaler")
+			return &workloadStatus{Phase: phaseError, VPA: name, Error: err.Error()}, err
+		}
+	} else {
+		if !vpaAnnotationsFound {
+			return nil, nil
+		}
+		if desired == nil {
+			return &workloadStatus{Phase: phaseInvalid, Error: invalidErr.Error()}, nil
+		}
+		log.Info("VerticalPodAutoscaler doesn't exist, will be created")
+		h.reportDryRun(ctx, vpaGroupVersionKind.Kind, name, namespace, nil, desired)
+		if err := h.client.Create(ctx, desired); err != nil && !errors.IsAlreadyExists(err) {
+			log.Error(err, "failed to create VerticalPodAutoscaler")
+			return &workloadStatus{Phase: phaseError, Error: err.Error()}, err
+		}
+	}
+	return &workloadStatus{Phase: phaseActive, VPA: name}, nil
+}
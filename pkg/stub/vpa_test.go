@@ -0,0 +1,263 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCreateVerticalPodAutoscaler(t *testing.T) {
+
+	cpuHPA := &v2beta2.HorizontalPodAutoscaler{
+		Spec: v2beta2.HorizontalPodAutoscalerSpec{
+			Metrics: []v2beta2.MetricSpec{
+				{Type: v2beta2.ResourceMetricSourceType, Resource: &v2beta2.ResourceMetricSource{Name: corev1.ResourceCPU}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		hpa          *v2beta2.HorizontalPodAutoscaler
+		expectedSpec string
+		expectedErr  []string
+	}{
+		{
+			name: "defaults",
+			annotations: map[string]string{
+				"vpa.autoscaling.banzaicloud.io/updateMode": "Off",
+			},
+			expectedSpec: `{"targetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"updatePolicy":{"updateMode":"Off"}}`,
+		},
+		{
+			name: "container policies",
+			annotations: map[string]string{
+				"vpa.autoscaling.banzaicloud.io/updateMode":                  "Initial",
+				"vpa.autoscaling.banzaicloud.io/controlledResources":         "memory",
+				"vpa.autoscaling.banzaicloud.io/maxAllowed":                  "memory=1Gi",
+				"app.vpa.autoscaling.banzaicloud.io/minAllowed":              "memory=128Mi",
+				"sidecar.vpa.autoscaling.banzaicloud.io/maxAllowed":          "memory=64Mi",
+				"sidecar.vpa.autoscaling.banzaicloud.io/controlledResources": "memory",
+				"app.vpa.autoscaling.banzaicloud.io/controlledResources":     "memory",
+			},
+			hpa: cpuHPA,
+			expectedSpec: `{"resourcePolicy":{"containerPolicies":[` +
+				`{"containerName":"*","controlledResources":["memory"],"maxAllowed":{"memory":"1Gi"}},` +
+				`{"containerName":"app","controlledResources":["memory"],"minAllowed":{"memory":"128Mi"}},` +
+				`{"containerName":"sidecar","controlledResources":["memory"],"maxAllowed":{"memory":"64Mi"}}]},` +
+				`"targetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"updatePolicy":{"updateMode":"Initial"}}`,
+		},
+		{
+			name: "recommendations don't conflict with the HPA",
+			annotations: map[string]string{
+				"vpa.autoscaling.banzaicloud.io/updateMode": "Off",
+			},
+			hpa:          cpuHPA,
+			expectedSpec: `{"targetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"test"},"updatePolicy":{"updateMode":"Off"}}`,
+		},
+		{
+			name: "conflicts with the HPA",
+			annotations: map[string]string{
+				"vpa.autoscaling.banzaicloud.io/updateMode":          "Initial",
+				"vpa.autoscaling.banzaicloud.io/controlledResources": "memory",
+				"app.vpa.autoscaling.banzaicloud.io/minAllowed":      "cpu=100m",
+			},
+			hpa:         cpuHPA,
+			expectedErr: []string{"VPA in Initial mode can't control cpu, the HPA scales on it"},
+		},
+		{
+			name: "invalid annotations",
+			annotations: map[string]string{
+				"vpa.autoscaling.banzaicloud.io/updateMode":          "Auto",
+				"app.vpa.autoscaling.banzaicloud.io/updateMode":      "Off",
+				"vpa.autoscaling.banzaicloud.io/controlledResources": "cpu,gpu",
+				"vpa.autoscaling.banzaicloud.io/minAllowed":          "cpu=1,memory=1Gi",
+				"vpa.autoscaling.banzaicloud.io/maxAllowed":          "cpu=500m,memory",
+				"app.vpa.autoscaling.banzaicloud.io/minAllowed":      "cpu=1",
+				"app.vpa.autoscaling.banzaicloud.io/maxAllowed":      "cpu=500m",
+				"vpa.autoscaling.banzaicloud.io/mode":                "Off",
+				"App.vpa.autoscaling.banzaicloud.io/minAllowed":      "cpu=1",
+			},
+			expectedErr: []string{
+				`App.vpa.autoscaling.banzaicloud.io/minAllowed: container name "App" is invalid`,
+				"app.vpa.autoscaling.banzaicloud.io/updateMode: updateMode can't be set for a single container",
+				`vpa.autoscaling.banzaicloud.io/controlledResources value is invalid: resource "gpu" should be cpu or memory`,
+				`vpa.autoscaling.banzaicloud.io/maxAllowed value is invalid: "memory" should be a resource=quantity pair`,
+				"VPA annotation is invalid: vpa.autoscaling.banzaicloud.io/mode",
+				"vpa.autoscaling.banzaicloud.io/updateMode value is invalid: Auto, it should be Off or Initial",
+				"VPA of container app: minAllowed cpu should not be greater than maxAllowed",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vpa, err := defaultAnnotationKeys.createVerticalPodAutoscaler("uid", "test", "default", "Deployment", "apps/v1", test.annotations, test.hpa)
+			if len(test.expectedErr) > 0 {
+				if vpa != nil {
+					t.Errorf("VPA should not be generated from invalid annotations: %v", vpa)
+				}
+				if err == nil {
+					t.Fatalf("Error expected: %v", test.expectedErr)
+				}
+				for _, expected := range test.expectedErr {
+					if !strings.Contains(err.Error(), expected) {
+						t.Errorf("Error expected: %v actual: %v", expected, err)
+					}
+				}
+				if errs := err.(*InvalidAnnotationsError).Errors; len(errs) != len(test.expectedErr) {
+					t.Errorf("Errors expected: %v actual: %v", len(test.expectedErr), errs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if vpa.GetAPIVersion() != "autoscaling.k8s.io/v1" || vpa.GetKind() != "VerticalPodAutoscaler" {
+				t.Errorf("VPA kind expected: %v actual: %v", vpaGroupVersionKind, vpa.GroupVersionKind())
+			}
+			if owners := vpa.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != "uid" {
+				t.Errorf("VPA should be owned by the workload: %v", owners)
+			}
+			spec, _ := json.Marshal(vpa.Object["spec"])
+			if string(spec) != test.expectedSpec {
+				t.Errorf("VPA spec expected: %s actual: %s", test.expectedSpec, spec)
+			}
+		})
+	}
+}
+
+// noVPAClient fails like a client of a cluster without the VPA CRD
+type noVPAClient struct {
+	client.Client
+}
+
+func (c noVPAClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		return &meta.NoKindMatchError{GroupKind: vpaGroupVersionKind.GroupKind(), SearchedVersions: []string{vpaGroupVersionKind.Version}}
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestHandleReplicaSetVerticalPodAutoscaler(t *testing.T) {
+
+	annotations := map[string]string{
+		"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+		"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+		"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+		"vpa.autoscaling.banzaicloud.io/updateMode":                   "Initial",
+		"vpa.autoscaling.banzaicloud.io/controlledResources":          "memory",
+	}
+
+	tests := []struct {
+		name             string
+		vpaInstalled     bool
+		annotations      map[string]string
+		expectedPhase    string
+		expectedVPAPhase string
+	}{
+		{
+			name:             "VPA is created next to the HPA",
+			vpaInstalled:     true,
+			annotations:      annotations,
+			expectedPhase:    phaseActive,
+			expectedVPAPhase: phaseActive,
+		},
+		{
+			name:         "VPA conflicting with the HPA is refused",
+			vpaInstalled: true,
+			annotations: map[string]string{
+				"hpa.autoscaling.banzaicloud.io/minReplicas":                  "1",
+				"hpa.autoscaling.banzaicloud.io/maxReplicas":                  "3",
+				"cpu.hpa.autoscaling.banzaicloud.io/targetAverageUtilization": "80",
+				"vpa.autoscaling.banzaicloud.io/updateMode":                   "Initial",
+			},
+			expectedPhase:    phaseActive,
+			expectedVPAPhase: phaseInvalid,
+		},
+		{
+			name:             "VPA API is not installed",
+			annotations:      annotations,
+			expectedPhase:    phaseActive,
+			expectedVPAPhase: phaseError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid", Annotations: test.annotations},
+			}
+			var c client.Client = fake.NewFakeClientWithScheme(scheme, deployment)
+			if !test.vpaInstalled {
+				c = noVPAClient{Client: c}
+			}
+			handler, err := NewHandler(c, nil, Options{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", deployment.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			actual := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, actual); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for key, expected := range map[string]string{handler.keys.status: test.expectedPhase, handler.keys.vpaStatus: test.expectedVPAPhase} {
+				var status workloadStatus
+				if err := json.Unmarshal([]byte(actual.Annotations[key]), &status); err != nil {
+					t.Fatalf("Status annotation %v is invalid: %v", key, err)
+				}
+				if status.Phase != expected {
+					t.Errorf("Phase of %v expected: %v actual: %v (%v)", key, expected, status.Phase, status.Error)
+				}
+			}
+
+			if !test.vpaInstalled {
+				return
+			}
+			vpa := &unstructured.Unstructured{}
+			vpa.SetGroupVersionKind(vpaGroupVersionKind)
+			err = c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, vpa)
+			if created := err == nil; created != (test.expectedVPAPhase == phaseActive) {
+				t.Fatalf("VPA created expected: %v actual: %v", test.expectedVPAPhase == phaseActive, err)
+			}
+			if err != nil {
+				return
+			}
+
+			// the VPA is deleted along with its annotations
+			delete(actual.Annotations, "vpa.autoscaling.banzaicloud.io/updateMode")
+			delete(actual.Annotations, "vpa.autoscaling.banzaicloud.io/controlledResources")
+			err = handler.HandleReplicaSet(ctx, deployment.UID, deployment.Name, deployment.Namespace,
+				"Deployment", "apps/v1", actual.Annotations, nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := c.Get(ctx, client.ObjectKey{Name: "test", Namespace: "default"}, vpa); err == nil {
+				t.Errorf("VPA should be deleted: %v", vpa)
+			}
+		})
+	}
+}